@@ -5,6 +5,7 @@ import (
 	"crypto/rand"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"strings"
 	"time"
 )
@@ -21,45 +22,87 @@ type authenicateMessage struct {
 
 	NegotiateFlags negotiateFlags
 
+	// only sent if not nil, along with negotiateFlag_NTLMSSP_NEGOTIATE_VERSION
+	Version *Version
+
+	// only sent if not nil, after the version
 	MIC []byte
 }
 
 type authenticateMessageFields struct {
 	messageHeader
-	LmChallengeResponse varField
-	NtChallengeResponse varField
-	TargetName          varField
-	UserName            varField
-	Workstation         varField
-	_                   [8]byte
-	NegotiateFlags      negotiateFlags
+	LmChallengeResponse       varField
+	NtChallengeResponse       varField
+	TargetName                varField
+	UserName                  varField
+	Workstation               varField
+	EncryptedRandomSessionKey varField
+	NegotiateFlags            negotiateFlags
 }
 
+// micOffset is the offset of the MIC in AUTHENTICATE messages that carry
+// one, after the fixed fields and the version.
+const micOffset = 72
+
 func (m authenicateMessage) MarshalBinary() ([]byte, error) {
+	encode := toUnicode
 	if !m.NegotiateFlags.Has(negotiateFlagNTLMSSPNEGOTIATEUNICODE) {
-		return nil, errors.New("Only unicode is supported")
+		if !m.NegotiateFlags.Has(negotiateFlagNTLMNEGOTIATEOEM) {
+			return nil, errors.New("Only unicode and OEM are supported")
+		}
+		encode = toOEM
 	}
 
-	target, user := toUnicode(m.TargetName), toUnicode(m.UserName)
-	workstation := toUnicode("")
+	target, user := encode(m.TargetName), encode(m.UserName)
+	workstation := encode("")
+	for _, f := range []struct {
+		name string
+		b    []byte
+	}{
+		{"LmChallengeResponse", m.LmChallengeResponse},
+		{"NtChallengeResponse", m.NtChallengeResponse},
+		{"TargetName", target},
+		{"UserName", user},
+		{"EncryptedRandomSessionKey", m.EncryptedRandomSessionKey},
+	} {
+		if err := checkVarFieldLen(f.name, len(f.b)); err != nil {
+			return nil, err
+		}
+	}
 
 	ptr := binary.Size(&authenticateMessageFields{})
+	if m.MIC != nil && m.Version == nil {
+		return nil, errors.New("ntlmssp: a MIC can only be sent along with the version")
+	}
+	if m.Version != nil {
+		ptr += binary.Size(m.Version) + len(m.MIC)
+	}
 	f := authenticateMessageFields{
-		messageHeader:       newMessageHeader(3),
-		NegotiateFlags:      m.NegotiateFlags,
-		LmChallengeResponse: newVarField(&ptr, len(m.LmChallengeResponse)),
-		NtChallengeResponse: newVarField(&ptr, len(m.NtChallengeResponse)),
-		TargetName:          newVarField(&ptr, len(target)),
-		UserName:            newVarField(&ptr, len(user)),
-		Workstation:         newVarField(&ptr, len(workstation)),
+		messageHeader:             newMessageHeader(3),
+		NegotiateFlags:            m.NegotiateFlags,
+		LmChallengeResponse:       newVarField(&ptr, len(m.LmChallengeResponse)),
+		NtChallengeResponse:       newVarField(&ptr, len(m.NtChallengeResponse)),
+		TargetName:                newVarField(&ptr, len(target)),
+		UserName:                  newVarField(&ptr, len(user)),
+		Workstation:               newVarField(&ptr, len(workstation)),
+		EncryptedRandomSessionKey: newVarField(&ptr, len(m.EncryptedRandomSessionKey)),
 	}
 
 	f.NegotiateFlags.Unset(negotiateFlagNTLMSSPNEGOTIATEVERSION)
+	if m.Version != nil {
+		f.NegotiateFlags |= negotiateFlagNTLMSSPNEGOTIATEVERSION
+	}
 
 	b := bytes.Buffer{}
 	if err := binary.Write(&b, binary.LittleEndian, &f); err != nil {
 		return nil, err
 	}
+	if m.Version != nil {
+		if err := binary.Write(&b, binary.LittleEndian, m.Version); err != nil {
+			return nil, err
+		}
+		b.Write(m.MIC)
+	}
 	if err := binary.Write(&b, binary.LittleEndian, &m.LmChallengeResponse); err != nil {
 		return nil, err
 	}
@@ -75,6 +118,9 @@ func (m authenicateMessage) MarshalBinary() ([]byte, error) {
 	if err := binary.Write(&b, binary.LittleEndian, &workstation); err != nil {
 		return nil, err
 	}
+	if err := binary.Write(&b, binary.LittleEndian, &m.EncryptedRandomSessionKey); err != nil {
+		return nil, err
+	}
 
 	return b.Bytes(), nil
 }
@@ -89,20 +135,132 @@ func ProcessChallenge(challengeMessageData []byte, domain, user, password string
 func ProcessChallengeWithHash(
 	challengeMessageData []byte, domain, user string, hash []byte,
 ) ([]byte, error) {
-	if user == "" && len(hash) == 0 {
-		return nil, errors.New("Anonymous authentication not supported")
+	msg, _, err := processChallenge(challengeMessageData, domain, user, hash, authenticateOptions{})
+	return msg, err
+}
+
+// AuthenticateOptions tweak how BuildAuthenticate builds the AUTHENTICATE
+// message. The fields have the same meaning as those of Client.
+type AuthenticateOptions struct {
+	TargetInfo      []AVPair
+	ClientChallenge []byte
+	SingleHost      *SingleHostData
+	ChannelBindings *ChannelBindings
+	Identify        bool
+	Version         *Version
+	ForceOEM        bool
+	RefuseNTLMv1    bool
+	OmitTimestamp   bool
+	ZeroLMResponse  bool
+	Now             func() time.Time
+}
+
+// BuildAuthenticate builds the AUTHENTICATE message in response to a
+// CHALLENGE message without a live server, e.g. to reproduce a handshake from
+// a challenge captured in logs. The result still needs to be base64 encoded
+// for HTTP.
+func BuildAuthenticate(challenge []byte, creds Credential, opts AuthenticateOptions) ([]byte, error) {
+	hash := creds.ntlmHash()
+	if creds.Hash == nil {
+		defer clear(hash)
 	}
+	msg, _, err := processChallenge(challenge, creds.Domain, creds.User, hash, authenticateOptions{
+		targetInfo:      opts.TargetInfo,
+		clientChallenge: opts.ClientChallenge,
+		singleHost:      opts.SingleHost,
+		channelBindings: opts.ChannelBindings,
+		identify:        opts.Identify,
+		version:         opts.Version,
+		forceOEM:        opts.ForceOEM,
+		refuseNTLMv1:    opts.RefuseNTLMv1,
+		omitTimestamp:   opts.OmitTimestamp,
+		zeroLMResponse:  opts.ZeroLMResponse,
+		now:             opts.Now,
+	})
+	return msg, err
+}
+
+// authenticateOptions tweaks how the AUTHENTICATE message is built.
+type authenticateOptions struct {
+	// targetInfo, if not nil, is sent in the NTLMv2 response instead of
+	// the target info received from the server.
+	targetInfo []AVPair
+	// clientChallenge, if not nil, is used instead of a random client
+	// challenge.
+	clientChallenge []byte
+	// singleHost, if not nil, is added to the target info as MsvAvSingleHost.
+	singleHost *SingleHostData
+	// channelBindings, if not nil, is added to the target info as
+	// MsvAvChannelBindings.
+	channelBindings *ChannelBindings
+	// bindingHash, if not nil, is the value of MsvAvChannelBindings to add
+	// if channelBindings isn't set.
+	bindingHash []byte
+	// identify requests an identify level token.
+	identify bool
+	// version, if not nil, is sent in the message.
+	version *Version
+	// negotiate is the NEGOTIATE message sent before the challenge. The
+	// MIC covers it, so it is only sent if negotiate is not nil.
+	negotiate []byte
+	// requireMIC sends a MIC, whether or not the server sent a timestamp.
+	requireMIC bool
+	// forceOEM encodes the strings of the message as OEM even if unicode
+	// was negotiated.
+	forceOEM bool
+	// refuseNTLMv1 rejects challenges that only allow an NTLMv1 response.
+	refuseNTLMv1 bool
+	// omitTimestamp leaves the timestamp of the NTLMv2 response all zero
+	// and drops MsvAvTimestamp from the target info echoed in it.
+	omitTimestamp bool
+	// zeroLMResponse sends Z(24) as the LM response when the LMv2 response
+	// is left out.
+	zeroLMResponse bool
+	// now, if not nil, is used instead of time.Now for the timestamp of the
+	// NTLMv2 response.
+	now func() time.Time
+}
+
+// ErrNTLMv1Refused is returned when the server's challenge only allows a
+// weak NTLMv1 response and NTLMv1 was refused.
+var ErrNTLMv1Refused = errors.New("ntlmssp: server only supports NTLMv1")
 
+// processChallenge builds the AUTHENTICATE message in response to a
+// CHALLENGE message, along with the session established by it.
+func processChallenge(
+	challengeMessageData []byte, domain, user string, hash []byte, opts authenticateOptions,
+) ([]byte, *Session, error) {
 	var cm challengeMessage
 	if err := cm.UnmarshalBinary(challengeMessageData); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	if cm.NegotiateFlags.Has(negotiateFlagNTLMSSPNEGOTIATELMKEY) {
-		return nil, errors.New("Only NTLM v2 is supported, but server requested v1 (NTLMSSP_NEGOTIATE_LM_KEY)")
+		return nil, nil, errors.New("Only NTLM v2 is supported, but server requested v1 (NTLMSSP_NEGOTIATE_LM_KEY)")
 	}
-	if cm.NegotiateFlags.Has(negotiateFlagNTLMSSPNEGOTIATEKEYEXCH) {
-		return nil, errors.New("Key exchange requested but not supported (NTLMSSP_NEGOTIATE_KEY_EXCH)")
+
+	if opts.refuseNTLMv1 && !cm.NegotiateFlags.Has(negotiateFlagNTLMSSPNEGOTIATEEXTENDEDSESSIONSECURITY) &&
+		!cm.NegotiateFlags.Has(negotiateFlagNTLMSSPNEGOTIATETARGETINFO) {
+		return nil, nil, ErrNTLMv1Refused
+	}
+
+	if user == "" && len(hash) == 0 {
+		// anonymous authentication: no NT response, an LM response of
+		// a single zero byte and no session key
+		am := authenicateMessage{
+			LmChallengeResponse: []byte{0},
+			TargetName:          domain,
+			NegotiateFlags:      cm.NegotiateFlags | negotiateFlagANONYMOUS,
+		}
+		msg, err := am.MarshalBinary()
+		if err != nil {
+			return nil, nil, err
+		}
+		return msg, newSession(cm.NegotiateFlags&am.NegotiateFlags, nil, true), nil
+	}
+
+	if len(hash) != 16 {
+		return nil, nil, errors.New("ntlmssp: NT hash must be 16 bytes long")
 	}
 
 	am := authenicateMessage{
@@ -110,26 +268,145 @@ func ProcessChallengeWithHash(
 		TargetName:     domain,
 		NegotiateFlags: cm.NegotiateFlags,
 	}
+	if opts.identify {
+		am.NegotiateFlags |= negotiateFlagNTLMSSPNEGOTIATEIDENTIFY
+	}
+	if opts.version != nil {
+		v := opts.version.withRevision()
+		am.Version = &v
+	}
+	if opts.forceOEM {
+		am.NegotiateFlags.Unset(negotiateFlagNTLMSSPNEGOTIATEUNICODE)
+		am.NegotiateFlags |= negotiateFlagNTLMNEGOTIATEOEM
+	}
 
-	timestamp := cm.TargetInfo[avIDMsvAvTimestamp]
+	timestamp := cm.TargetInfo[MsvAvTimestamp]
 	if timestamp == nil { // no time sent, take current time
-		ft := uint64(time.Now().UnixNano()) / 100
-		ft += 116444736000000000 // add time between unix & windows offset
+		now := time.Now
+		if opts.now != nil {
+			now = opts.now
+		}
+		timestamp = fileTime(now())
+	}
+	if opts.omitTimestamp {
 		timestamp = make([]byte, 8)
-		binary.LittleEndian.PutUint64(timestamp, ft)
 	}
 
-	clientChallenge := make([]byte, 8)
-	rand.Reader.Read(clientChallenge)
+	clientChallenge := opts.clientChallenge
+	if clientChallenge == nil {
+		clientChallenge = make([]byte, 8)
+		rand.Reader.Read(clientChallenge)
+	} else if len(clientChallenge) != 8 {
+		return nil, nil, errors.New("client challenge must be 8 bytes long")
+	}
 
+	// the strings of the message are OEM when the server only agreed to
+	// OEM, but the NTLMv2 hash always takes the user and domain in Unicode
 	ntlmV2Hash := hmacMd5(hash, toUnicode(strings.ToUpper(user)+domain))
 
-	am.NtChallengeResponse = computeNtlmV2Response(ntlmV2Hash,
-		cm.ServerChallenge[:], clientChallenge, timestamp, cm.TargetInfoRaw)
+	var added []AVPair
+	// the MIC and the version it follows are only sent on request, so that
+	// the AUTHENTICATE message stays the same for servers that don't check
+	// it, see https://msdn.microsoft.com/en-us/library/cc236676.aspx
+	sendMIC := opts.requireMIC && opts.negotiate != nil
+	if sendMIC {
+		var avFlags uint32
+		if v := cm.TargetInfo[MsvAvFlags]; len(v) == 4 {
+			avFlags = binary.LittleEndian.Uint32(v)
+		}
+		value := binary.LittleEndian.AppendUint32(nil, avFlags|msvAvFlagMIC)
+		added = append(added, AVPair{ID: MsvAvFlags, Value: value})
+		am.MIC = make([]byte, 16)
+		if am.Version == nil {
+			v := DefaultVersion()
+			am.Version = &v
+		}
+	}
+	if opts.singleHost != nil {
+		added = append(added, AVPair{ID: MsvAvSingleHost, Value: opts.singleHost.marshal()})
+	}
+	bindingHash := opts.bindingHash
+	if opts.channelBindings != nil {
+		bindingHash = opts.channelBindings.Hash()
+	}
+	if bindingHash != nil {
+		if len(bindingHash) != 16 {
+			return nil, nil, errors.New("ntlmssp: channel binding hash must be 16 bytes long")
+		}
+		added = append(added, AVPair{ID: MsvAvChannelBindings, Value: bindingHash})
+	}
+	// if the server sent no target info at all, the added AV pairs make up
+	// a target info of their own
+	targetInfo := cm.TargetInfoRaw
+	if opts.targetInfo != nil || added != nil || opts.omitTimestamp && cm.AVPairs != nil {
+		pairs := cm.AVPairs
+		if opts.targetInfo != nil {
+			pairs = opts.targetInfo
+		}
+		if opts.omitTimestamp {
+			var kept []AVPair
+			for _, p := range pairs {
+				if p.ID != MsvAvTimestamp {
+					kept = append(kept, p)
+				}
+			}
+			pairs = kept
+		}
+		targetInfo = marshalAVPairs(mergeAVPairs(pairs, added))
+	}
+	// the target info is echoed in the NTLMv2 response, after 48 bytes of
+	// NTProofStr, blob header and padding
+	if len(targetInfo) > maxVarFieldLen-48 {
+		return nil, nil, fmt.Errorf("ntlmssp: target info is %d bytes long, at most %d fit in an NTLMv2 response", len(targetInfo), maxVarFieldLen-48)
+	}
+
+	// the responses and the session base key are all keyed by the NTLMv2
+	// hash, so they share one HMAC
+	mac := newNtlmV2MAC(ntlmV2Hash)
+	am.NtChallengeResponse = mac.response(cm.ServerChallenge[:], clientChallenge, timestamp, targetInfo)
+
+	// the LMv2 response is left out when the server sent a timestamp, as
+	// MS-NLMP recommends, since the NTLMv2 response then covers it
+	if cm.TargetInfo[MsvAvTimestamp] == nil {
+		am.LmChallengeResponse = mac.lmV2Response(cm.ServerChallenge[:], clientChallenge)
+	} else if opts.zeroLMResponse {
+		am.LmChallengeResponse = make([]byte, 24)
+	}
+
+	// For NTLMv2 the key exchange key is the session base key
+	keyExchangeKey := mac.sessionBaseKey(am.NtChallengeResponse[:16])
+	exportedSessionKey := keyExchangeKey
+	if cm.NegotiateFlags.Has(negotiateFlagNTLMSSPNEGOTIATEKEYEXCH) {
+		exportedSessionKey = make([]byte, 16)
+		if _, err := rand.Read(exportedSessionKey); err != nil {
+			return nil, nil, err
+		}
+		am.EncryptedRandomSessionKey = rc4K(keyExchangeKey, exportedSessionKey)
+	}
 
-	if cm.TargetInfoRaw == nil {
-		am.LmChallengeResponse = computeLmV2Response(ntlmV2Hash,
-			cm.ServerChallenge[:], clientChallenge)
+	msg, err := am.MarshalBinary()
+	if err != nil {
+		return nil, nil, err
+	}
+	if sendMIC {
+		copy(msg[micOffset:], hmacMd5(exportedSessionKey, opts.negotiate, challengeMessageData, msg))
 	}
-	return am.MarshalBinary()
+	// the session uses the flags both sides agreed to
+	return msg, newSession(cm.NegotiateFlags&am.NegotiateFlags, exportedSessionKey, true), nil
+}
+
+// fileTime encodes t as a little-endian Windows FILETIME, i.e. the number of
+// 100ns intervals since January 1, 1601 UTC.
+func fileTime(t time.Time) []byte {
+	ft := t.Unix()*10000000 + int64(t.Nanosecond())/100
+	ft += 116444736000000000 // add time between unix & windows offset
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, uint64(ft))
+	return b
+}
+
+// parseFileTime is the inverse of fileTime.
+func parseFileTime(b []byte) time.Time {
+	ft := int64(binary.LittleEndian.Uint64(b)) - 116444736000000000
+	return time.Unix(ft/10000000, ft%10000000*100)
 }
@@ -0,0 +1,53 @@
+package ntlmssp
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestBuildAuthenticate(t *testing.T) {
+	creds := Credential{Domain: "isis", User: "malory", Password: []byte("guest")}
+	opts := AuthenticateOptions{
+		ClientChallenge: []byte("clientch"),
+		Now:             func() time.Time { return time.Date(2024, 2, 29, 12, 0, 0, 0, time.UTC) },
+	}
+	msg, err := BuildAuthenticate(unhex(t, exampleChallenge), creds, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	domain, user, err := unmarshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if domain != "isis" || user != "malory" {
+		t.Fatalf("expected isis\\malory, got %s\\%s", domain, user)
+	}
+	if string(creds.Password) != "guest" {
+		t.Fatal("expected the caller's password to be left alone")
+	}
+
+	// the same challenge, credentials and options reproduce the message
+	again, err := BuildAuthenticate(unhex(t, exampleChallenge), creds, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(msg, again) {
+		t.Fatalf("expected %x, got %x", msg, again)
+	}
+}
+
+func BenchmarkBuildAuthenticate(b *testing.B) {
+	challenge := unhex(b, exampleChallenge)
+	creds := Credential{Domain: "isis", User: "malory", Hash: GetNtlmHash("guest")}
+	opts := AuthenticateOptions{
+		ClientChallenge: []byte("clientch"),
+		Now:             func() time.Time { return time.Date(2024, 2, 29, 12, 0, 0, 0, time.UTC) },
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := BuildAuthenticate(challenge, creds, opts); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
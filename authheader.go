@@ -2,6 +2,7 @@ package ntlmssp
 
 import (
 	"encoding/base64"
+	"errors"
 	"strings"
 )
 
@@ -43,24 +44,69 @@ func (h authheader) IsNTLM() bool {
 	return false
 }
 
+// NegotiateData is like GetData, but only looks at the Negotiate scheme.
+func (h authheader) NegotiateData() ([]byte, error) {
+	for _, s := range h {
+		if strings.HasPrefix(s, "Negotiate") {
+			return authheader{s}.GetData()
+		}
+	}
+	return nil, nil
+}
+
 func (h authheader) GetData() ([]byte, error) {
 	for _, s := range h {
 		if strings.HasPrefix(string(s), "NTLM") || strings.HasPrefix(string(s), "Negotiate") || strings.HasPrefix(string(s), "Basic ") {
-			p := strings.Split(string(s), " ")
-			if len(p) < 2 {
+			_, token, ok := strings.Cut(string(s), " ")
+			if !ok {
 				return nil, nil
 			}
-			return base64.StdEncoding.DecodeString(string(p[1]))
+			// some proxies fold long headers or otherwise put whitespace
+			// into the token
+			return decodeToken(strings.Join(strings.Fields(token), ""))
 		}
 	}
 	return nil, nil
 }
 
+// tokenEncodings are tried in order to decode a token. Besides standard
+// base64, some intermediaries re-encode tokens URL-safe or drop the padding.
+var tokenEncodings = []*base64.Encoding{
+	base64.StdEncoding,
+	base64.RawStdEncoding,
+	base64.URLEncoding,
+	base64.RawURLEncoding,
+}
+
+// decodeToken decodes a base64 token in any of tokenEncodings. If none of
+// them fits, the error of standard base64 is returned.
+func decodeToken(token string) ([]byte, error) {
+	var first error
+	for _, enc := range tokenEncodings {
+		data, err := enc.DecodeString(token)
+		if err == nil {
+			return data, nil
+		}
+		if first == nil {
+			first = err
+		}
+	}
+	return nil, first
+}
+
 func (h authheader) GetBasicCreds() (username, password string, err error) {
-	d, err := h.GetData()
+	basic := h.Basic()
+	if basic == "" {
+		return "", "", errors.New("no basic authorization header")
+	}
+	d, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(basic, "Basic "))
 	if err != nil {
 		return "", "", err
 	}
-	parts := strings.SplitN(string(d), ":", 2)
-	return parts[0], parts[1], nil
+	// the user-id can't contain a colon, but the password can (RFC 7617)
+	username, password, ok := strings.Cut(string(d), ":")
+	if !ok {
+		return "", "", errors.New("malformed basic authorization credentials")
+	}
+	return username, password, nil
 }
@@ -0,0 +1,88 @@
+package ntlmssp
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+)
+
+func TestGetBasicCreds(t *testing.T) {
+	tables := []struct {
+		creds    string
+		user     string
+		password string
+		domain   string
+	}{
+		{"malory:guest", "malory", "guest", ""},
+		{"malory:a:b:c", "malory", "a:b:c", ""},
+		{"malory:", "malory", "", ""},
+		{"isis\\malory:a:b\\c", "malory", "a:b\\c", "isis"},
+		{"isis\\malory\\jr:guest", "malory\\jr", "guest", "isis"},
+	}
+	for _, table := range tables {
+		h := authheader{"Basic " + base64.StdEncoding.EncodeToString([]byte(table.creds))}
+		u, p, err := h.GetBasicCreds()
+		if err != nil {
+			t.Fatalf("%q: %v", table.creds, err)
+		}
+		user, domain := GetDomain(u)
+		if user != table.user || p != table.password || domain != table.domain {
+			t.Fatalf("%q: expected %q, %q, %q, got %q, %q, %q", table.creds,
+				table.user, table.password, table.domain, user, p, domain)
+		}
+	}
+}
+
+func TestGetBasicCredsMalformed(t *testing.T) {
+	for _, h := range []authheader{
+		{},
+		{"Basic " + base64.StdEncoding.EncodeToString([]byte("no colon"))},
+		{"Basic not base64!"},
+	} {
+		if _, _, err := h.GetBasicCreds(); err == nil {
+			t.Fatalf("%q: expected an error", h)
+		}
+	}
+}
+
+func TestGetDataWhitespace(t *testing.T) {
+	challenge := unhex(t, exampleChallenge)
+	token := base64.StdEncoding.EncodeToString(challenge)
+	for _, s := range []string{
+		"NTLM " + token,
+		"NTLM  " + token + " ",
+		"NTLM " + token[:4] + "\r\n " + token[4:],
+		"NTLM " + token[:10] + " \t" + token[10:20] + "\n" + token[20:],
+	} {
+		data, err := authheader{s}.GetData()
+		if err != nil {
+			t.Fatalf("%q: %v", s, err)
+		}
+		if !bytes.Equal(data, challenge) {
+			t.Fatalf("%q: expected %x, got %x", s, challenge, data)
+		}
+	}
+}
+
+func TestGetDataEncodings(t *testing.T) {
+	// a challenge whose base64 encoding has a / and needs padding
+	challenge := append(unhex(t, exampleChallenge), 0xfb, 0xff, 0xbf)
+	for _, enc := range []*base64.Encoding{
+		base64.StdEncoding,
+		base64.URLEncoding,
+		base64.RawStdEncoding,
+		base64.RawURLEncoding,
+	} {
+		s := "NTLM " + enc.EncodeToString(challenge)
+		data, err := authheader{s}.GetData()
+		if err != nil {
+			t.Fatalf("%q: %v", s, err)
+		}
+		if !bytes.Equal(data, challenge) {
+			t.Fatalf("%q: expected %x, got %x", s, challenge, data)
+		}
+	}
+	if _, err := (authheader{"NTLM not base64!"}).GetData(); err == nil {
+		t.Fatal("expected a token that isn't base64 to be refused")
+	}
+}
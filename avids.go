@@ -1,17 +1,168 @@
 package ntlmssp
 
-type avID uint16
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// AvID identifies the kind of an AV_PAIR, see https://msdn.microsoft.com/en-us/library/cc236646.aspx
+type AvID uint16
+
+// AV_PAIR identifiers defined by MS-NLMP
+const (
+	MsvAvEOL AvID = iota
+	MsvAvNbComputerName
+	MsvAvNbDomainName
+	MsvAvDNSComputerName
+	MsvAvDNSDomainName
+	MsvAvDNSTreeName
+	MsvAvFlags
+	MsvAvTimestamp
+	MsvAvSingleHost
+	MsvAvTargetName
+	MsvAvChannelBindings
+)
+
+// msvAvFlagMIC is the bit of MsvAvFlags telling that the AUTHENTICATE message
+// carries a MIC.
+const msvAvFlagMIC = 0x2
+
+// AVPair is a single attribute/value pair of the target information carried
+// in CHALLENGE messages and echoed in NTLMv2 responses.
+type AVPair struct {
+	ID    AvID
+	Value []byte
+}
+
+// parseAVPairs splits target information into its AV pairs, up to but not
+// including the terminating MsvAvEOL.
+func parseAVPairs(d []byte) ([]AVPair, error) {
+	var pairs []AVPair
+	for {
+		if len(d) < 4 {
+			return nil, errors.New("target info is not terminated by MsvAvEOL")
+		}
+		id := AvID(binary.LittleEndian.Uint16(d[0:]))
+		l := int(binary.LittleEndian.Uint16(d[2:]))
+		d = d[4:]
+		if id == MsvAvEOL {
+			return pairs, nil
+		}
+		if len(d) < l {
+			return nil, fmt.Errorf("AV pair %d extends beyond target info: want %d bytes, have %d", id, l, len(d))
+		}
+		pairs = append(pairs, AVPair{ID: id, Value: d[:l:l]})
+		d = d[l:]
+	}
+}
 
+// marshalAVPairs serializes pairs followed by a terminating MsvAvEOL. Any
+// MsvAvEOL among pairs is skipped, so that the terminating one stays last.
+func marshalAVPairs(pairs []AVPair) []byte {
+	b := bytes.Buffer{}
+	for _, p := range pairs {
+		if p.ID == MsvAvEOL {
+			continue
+		}
+		binary.Write(&b, binary.LittleEndian, p.ID)
+		binary.Write(&b, binary.LittleEndian, uint16(len(p.Value)))
+		b.Write(p.Value)
+	}
+	b.Write([]byte{0, 0, 0, 0})
+	return b.Bytes()
+}
+
+// clientAVOrder is the order in which the AV pairs added by the client
+// follow those of the server, as sent by Windows.
+var clientAVOrder = []AvID{MsvAvFlags, MsvAvSingleHost, MsvAvChannelBindings, MsvAvTargetName}
+
+// mergeAVPairs returns the target info for an NTLMv2 response: the pairs of
+// the server in their original order, followed by the pairs added by the
+// client in the order of clientAVOrder. A pair added by the client replaces
+// any server pair with the same ID, e.g. MsvAvFlags with the MIC bit set.
+// All other server pairs are kept byte for byte, duplicates included, since
+// the server checks MsvAvTimestamp and the MIC against what it sent.
+func mergeAVPairs(server, added []AVPair) []AVPair {
+	rank := func(id AvID) int {
+		for i, o := range clientAVOrder {
+			if o == id {
+				return i
+			}
+		}
+		return len(clientAVOrder)
+	}
+	added = append([]AVPair{}, added...)
+	sort.SliceStable(added, func(i, j int) bool { return rank(added[i].ID) < rank(added[j].ID) })
+
+	replaced := map[AvID]bool{}
+	for _, p := range added {
+		replaced[p.ID] = true
+	}
+	var pairs []AVPair
+	for _, p := range server {
+		if !replaced[p.ID] {
+			pairs = append(pairs, p)
+		}
+	}
+	return append(pairs, added...)
+}
+
+// SingleHostData is the value of an MsvAvSingleHost AV pair, which
+// identifies the client machine, see https://msdn.microsoft.com/en-us/library/cc236649.aspx
+// Servers can't ask for it in their challenge, so it is sent whenever it is
+// configured.
+type SingleHostData struct {
+	// CustomData is the Restriction_Encoding of the client's security
+	// context as sent by Windows, see SetIntegrityLevel, or all zero.
+	CustomData [8]byte
+	// MachineID identifies the client machine. If it is all zero, an
+	// identifier derived from the host name is used.
+	MachineID [32]byte
+}
+
+func (d *SingleHostData) marshal() []byte {
+	machineID := d.MachineID
+	if machineID == ([32]byte{}) {
+		machineID = defaultMachineID()
+	}
+	b := make([]byte, 48)
+	binary.LittleEndian.PutUint32(b[0:], uint32(len(b))) // Size
+	// followed by Z4, 4 bytes that must be zero
+	copy(b[8:], d.CustomData[:])
+	copy(b[16:], machineID[:])
+	return b
+}
+
+// Mandatory integrity levels of Windows, as sent in the Restriction_Encoding
+// of SingleHostData.
 const (
-	avIDMsvAvEOL avID = iota
-	avIDMsvAvNbComputerName
-	avIDMsvAvNbDomainName
-	avIDMsvAvDNSComputerName
-	avIDMsvAvDNSDomainName
-	avIDMsvAvDNSTreeName
-	avIDMsvAvFlags
-	avIDMsvAvTimestamp
-	avIDMsvAvSingleHost
-	avIDMsvAvTargetName
-	avIDMsvChannelBindings
+	IntegrityLevelLow    = 0x1000
+	IntegrityLevelMedium = 0x2000
+	IntegrityLevelHigh   = 0x3000
+	IntegrityLevelSystem = 0x4000
 )
+
+// SetIntegrityLevel sets CustomData to the Restriction_Encoding of a client
+// running at the given integrity level, e.g. IntegrityLevelMedium, i.e. an
+// LSAP_TOKEN_INFO_INTEGRITY as defined by MS-KILE: the Flags, which are 1 for
+// a UAC restricted token and 0 for a full token, followed by the level.
+func (d *SingleHostData) SetIntegrityLevel(level uint32, restricted bool) {
+	var flags uint32
+	if restricted {
+		flags = 1
+	}
+	binary.LittleEndian.PutUint32(d.CustomData[0:], flags)
+	binary.LittleEndian.PutUint32(d.CustomData[4:], level)
+}
+
+// defaultMachineID derives a machine ID that is stable for this host.
+func defaultMachineID() [32]byte {
+	hostname, _ := os.Hostname()
+	return sha256.Sum256([]byte("ntlmssp machine id\x00" + strings.ToLower(hostname)))
+}
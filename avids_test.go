@@ -0,0 +1,181 @@
+package ntlmssp
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMergeAVPairs(t *testing.T) {
+	server := []AVPair{
+		{ID: MsvAvNbDomainName, Value: []byte("D")},
+		{ID: MsvAvChannelBindings, Value: []byte("server")},
+		{ID: MsvAvNbComputerName, Value: []byte("C")},
+		{ID: MsvAvNbDomainName, Value: []byte("duplicate")},
+		{ID: MsvAvTimestamp, Value: []byte("T")},
+	}
+	added := []AVPair{
+		{ID: MsvAvTargetName, Value: []byte("N")},
+		{ID: MsvAvChannelBindings, Value: []byte("client")},
+		{ID: MsvAvSingleHost, Value: []byte("S")},
+		{ID: MsvAvFlags, Value: []byte("F")},
+	}
+	expected := []AVPair{
+		{ID: MsvAvNbDomainName, Value: []byte("D")},
+		{ID: MsvAvNbComputerName, Value: []byte("C")},
+		{ID: MsvAvNbDomainName, Value: []byte("duplicate")},
+		{ID: MsvAvTimestamp, Value: []byte("T")},
+		{ID: MsvAvFlags, Value: []byte("F")},
+		{ID: MsvAvSingleHost, Value: []byte("S")},
+		{ID: MsvAvChannelBindings, Value: []byte("client")},
+		{ID: MsvAvTargetName, Value: []byte("N")},
+	}
+	merged := mergeAVPairs(server, added)
+	if !reflect.DeepEqual(merged, expected) {
+		t.Fatalf("expected %q, got %q", expected, merged)
+	}
+
+	// the terminating MsvAvEOL stays last, even if given explicitly
+	pairs, err := parseAVPairs(marshalAVPairs(append([]AVPair{{ID: MsvAvEOL}}, merged...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(pairs, expected) {
+		t.Fatalf("expected %q, got %q", expected, pairs)
+	}
+}
+
+func TestClientKeepsServerAVPairs(t *testing.T) {
+	s := testServer("guest")
+	s.TargetInfo = []AVPair{
+		{ID: MsvAvNbDomainName, Value: toUnicode("DOMAIN")},
+		{ID: MsvAvNbComputerName, Value: toUnicode("SERVER")},
+		{ID: MsvAvDNSDomainName, Value: toUnicode("domain.com")},
+		{ID: MsvAvFlags, Value: []byte{0x01, 0, 0, 0}},
+		{ID: MsvAvTimestamp, Value: fileTime(time.Now())},
+		{ID: MsvAvNbComputerName, Value: toUnicode("SERVER2")},
+	}
+	s.RequireMIC = true
+	c := &Client{
+		Domain: "isis", User: "malory", Password: "guest",
+		RequireMIC:      true,
+		SingleHost:      &SingleHostData{},
+		ChannelBindings: &ChannelBindings{},
+	}
+	negotiate, err := c.Step(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	challenge, err := s.Step(negotiate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authenticate, err := c.Step(challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Step(authenticate); err != nil {
+		t.Fatalf("expected the MIC to verify, got %v", err)
+	}
+
+	// leaving out the pairs added by the client, and the MsvAvFlags it
+	// updated, the server's pairs are echoed as they were sent
+	var kept []AVPair
+	var avFlags []byte
+	for _, p := range ntlmV2ResponseAVPairs(t, authenticate) {
+		switch p.ID {
+		case MsvAvSingleHost, MsvAvChannelBindings:
+		case MsvAvFlags:
+			avFlags = p.Value
+		default:
+			kept = append(kept, p)
+		}
+	}
+	var expected []AVPair
+	for _, p := range s.TargetInfo {
+		if p.ID != MsvAvFlags {
+			expected = append(expected, p)
+		}
+	}
+	if !reflect.DeepEqual(kept, expected) {
+		t.Fatalf("expected server AV pairs %q, got %q", expected, kept)
+	}
+	if want := []byte{0x01 | msvAvFlagMIC, 0, 0, 0}; !bytes.Equal(avFlags, want) {
+		t.Fatalf("expected MsvAvFlags %x, got %x", want, avFlags)
+	}
+}
+
+func TestClientAVPairOrder(t *testing.T) {
+	c := Client{
+		Domain: "isis", User: "malory", Password: "guest",
+		SingleHost:      &SingleHostData{},
+		ChannelBindings: &ChannelBindings{},
+	}
+	if _, err := c.Step(nil); err != nil {
+		t.Fatal(err)
+	}
+	authenticate, err := c.Step(unhex(t, exampleChallenge))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []AvID
+	for _, p := range ntlmV2ResponseAVPairs(t, authenticate) {
+		ids = append(ids, p.ID)
+	}
+	// the example challenge's pairs, then those added by the client
+	expected := []AvID{
+		MsvAvNbDomainName, MsvAvNbComputerName, MsvAvDNSDomainName, MsvAvDNSComputerName,
+		MsvAvSingleHost, MsvAvChannelBindings,
+	}
+	if !reflect.DeepEqual(ids, expected) {
+		t.Fatalf("expected %v, got %v", expected, ids)
+	}
+}
+
+func TestSingleHostDataRestrictions(t *testing.T) {
+	d := SingleHostData{}
+	for i := range d.MachineID {
+		d.MachineID[i] = byte(0xa0 + i)
+	}
+	d.SetIntegrityLevel(IntegrityLevelMedium, true)
+	expected := append([]byte{
+		48, 0, 0, 0, // Size
+		0, 0, 0, 0, // Z4
+		1, 0, 0, 0, // Flags: UAC restricted token
+		0, 0x20, 0, 0, // TokenIL
+	}, d.MachineID[:]...)
+	if b := d.marshal(); !bytes.Equal(b, expected) {
+		t.Fatalf("expected %x, got %x", expected, b)
+	}
+
+	d.SetIntegrityLevel(IntegrityLevelHigh, false)
+	expected = append([]byte{
+		48, 0, 0, 0, // Size
+		0, 0, 0, 0, // Z4
+		0, 0, 0, 0, // Flags: full token
+		0, 0x30, 0, 0, // TokenIL
+	}, d.MachineID[:]...)
+	if b := d.marshal(); !bytes.Equal(b, expected) {
+		t.Fatalf("expected %x, got %x", expected, b)
+	}
+
+	// the AV pair is sent as is along with the NTLMv2 response
+	c := Client{Domain: "isis", User: "malory", Password: "guest", SingleHost: &d}
+	if _, err := c.Step(nil); err != nil {
+		t.Fatal(err)
+	}
+	authenticate, err := c.Step(unhex(t, exampleChallenge))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range ntlmV2ResponseAVPairs(t, authenticate) {
+		if p.ID == MsvAvSingleHost {
+			if !bytes.Equal(p.Value, expected) {
+				t.Fatalf("expected MsvAvSingleHost %x, got %x", expected, p.Value)
+			}
+			return
+		}
+	}
+	t.Fatal("no MsvAvSingleHost AV pair sent")
+}
@@ -0,0 +1,31 @@
+package ntlmssp
+
+import (
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/rc4"
+	"hash"
+)
+
+// cryptoBackend provides the cryptographic primitives NTLM is built on, none
+// of which are approved for FIPS mode. Builds for environments where the
+// standard library refuses to provide them can replace backend, e.g. from a
+// file with a build tag, with an implementation that gets them elsewhere.
+type cryptoBackend interface {
+	newMD4() hash.Hash
+	newMD5() hash.Hash
+	newRC4(key []byte) (cipher.Stream, error)
+}
+
+// backend is the cryptoBackend used by the package.
+var backend cryptoBackend = defaultBackend{}
+
+// defaultBackend uses the bundled MD4 and the standard library's MD5 and RC4.
+type defaultBackend struct{}
+
+func (defaultBackend) newMD4() hash.Hash { return newMD4() }
+func (defaultBackend) newMD5() hash.Hash { return md5.New() }
+
+func (defaultBackend) newRC4(key []byte) (cipher.Stream, error) {
+	return rc4.NewCipher(key)
+}
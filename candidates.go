@@ -0,0 +1,81 @@
+package ntlmssp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+)
+
+// authenticateCandidates tries CandidateCredentials in order until the
+// server accepts one, returning the last rejection if none is.
+func (l Negotiator) authenticateCandidates(req *http.Request) (*Result, error) {
+	// the body is sent once per attempt
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	candidates := l.CandidateCredentials
+	if l.MaxAttempts > 0 && l.MaxAttempts < len(candidates) {
+		candidates = candidates[:l.MaxAttempts]
+	}
+	for i, cred := range candidates {
+		attempt := l
+		attempt.CandidateCredentials = nil
+		attempt.Credentials = func(*http.Request) (Credential, error) {
+			// copied, since they are wiped after use
+			return cred.clone(), nil
+		}
+		done := func() {}
+		if i > 0 {
+			attempt.RoundTripper, done = freshConnections(l.RoundTripper)
+			// the fresh connections are closed once the attempt is
+			// done, so they aren't kept for others
+			attempt.PinAuthenticatedConnection = false
+		}
+		r := req.Clone(req.Context())
+		if body != nil {
+			r.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		result, err := attempt.authenticate(r)
+		var rejected *RejectedError
+		if errors.As(err, &rejected) {
+			if rejected.Reason == RejectCredentials && i < len(candidates)-1 {
+				l.drain(rejected.Response)
+				done()
+				continue
+			}
+			rejected.Response.Body = &releaseOnClose{ReadCloser: rejected.Response.Body, release: done}
+			return nil, err
+		}
+		if err != nil {
+			done()
+			return nil, err
+		}
+		result.Response.Body = &releaseOnClose{ReadCloser: result.Response.Body, release: done}
+		return result, nil
+	}
+	// not reached, the last attempt always returns
+	return nil, errors.New("ntlmssp: no candidate credentials")
+}
+
+// freshConnections returns a round tripper that doesn't reuse the
+// connections of rt, along with a function that closes its own once it is no
+// longer needed. Round trippers other than *http.Transport are returned as
+// they are.
+func freshConnections(rt http.RoundTripper) (http.RoundTripper, func()) {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	t, ok := rt.(*http.Transport)
+	if !ok {
+		return rt, func() {}
+	}
+	t = t.Clone()
+	return t, t.CloseIdleConnections
+}
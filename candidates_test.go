@@ -0,0 +1,64 @@
+package ntlmssp
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestNegotiatorCandidateCredentials(t *testing.T) {
+	var mu sync.Mutex
+	var conns []string // remote addresses of the AUTHENTICATE messages
+	handler := &Handler{NewServer: func(*http.Request) *Server { return testServer("guest") }}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var msgs [][]byte
+		recorder(func(http.ResponseWriter, *http.Request) {}, &msgs)(w, req)
+		if len(msgs) == 1 && msgs[0][8] == 3 {
+			mu.Lock()
+			conns = append(conns, req.RemoteAddr)
+			mu.Unlock()
+		}
+		handler.ServeHTTP(w, req)
+	}))
+	defer server.Close()
+
+	candidates := []Credential{
+		{Domain: "isis", User: "malory", Password: []byte("cached")},
+		{Domain: "isis", User: "malory", Password: []byte("guest")},
+	}
+	for _, tc := range []struct {
+		maxAttempts int
+		status      int
+		attempts    int
+	}{
+		{0, http.StatusOK, 2},
+		{1, http.StatusUnauthorized, 1},
+	} {
+		conns = nil
+		req, err := http.NewRequest(http.MethodPost, server.URL, strings.NewReader("body"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		negotiator := Negotiator{CandidateCredentials: candidates, MaxAttempts: tc.maxAttempts}
+		resp, err := negotiator.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Fatalf("max attempts %d: expected status %d, got %v", tc.maxAttempts, tc.status, resp.Status)
+		}
+		if len(conns) != tc.attempts {
+			t.Fatalf("max attempts %d: expected %d attempts, got %d", tc.maxAttempts, tc.attempts, len(conns))
+		}
+		if len(conns) == 2 && conns[0] == conns[1] {
+			t.Fatalf("max attempts %d: both attempts used the same connection", tc.maxAttempts)
+		}
+	}
+	if !bytes.Equal(candidates[0].Password, []byte("cached")) || !bytes.Equal(candidates[1].Password, []byte("guest")) {
+		t.Fatal("candidate credentials were wiped")
+	}
+}
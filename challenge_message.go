@@ -3,7 +3,6 @@ package ntlmssp
 import (
 	"bytes"
 	"encoding/binary"
-	"fmt"
 )
 
 type challengeMessageFields struct {
@@ -22,24 +21,25 @@ func (m challengeMessageFields) IsValid() bool {
 type challengeMessage struct {
 	challengeMessageFields
 	TargetName    string
-	TargetInfo    map[avID][]byte
+	TargetInfo    map[AvID][]byte
 	TargetInfoRaw []byte
+	AVPairs       []AVPair
 }
 
 func (m *challengeMessage) UnmarshalBinary(data []byte) error {
 	r := bytes.NewReader(data)
 	err := binary.Read(r, binary.LittleEndian, &m.challengeMessageFields)
 	if err != nil {
-		return err
+		return &ParseError{ChallengeMessageType, "header", err}
 	}
-	if !m.challengeMessageFields.IsValid() {
-		return fmt.Errorf("Message is not a valid challenge message: %+v", m.challengeMessageFields.messageHeader)
+	if err := m.challengeMessageFields.messageHeader.check(ChallengeMessageType); err != nil {
+		return &ParseError{ChallengeMessageType, "header", err}
 	}
 
 	if m.challengeMessageFields.TargetName.Len > 0 {
 		m.TargetName, err = m.challengeMessageFields.TargetName.ReadStringFrom(data, m.NegotiateFlags.Has(negotiateFlagNTLMSSPNEGOTIATEUNICODE))
 		if err != nil {
-			return err
+			return &ParseError{ChallengeMessageType, "TargetName", err}
 		}
 	}
 
@@ -47,34 +47,15 @@ func (m *challengeMessage) UnmarshalBinary(data []byte) error {
 		d, err := m.challengeMessageFields.TargetInfo.ReadFrom(data)
 		m.TargetInfoRaw = d
 		if err != nil {
-			return err
+			return &ParseError{ChallengeMessageType, "TargetInfo", err}
 		}
-		m.TargetInfo = make(map[avID][]byte)
-		r := bytes.NewReader(d)
-		for {
-			var id avID
-			var l uint16
-			err = binary.Read(r, binary.LittleEndian, &id)
-			if err != nil {
-				return err
-			}
-			if id == avIDMsvAvEOL {
-				break
-			}
-
-			err = binary.Read(r, binary.LittleEndian, &l)
-			if err != nil {
-				return err
-			}
-			value := make([]byte, l)
-			n, err := r.Read(value)
-			if err != nil {
-				return err
-			}
-			if n != int(l) {
-				return fmt.Errorf("Expected to read %d bytes, got only %d", l, n)
-			}
-			m.TargetInfo[id] = value
+		m.AVPairs, err = parseAVPairs(d)
+		if err != nil {
+			return &ParseError{ChallengeMessageType, "TargetInfo", err}
+		}
+		m.TargetInfo = make(map[AvID][]byte)
+		for _, p := range m.AVPairs {
+			m.TargetInfo[p.ID] = p.Value
 		}
 	}
 
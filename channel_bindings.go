@@ -0,0 +1,67 @@
+package ntlmssp
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/binary"
+)
+
+// ChannelBindings is the gss_channel_bindings_struct of RFC 2744 that binds
+// the authentication to an outer channel, typically TLS. Its MD5 hash is sent
+// to the server in an MsvAvChannelBindings AV pair.
+type ChannelBindings struct {
+	InitiatorAddrType uint32
+	InitiatorAddress  []byte
+	AcceptorAddrType  uint32
+	AcceptorAddress   []byte
+	ApplicationData   []byte
+}
+
+// TLSServerEndPoint returns the "tls-server-end-point" channel bindings of
+// RFC 5929 for a TLS connection to a server with the given certificate.
+func TLSServerEndPoint(cert *x509.Certificate) *ChannelBindings {
+	return &ChannelBindings{
+		ApplicationData: append([]byte("tls-server-end-point:"), certificateHash(cert)...),
+	}
+}
+
+// certificateHash returns the hash of cert used for tls-server-end-point
+// channel bindings, which depends on the algorithm the cert is signed with.
+func certificateHash(cert *x509.Certificate) []byte {
+	var h crypto.Hash
+	switch cert.SignatureAlgorithm {
+	case x509.SHA384WithRSA, x509.ECDSAWithSHA384, x509.SHA384WithRSAPSS:
+		h = crypto.SHA384
+	case x509.SHA512WithRSA, x509.ECDSAWithSHA512, x509.SHA512WithRSAPSS:
+		h = crypto.SHA512
+	default:
+		// including MD5 and SHA-1 signatures, which are replaced by SHA-256
+		h = crypto.SHA256
+	}
+	d := h.New()
+	d.Write(cert.Raw)
+	return d.Sum(nil)
+}
+
+// Marshal returns the flat encoding of the channel bindings that is hashed
+// for MsvAvChannelBindings.
+func (cb *ChannelBindings) Marshal() []byte {
+	b := bytes.Buffer{}
+	binary.Write(&b, binary.LittleEndian, cb.InitiatorAddrType)
+	binary.Write(&b, binary.LittleEndian, uint32(len(cb.InitiatorAddress)))
+	b.Write(cb.InitiatorAddress)
+	binary.Write(&b, binary.LittleEndian, cb.AcceptorAddrType)
+	binary.Write(&b, binary.LittleEndian, uint32(len(cb.AcceptorAddress)))
+	b.Write(cb.AcceptorAddress)
+	binary.Write(&b, binary.LittleEndian, uint32(len(cb.ApplicationData)))
+	b.Write(cb.ApplicationData)
+	return b.Bytes()
+}
+
+// Hash returns the value of the MsvAvChannelBindings AV pair.
+func (cb *ChannelBindings) Hash() []byte {
+	h := backend.newMD5()
+	h.Write(cb.Marshal())
+	return h.Sum(nil)
+}
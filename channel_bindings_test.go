@@ -0,0 +1,149 @@
+package ntlmssp
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestChannelBindingsMarshal(t *testing.T) {
+	cb := ChannelBindings{
+		InitiatorAddrType: 2,
+		InitiatorAddress:  []byte{192, 168, 0, 1},
+		AcceptorAddrType:  2,
+		AcceptorAddress:   []byte{10, 0, 0, 1},
+		ApplicationData:   []byte("custom"),
+	}
+	expected := []byte{
+		2, 0, 0, 0, 4, 0, 0, 0, 192, 168, 0, 1,
+		2, 0, 0, 0, 4, 0, 0, 0, 10, 0, 0, 1,
+		6, 0, 0, 0, 'c', 'u', 's', 't', 'o', 'm',
+	}
+	if b := cb.Marshal(); !bytes.Equal(b, expected) {
+		t.Fatalf("expected %x, got %x", expected, b)
+	}
+	if h, expected := cb.Hash(), md5.Sum(expected); !bytes.Equal(h, expected[:]) {
+		t.Fatalf("expected hash %x, got %x", expected, h)
+	}
+}
+
+func TestTLSServerEndPoint(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer server.Close()
+	cert := server.Certificate()
+	h := sha256.Sum256(cert.Raw)
+	expected := append(make([]byte, 20), append([]byte("tls-server-end-point:"), h[:]...)...)
+	expected[16] = byte(len(expected) - 20)
+	if b := TLSServerEndPoint(cert).Marshal(); !bytes.Equal(b, expected) {
+		t.Fatalf("expected %x, got %x", expected, b)
+	}
+}
+
+func TestNegotiatorChannelBindings(t *testing.T) {
+	var msgs [][]byte
+	server := httptest.NewTLSServer(recorder(handler, &msgs))
+	defer server.Close()
+	negotiator := Negotiator{RoundTripper: server.Client().Transport}
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("isis\\malory", "guest")
+	resp, err := negotiator.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	expected := TLSServerEndPoint(server.Certificate()).Hash()
+	for _, p := range ntlmV2ResponseAVPairs(t, msgs[1]) {
+		if p.ID == MsvAvChannelBindings {
+			if !bytes.Equal(p.Value, expected) {
+				t.Fatalf("expected channel bindings %x, got %x", expected, p.Value)
+			}
+			return
+		}
+	}
+	t.Fatal("no MsvAvChannelBindings AV pair sent")
+}
+
+func TestNegotiatorResultTLS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(handler))
+	defer server.Close()
+	plain := httptest.NewServer(http.HandlerFunc(handler))
+	defer plain.Close()
+	for _, s := range []*httptest.Server{server, plain} {
+		req, err := http.NewRequest(http.MethodGet, s.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth("isis\\malory", "guest")
+		r, err := Negotiator{RoundTripper: s.Client().Transport}.Authenticate(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Response.Body.Close()
+		tls := s == server
+		if r.TLS != tls || r.ChannelBound != tls {
+			t.Fatalf("%s: unexpected TLS %v and ChannelBound %v", s.URL, r.TLS, r.ChannelBound)
+		}
+		var expected []byte
+		if tls {
+			sum := sha256.Sum256(server.Certificate().Raw)
+			expected = sum[:]
+		}
+		if !bytes.Equal(r.PeerCertificateHash, expected) {
+			t.Fatalf("%s: expected certificate hash %x, got %x", s.URL, expected, r.PeerCertificateHash)
+		}
+	}
+}
+
+func TestNegotiatorChannelBinding(t *testing.T) {
+	// as computed by a TLS terminating proxy in front of the server
+	binding := (&ChannelBindings{ApplicationData: []byte("tls-server-end-point:proxy")}).Hash()
+	for _, newServer := range []func(http.Handler) *httptest.Server{httptest.NewServer, httptest.NewTLSServer} {
+		var msgs [][]byte
+		server := newServer(recorder(handler, &msgs))
+		defer server.Close()
+		req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth("isis\\malory", "guest")
+		r, err := Negotiator{RoundTripper: server.Client().Transport, ChannelBinding: binding}.Authenticate(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Response.Body.Close()
+		if !r.ChannelBound {
+			t.Errorf("%s: expected the handshake to be channel bound", server.URL)
+		}
+		// even over TLS, the authentication isn't bound to the server
+		// certificate
+		if r.PeerCertificateHash != nil {
+			t.Errorf("%s: unexpected certificate hash %x", server.URL, r.PeerCertificateHash)
+		}
+		var value []byte
+		for _, p := range ntlmV2ResponseAVPairs(t, msgs[1]) {
+			if p.ID == MsvAvChannelBindings {
+				value = p.Value
+			}
+		}
+		if !bytes.Equal(value, binding) {
+			t.Fatalf("%s: expected channel bindings %x, got %x", server.URL, binding, value)
+		}
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("isis\\malory", "guest")
+	if _, err := (Negotiator{ChannelBinding: []byte("short")}).RoundTrip(req); err == nil {
+		t.Fatal("expected a channel binding that isn't 16 bytes long to be refused")
+	}
+}
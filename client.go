@@ -0,0 +1,225 @@
+package ntlmssp
+
+import (
+	"errors"
+	"time"
+)
+
+// Client performs the client side of an NTLM handshake independently of the
+// protocol carrying the messages, e.g. to set up signing and sealing for
+// SMB or RPC. A Client is used for a single handshake.
+type Client struct {
+	// User, Password and Hash are all left empty for anonymous
+	// authentication.
+	Domain   string
+	User     string
+	Password string
+	// Hash is the 16 byte NT hash of the password, i.e. its NT one-way
+	// function, which is also the form of the MSV1_0 credential that some
+	// device management setups provide instead of a password. If set,
+	// Password is ignored.
+	Hash        []byte
+	Workstation string
+	// WorkstationFlag controls whether the NEGOTIATE message claims to
+	// supply a workstation name, independently of Workstation.
+	WorkstationFlag WorkstationFlag
+
+	// TargetName, if set, is sent as the domain of the AUTHENTICATE
+	// message and used for the NTLMv2 response instead of Domain, e.g.
+	// the computer name of a standalone server for its local accounts.
+	// Domain is then only sent in the NEGOTIATE message.
+	TargetName string
+
+	// NegotiateDomain and NegotiateWorkstation, if set, are sent in the
+	// NEGOTIATE message instead of Domain and Workstation, e.g. when the
+	// server routes the handshake by a domain other than the one the user
+	// authenticates in. They don't affect the AUTHENTICATE message.
+	NegotiateDomain      string
+	NegotiateWorkstation string
+
+	// Sign and Seal request message integrity and confidentiality for the
+	// session. Servers that don't support them simply don't agree to it,
+	// in which case the handshake still completes.
+	Sign bool
+	Seal bool
+	// AlwaysSign requests NTLMSSP_NEGOTIATE_ALWAYS_SIGN, i.e. a signature
+	// block on every message, which is implied by Sign. When negotiated
+	// without signing, the session derives its keys as usual but carries
+	// dummy signatures.
+	AlwaysSign bool
+	// Identify requests NTLMSSP_NEGOTIATE_IDENTIFY, i.e. a token that lets
+	// the server identify the user but not impersonate them.
+	Identify bool
+
+	// Version, if not nil, is sent in the NEGOTIATE and AUTHENTICATE
+	// messages along with NTLMSSP_NEGOTIATE_VERSION, for servers that
+	// check it. A zero NTLMRevisionCurrent is sent as NTLMSSPRevisionW2K3.
+	Version *Version
+
+	// RequireMIC sends a MIC over the handshake in the AUTHENTICATE
+	// message and sets its bit in MsvAvFlags, along with the version it
+	// follows. This is done regardless of whether the server sent an
+	// MsvAvTimestamp, for hardened servers that require a MIC anyway; a
+	// timestamp is then made up as usual.
+	RequireMIC bool
+
+	// TargetInfo, if not nil, replaces the AV pairs echoed from the
+	// server's challenge in the NTLMv2 response.
+	TargetInfo []AVPair
+
+	// ClientChallenge, if not nil, is the 8 byte client challenge to use
+	// instead of a random one, e.g. to reproduce a recorded handshake.
+	ClientChallenge []byte
+
+	// SingleHost, if not nil, is sent to the server as an MsvAvSingleHost
+	// AV pair along with the NTLMv2 response, as required by some
+	// hardened server policies.
+	SingleHost *SingleHostData
+
+	// ChannelBindings, if not nil, binds the authentication to the outer
+	// channel (e.g. TLS) by sending its hash as an MsvAvChannelBindings
+	// AV pair.
+	ChannelBindings *ChannelBindings
+
+	// ForceOEM encodes the user, domain and workstation of the
+	// AUTHENTICATE message as OEM rather than Unicode, even if the server
+	// agreed to Unicode. This works around servers that advertise Unicode
+	// but only parse OEM.
+	ForceOEM bool
+
+	// RefuseNTLMv1 makes Step fail with ErrNTLMv1Refused rather than
+	// respond to a challenge that agrees to neither extended session
+	// security nor target info, i.e. one that only allows NTLMv1.
+	RefuseNTLMv1 bool
+
+	// OmitTimestamp builds the NTLMv2 response without a timestamp for
+	// ancient servers that choke on it: the timestamp of the response is
+	// left all zero and the server's MsvAvTimestamp isn't echoed. This is
+	// a compatibility shim that modern servers may reject.
+	OmitTimestamp bool
+
+	// ZeroLMResponse sends 24 zero bytes, Z(24) in MS-NLMP, as the LM
+	// response when the LMv2 response is left out because the server sent
+	// a timestamp, for servers that don't accept an empty LM response.
+	ZeroLMResponse bool
+
+	// Now, if not nil, is used instead of time.Now for the timestamp of
+	// the NTLMv2 response when the server sent none.
+	Now func() time.Time
+
+	// channelBindingHash, if not nil, is sent as MsvAvChannelBindings
+	// unless ChannelBindings is set
+	channelBindingHash []byte
+
+	negotiate  []byte
+	transcript *Transcript
+	session    *Session
+}
+
+// WorkstationFlag controls the NTLMSSP_NEGOTIATE_OEM_WORKSTATION_SUPPLIED flag
+// of the NEGOTIATE message. Some servers misbehave when it is set, others
+// want it even without a workstation name.
+type WorkstationFlag int
+
+const (
+	// WorkstationFlagAuto sets the flag if a workstation name is sent.
+	WorkstationFlagAuto WorkstationFlag = iota
+	// WorkstationFlagOmit never sets the flag.
+	WorkstationFlagOmit
+	// WorkstationFlagSet always sets the flag.
+	WorkstationFlagSet
+)
+
+// NTLMClient builds the messages of the client side of a single NTLM
+// handshake, the way Client does: Step(nil) returns the NEGOTIATE message and
+// Step with the CHALLENGE message the AUTHENTICATE message. If it is an
+// io.Closer too, it is closed once the handshake is over.
+type NTLMClient interface {
+	Step(in []byte) ([]byte, error)
+}
+
+// Step returns the next message to send to the server. The first call takes
+// nil and returns the NEGOTIATE message, the second takes the CHALLENGE
+// message received from the server and returns the AUTHENTICATE message,
+// after which the handshake is complete.
+func (c *Client) Step(in []byte) ([]byte, error) {
+	switch {
+	case c.negotiate == nil:
+		if in != nil {
+			return nil, errors.New("ntlmssp: first step of the handshake takes no input")
+		}
+		flags := defaultFlags
+		if c.Sign {
+			flags |= negotiateFlagNTLMSSPNEGOTIATESIGN | negotiateFlagNTLMSSPNEGOTIATEKEYEXCH
+		}
+		if c.Sign || c.AlwaysSign {
+			flags |= negotiateFlagNTLMSSPNEGOTIATEALWAYSSIGN
+		}
+		if c.Seal {
+			flags |= negotiateFlagNTLMSSPNEGOTIATESEAL | negotiateFlagNTLMSSPNEGOTIATEKEYEXCH
+		}
+		if c.Identify {
+			flags |= negotiateFlagNTLMSSPNEGOTIATEIDENTIFY
+		}
+		domain, workstation := c.Domain, c.Workstation
+		if c.NegotiateDomain != "" {
+			domain = c.NegotiateDomain
+		}
+		if c.NegotiateWorkstation != "" {
+			workstation = c.NegotiateWorkstation
+		}
+		if c.WorkstationFlag == WorkstationFlagSet || c.WorkstationFlag == WorkstationFlagAuto && workstation != "" {
+			flags |= negotiateFlagNTLMSSPNEGOTIATEOEMWORKSTATIONSUPPLIED
+		}
+		msg, err := newNegotiateMessage(domain, workstation, flags, c.Version)
+		if err != nil {
+			return nil, err
+		}
+		c.negotiate = msg
+		return msg, nil
+	case c.session == nil:
+		hash := c.Hash
+		if hash == nil && (c.User != "" || c.Password != "") {
+			hash = GetNtlmHash(c.Password)
+		}
+		domain := c.Domain
+		if c.TargetName != "" {
+			domain = c.TargetName
+		}
+		msg, session, err := processChallenge(in, domain, c.User, hash, authenticateOptions{
+			targetInfo:      c.TargetInfo,
+			clientChallenge: c.ClientChallenge,
+			singleHost:      c.SingleHost,
+			channelBindings: c.ChannelBindings,
+			bindingHash:     c.channelBindingHash,
+			identify:        c.Identify,
+			version:         c.Version,
+			negotiate:       c.negotiate,
+			requireMIC:      c.RequireMIC,
+			forceOEM:        c.ForceOEM,
+			refuseNTLMv1:    c.RefuseNTLMv1,
+			omitTimestamp:   c.OmitTimestamp,
+			zeroLMResponse:  c.ZeroLMResponse,
+			now:             c.Now,
+		})
+		if err != nil {
+			return nil, err
+		}
+		c.session = session
+		c.transcript = newTranscript(c.negotiate, in, msg, session)
+		return msg, nil
+	}
+	return nil, errors.New("ntlmssp: handshake already complete")
+}
+
+// Transcript returns the messages of the handshake, or nil if the handshake
+// hasn't completed yet.
+func (c *Client) Transcript() *Transcript {
+	return c.transcript
+}
+
+// Session returns the session established by the handshake, or nil if the
+// handshake hasn't completed yet.
+func (c *Client) Session() *Session {
+	return c.session
+}
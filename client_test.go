@@ -0,0 +1,784 @@
+package ntlmssp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// withFlags returns a copy of a CHALLENGE message with additional flags set.
+func withFlags(challenge []byte, flags negotiateFlags) []byte {
+	c := append([]byte{}, challenge...)
+	binary.LittleEndian.PutUint32(c[20:], binary.LittleEndian.Uint32(c[20:])|uint32(flags))
+	return c
+}
+
+func TestClientSignSeal(t *testing.T) {
+	c := Client{Domain: "isis", User: "malory", Password: "guest", Sign: true, Seal: true}
+	negotiate, err := c.Step(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, m, err := ParseMessage(negotiate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	requested := negotiateFlags(m.(*NegotiateMessage).NegotiateFlags)
+	if !requested.Has(negotiateFlagNTLMSSPNEGOTIATESIGN | negotiateFlagNTLMSSPNEGOTIATESEAL | negotiateFlagNTLMSSPNEGOTIATEKEYEXCH) {
+		t.Fatalf("expected sign, seal and key exchange to be requested, got flags %08x", uint32(requested))
+	}
+
+	challenge := withFlags(unhex(t, exampleChallenge), requested)
+	authenticate, err := c.Step(challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Session() == nil {
+		t.Fatal("expected a session after the handshake")
+	}
+	if _, err := c.Step(challenge); err == nil {
+		t.Fatal("expected an error when stepping a completed handshake")
+	}
+
+	// recover the session key the way the server would
+	_, m, err = ParseMessage(authenticate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	am := m.(*AuthenticateMessage)
+	ntlmV2Hash := getNtlmV2Hash("guest", "malory", "isis")
+	sessionBaseKey := hmacMd5(ntlmV2Hash, am.NtChallengeResponse[:16])
+	server := newSession(negotiateFlags(am.NegotiateFlags), rc4K(sessionBaseKey, am.EncryptedRandomSessionKey), false)
+
+	msg := []byte("hello, server")
+	signature, err := c.Session().Sign(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Verify(msg, signature); err != nil {
+		t.Fatal(err)
+	}
+	sealed, signature, err := c.Session().Seal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.Unseal(sealed, signature); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientSignSealIgnored(t *testing.T) {
+	// the example server doesn't echo the sign and seal flags, the
+	// handshake must complete regardless
+	c := Client{Domain: "isis", User: "malory", Password: "guest", Sign: true, Seal: true}
+	if _, err := c.Step(nil); err != nil {
+		t.Fatal(err)
+	}
+	authenticate, err := c.Step(unhex(t, exampleChallenge))
+	if err != nil {
+		t.Fatal(err)
+	}
+	domain, user, err := unmarshal(authenticate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if domain != "isis" || user != "malory" {
+		t.Fatalf("unexpected domain %q and user %q", domain, user)
+	}
+	if _, err := c.Session().Sign([]byte("hello")); err == nil {
+		t.Fatal("expected signing to fail when the server didn't agree to it")
+	}
+}
+
+func TestClientAlwaysSign(t *testing.T) {
+	c := Client{Domain: "isis", User: "malory", Password: "guest", AlwaysSign: true}
+	negotiate, err := c.Step(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flags := negotiateFlags(binary.LittleEndian.Uint32(negotiate[12:]))
+	if !flags.Has(negotiateFlagNTLMSSPNEGOTIATEALWAYSSIGN) || flags.Has(negotiateFlagNTLMSSPNEGOTIATESIGN) {
+		t.Fatalf("expected only NTLMSSP_NEGOTIATE_ALWAYS_SIGN to be requested, got flags %08x", uint32(flags))
+	}
+	challenge := withFlags(unhex(t, exampleChallenge), negotiateFlagNTLMSSPNEGOTIATEALWAYSSIGN)
+	if _, err := c.Step(challenge); err != nil {
+		t.Fatal(err)
+	}
+	signature, err := c.Session().Sign([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(signature, dummySignature) {
+		t.Fatalf("expected dummy signature, got %x", signature)
+	}
+}
+
+func TestClientAnonymous(t *testing.T) {
+	var c Client
+	if _, err := c.Step(nil); err != nil {
+		t.Fatal(err)
+	}
+	challenge := withFlags(unhex(t, exampleChallenge), negotiateFlagNTLMSSPNEGOTIATESIGN|negotiateFlagNTLMSSPNEGOTIATEKEYEXCH)
+	if _, err := c.Step(challenge); err != nil {
+		t.Fatal(err)
+	}
+	if key := c.Session().SessionKey(); key != nil {
+		t.Fatalf("expected no session key, got %x", key)
+	}
+	if _, err := c.Session().Sign([]byte("hello")); err == nil {
+		t.Fatal("expected signing to fail for an anonymous session")
+	}
+}
+
+// newChallenge builds a CHALLENGE message for tests.
+func newChallenge(flags negotiateFlags, serverChallenge []byte, targetName string, targetInfo []AVPair) []byte {
+	name := toUnicode(targetName)
+	if !flags.Has(negotiateFlagNTLMSSPNEGOTIATEUNICODE) {
+		name = toOEM(targetName)
+	}
+	info := marshalAVPairs(targetInfo)
+	ptr := binary.Size(&challengeMessageFields{})
+	f := challengeMessageFields{
+		messageHeader:  newMessageHeader(2),
+		TargetName:     newVarField(&ptr, len(name)),
+		NegotiateFlags: flags,
+		TargetInfo:     newVarField(&ptr, len(info)),
+	}
+	copy(f.ServerChallenge[:], serverChallenge)
+	b := bytes.Buffer{}
+	binary.Write(&b, binary.LittleEndian, &f)
+	b.Write(name)
+	b.Write(info)
+	return b.Bytes()
+}
+
+func TestClientClientChallenge(t *testing.T) {
+	flags := negotiateFlagNTLMSSPNEGOTIATEUNICODE |
+		negotiateFlagNTLMSSPNEGOTIATENTLM |
+		negotiateFlagNTLMSSPNEGOTIATEEXTENDEDSESSIONSECURITY |
+		negotiateFlagNTLMSSPNEGOTIATETARGETINFO
+	challenge := newChallenge(flags, specServerChallenge, "Domain", []AVPair{
+		{ID: MsvAvNbDomainName, Value: toUnicode("Domain")},
+		{ID: MsvAvNbComputerName, Value: toUnicode("Server")},
+		{ID: MsvAvTimestamp, Value: []byte{0x00, 0x90, 0xd3, 0x36, 0xb7, 0x34, 0xc3, 0x01}},
+	})
+	c := Client{Domain: "Domain", User: "User", Password: "Password", ClientChallenge: specClientChallenge}
+	if _, err := c.Step(nil); err != nil {
+		t.Fatal(err)
+	}
+	authenticate, err := c.Step(challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	golden := unhex(t, "4e544c4d5353500003000000000000004000000060006000400000000c000c00"+
+		"a000000008000800ac00000000000000b400000000000000b400000001028800"+
+		"b5b63b227e22c83ed1bc8a56e7f60b3b01010000000000000090d336b734c301"+
+		"aaaaaaaaaaaaaaaa0000000002000c0044006f006d00610069006e0001000c00"+
+		"530065007200760065007200070008000090d336b734c3010000000000000000"+
+		"44006f006d00610069006e005500730065007200")
+	if !bytes.Equal(authenticate, golden) {
+		t.Fatalf("expected %x, got %x", golden, authenticate)
+	}
+
+	c = Client{User: "User", Password: "Password", ClientChallenge: []byte{1, 2, 3}}
+	c.Step(nil)
+	if _, err := c.Step(challenge); err == nil {
+		t.Fatal("expected an error for a client challenge that isn't 8 bytes long")
+	}
+}
+
+func TestDefaultMachineID(t *testing.T) {
+	var d SingleHostData
+	v1, v2 := d.marshal(), d.marshal()
+	if !bytes.Equal(v1, v2) {
+		t.Fatalf("expected a stable machine ID, got %x and %x", v1[16:], v2[16:])
+	}
+	if bytes.Equal(v1[16:], make([]byte, 32)) {
+		t.Fatal("expected a non-zero machine ID")
+	}
+}
+
+func TestClientRefuseNTLMv1(t *testing.T) {
+	v1 := newChallenge(negotiateFlagNTLMSSPNEGOTIATEUNICODE|negotiateFlagNTLMSSPNEGOTIATENTLM,
+		[]byte("8bytes!!"), "DOMAIN", nil)
+	c := Client{Domain: "isis", User: "malory", Password: "guest", RefuseNTLMv1: true}
+	if _, err := c.Step(nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Step(v1); !errors.Is(err, ErrNTLMv1Refused) {
+		t.Fatalf("expected ErrNTLMv1Refused, got %v", err)
+	}
+
+	c = Client{Domain: "isis", User: "malory", Password: "guest", RefuseNTLMv1: true}
+	if _, err := c.Step(nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Step(unhex(t, exampleChallenge)); err != nil {
+		t.Fatalf("expected a challenge with target info to be accepted, got %v", err)
+	}
+}
+
+func TestClientChannelBindingsWithoutTargetInfo(t *testing.T) {
+	flags := negotiateFlagNTLMSSPNEGOTIATEUNICODE |
+		negotiateFlagNTLMSSPNEGOTIATENTLM |
+		negotiateFlagNTLMSSPNEGOTIATEEXTENDEDSESSIONSECURITY
+	empty := newChallenge(flags, []byte("8bytes!!"), "DOMAIN", nil)
+	// the same challenge without even the MsvAvEOL of the target info
+	absent := append([]byte{}, empty[:len(empty)-4]...)
+	binary.LittleEndian.PutUint32(absent[40:], 0)
+	cb := &ChannelBindings{ApplicationData: []byte("tls-server-end-point:hash")}
+	for name, challenge := range map[string][]byte{"empty": empty, "absent": absent} {
+		c := Client{Domain: "isis", User: "malory", Password: "guest", ChannelBindings: cb}
+		if _, err := c.Step(nil); err != nil {
+			t.Fatal(err)
+		}
+		authenticate, err := c.Step(challenge)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		pairs := ntlmV2ResponseAVPairs(t, authenticate)
+		if expected := []AVPair{{ID: MsvAvChannelBindings, Value: cb.Hash()}}; !reflect.DeepEqual(pairs, expected) {
+			t.Errorf("%s: expected target info %+v, got %+v", name, expected, pairs)
+		}
+	}
+}
+
+func TestClientForceOEM(t *testing.T) {
+	c := Client{Domain: "isis", User: "malory", Password: "guest", ForceOEM: true}
+	if _, err := c.Step(nil); err != nil {
+		t.Fatal(err)
+	}
+	authenticate, err := c.Step(unhex(t, exampleChallenge))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, m, err := ParseMessage(authenticate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	am := m.(*AuthenticateMessage)
+	flags := negotiateFlags(am.NegotiateFlags)
+	if flags.Has(negotiateFlagNTLMSSPNEGOTIATEUNICODE) || !flags.Has(negotiateFlagNTLMNEGOTIATEOEM) {
+		t.Fatalf("expected OEM rather than unicode to be selected, got flags %08x", uint32(flags))
+	}
+	if am.Domain != "isis" || am.User != "malory" {
+		t.Fatalf("expected isis\\malory, got %s\\%s", am.Domain, am.User)
+	}
+	if !bytes.Contains(authenticate, []byte("isismalory")) {
+		t.Fatalf("expected OEM encoded domain and user in %x", authenticate)
+	}
+}
+
+func TestClientNegotiatedFlags(t *testing.T) {
+	// the example challenge agrees to unicode, NTLM and target info with
+	// a domain as target type
+	for _, tc := range []struct {
+		c        Client
+		expected uint32
+	}{
+		{Client{Domain: "isis", User: "malory", Password: "guest"}, 0x00810201},
+		// unicode isn't agreed to when forcing OEM
+		{Client{Domain: "isis", User: "malory", Password: "guest", ForceOEM: true}, 0x00810200},
+	} {
+		if _, err := tc.c.Step(nil); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tc.c.Step(unhex(t, exampleChallenge)); err != nil {
+			t.Fatal(err)
+		}
+		if flags := tc.c.Session().NegotiatedFlags(); flags != tc.expected {
+			t.Errorf("expected flags %08x, got %08x", tc.expected, flags)
+		}
+	}
+}
+
+func TestClientTargetName(t *testing.T) {
+	c := &Client{User: "malory", Password: "guest", TargetName: "SERVER"}
+	s := testServer("guest")
+	s.Hash = func(domain, user string) ([]byte, error) {
+		if domain != "SERVER" || user != "malory" {
+			return nil, errors.New("unknown user")
+		}
+		return GetNtlmHash("guest"), nil
+	}
+	negotiate, err := c.Step(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, m, err := ParseMessage(negotiate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if domain := m.(*NegotiateMessage).Domain; domain != "" {
+		t.Fatalf("expected no domain in the NEGOTIATE message, got %q", domain)
+	}
+	challenge, err := s.Step(negotiate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authenticate, err := c.Step(challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, m, err = ParseMessage(authenticate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if domain := m.(*AuthenticateMessage).Domain; domain != "SERVER" {
+		t.Fatalf("expected the target name as domain of the AUTHENTICATE message, got %q", domain)
+	}
+	if _, err := s.Step(authenticate); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientIdentify(t *testing.T) {
+	for _, identify := range []bool{false, true} {
+		c := Client{Domain: "isis", User: "malory", Password: "guest", Identify: identify}
+		negotiate, err := c.Step(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		authenticate, err := c.Step(unhex(t, exampleChallenge))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, msg := range [][]byte{negotiate, authenticate} {
+			_, m, err := ParseMessage(msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var flags negotiateFlags
+			switch m := m.(type) {
+			case *NegotiateMessage:
+				flags = negotiateFlags(m.NegotiateFlags)
+			case *AuthenticateMessage:
+				flags = negotiateFlags(m.NegotiateFlags)
+			}
+			if flags.Has(negotiateFlagNTLMSSPNEGOTIATEIDENTIFY) != identify {
+				t.Errorf("Identify %v: unexpected flags %08x", identify, uint32(flags))
+			}
+		}
+	}
+}
+
+func TestClientLMv2Response(t *testing.T) {
+	flags := negotiateFlagNTLMSSPNEGOTIATEUNICODE |
+		negotiateFlagNTLMSSPNEGOTIATENTLM |
+		negotiateFlagNTLMSSPNEGOTIATEEXTENDEDSESSIONSECURITY |
+		negotiateFlagNTLMSSPNEGOTIATETARGETINFO
+	info := []AVPair{
+		{ID: MsvAvNbDomainName, Value: toUnicode("Domain")},
+		{ID: MsvAvNbComputerName, Value: toUnicode("Server")},
+	}
+	timestamp := AVPair{ID: MsvAvTimestamp, Value: []byte{0x00, 0x90, 0xd3, 0x36, 0xb7, 0x34, 0xc3, 0x01}}
+	lmv2 := unhex(t, "86c35097ac9cec102554764a57cccc19aaaaaaaaaaaaaaaa")
+	for _, tc := range []struct {
+		name string
+		info []AVPair
+		zero bool
+		want []byte
+	}{
+		{"no target info", nil, false, lmv2},
+		{"no timestamp", info, false, lmv2},
+		{"timestamp", append(info, timestamp), false, nil},
+		{"no timestamp, Z(24)", info, true, lmv2},
+		{"timestamp, Z(24)", append(info, timestamp), true, make([]byte, 24)},
+	} {
+		c := Client{Domain: "Domain", User: "User", Password: "Password", ClientChallenge: specClientChallenge, ZeroLMResponse: tc.zero}
+		if _, err := c.Step(nil); err != nil {
+			t.Fatal(err)
+		}
+		msg, err := c.Step(newChallenge(flags, specServerChallenge, "Domain", tc.info))
+		if err != nil {
+			t.Fatal(err)
+		}
+		am, err := parseAuthenticateMessage(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(am.LmChallengeResponse, tc.want) {
+			t.Errorf("%s: expected LM response %x, got %x", tc.name, tc.want, am.LmChallengeResponse)
+		}
+		// the length of the LmChallengeResponse field follows the header
+		if got := binary.LittleEndian.Uint16(msg[12:]); int(got) != len(tc.want) {
+			t.Errorf("%s: expected an LM response field of %d bytes, got %d", tc.name, len(tc.want), got)
+		}
+	}
+}
+
+func TestClientWorkstationFlag(t *testing.T) {
+	for _, tc := range []struct {
+		workstation string
+		flag        WorkstationFlag
+		want        bool
+	}{
+		{"", WorkstationFlagAuto, false},
+		{"MYPC", WorkstationFlagAuto, true},
+		{"", WorkstationFlagOmit, false},
+		{"MYPC", WorkstationFlagOmit, false},
+		{"", WorkstationFlagSet, true},
+		{"MYPC", WorkstationFlagSet, true},
+	} {
+		c := Client{Workstation: tc.workstation, WorkstationFlag: tc.flag}
+		msg, err := c.Step(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nm, err := parseNegotiateMessage(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if nm.Workstation != tc.workstation {
+			t.Errorf("%q, %d: expected workstation %q, got %q", tc.workstation, tc.flag, tc.workstation, nm.Workstation)
+		}
+		if got := negotiateFlags(nm.NegotiateFlags).Has(negotiateFlagNTLMSSPNEGOTIATEOEMWORKSTATIONSUPPLIED); got != tc.want {
+			t.Errorf("%q, %d: expected workstation supplied flag %v, got %v", tc.workstation, tc.flag, tc.want, got)
+		}
+	}
+}
+
+func TestClientHash(t *testing.T) {
+	c := &Client{Domain: "isis", User: "malory", Hash: GetNtlmHash("guest")}
+	if err := runHandshake(c, testServer("guest")); err != nil {
+		t.Fatal(err)
+	}
+
+	c = &Client{Domain: "isis", User: "malory", Hash: GetNtlmHash("guest")[:15]}
+	if err := runHandshake(c, testServer("guest")); err == nil {
+		t.Fatal("expected a 15 byte hash to be refused")
+	}
+}
+
+func TestClientNegotiateDomain(t *testing.T) {
+	c := Client{
+		Domain:               "isis",
+		User:                 "malory",
+		Password:             "guest",
+		Workstation:          "MYPC",
+		NegotiateDomain:      "ROUTING",
+		NegotiateWorkstation: "GATEWAY",
+	}
+	msg, err := c.Step(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nm, err := parseNegotiateMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nm.Domain != "ROUTING" || nm.Workstation != "GATEWAY" {
+		t.Fatalf("expected ROUTING and GATEWAY, got %q and %q", nm.Domain, nm.Workstation)
+	}
+	msg, err = c.Step(unhex(t, exampleChallenge))
+	if err != nil {
+		t.Fatal(err)
+	}
+	am, err := parseAuthenticateMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if am.Domain != "isis" {
+		t.Fatalf("expected isis, got %q", am.Domain)
+	}
+}
+
+func TestClientTargetInfoFlag(t *testing.T) {
+	c := Client{Domain: "isis", User: "malory", Password: "guest", ClientChallenge: specClientChallenge}
+	msg, err := c.Step(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nm, err := parseNegotiateMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !negotiateFlags(nm.NegotiateFlags).Has(negotiateFlagNTLMSSPNEGOTIATETARGETINFO) {
+		t.Fatalf("expected NTLMSSP_NEGOTIATE_TARGET_INFO, got flags %08x", nm.NegotiateFlags)
+	}
+
+	// a server that ignores the flag still gets an NTLMv2 response, with a
+	// blob carrying no AV pairs, along with the LMv2 response
+	challenge := newChallenge(negotiateFlagNTLMSSPNEGOTIATEUNICODE|negotiateFlagNTLMSSPNEGOTIATENTLM|
+		negotiateFlagNTLMSSPNEGOTIATEEXTENDEDSESSIONSECURITY, specServerChallenge, "DOMAIN", nil)
+	challenge = challenge[:len(challenge)-4]
+	binary.LittleEndian.PutUint32(challenge[40:], 0)
+	msg, err = c.Step(challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	am, err := parseAuthenticateMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(am.NtChallengeResponse) != 48 {
+		t.Fatalf("expected a 48 byte NTLMv2 response, got %x", am.NtChallengeResponse)
+	}
+	if len(am.LmChallengeResponse) != 24 {
+		t.Fatalf("expected a 24 byte LMv2 response, got %x", am.LmChallengeResponse)
+	}
+}
+
+func TestClientSessionBaseKey(t *testing.T) {
+	// MS-NLMP 4.2.4, without key exchange the exported session key is the
+	// session base key
+	flags := negotiateFlagNTLMSSPNEGOTIATEUNICODE |
+		negotiateFlagNTLMSSPNEGOTIATENTLM |
+		negotiateFlagNTLMSSPNEGOTIATESIGN |
+		negotiateFlagNTLMSSPNEGOTIATETARGETINFO
+	pairs, err := parseAVPairs(specTargetInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Client{
+		Domain:          "Domain",
+		User:            "User",
+		Password:        "Password",
+		Sign:            true,
+		ClientChallenge: specClientChallenge,
+		// the all-zero FILETIME of the worked example
+		Now: func() time.Time { return time.Date(1601, 1, 1, 0, 0, 0, 0, time.UTC) },
+	}
+	if _, err := c.Step(nil); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := c.Step(newChallenge(flags, specServerChallenge, "Server", pairs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	am, err := parseAuthenticateMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := unhex(t, "68cd0ab851e51c96aabc927bebef6a1c"); !bytes.Equal(am.NtChallengeResponse[:16], expected) {
+		t.Fatalf("expected NTProofStr %x, got %x", expected, am.NtChallengeResponse[:16])
+	}
+	if expected := unhex(t, "8de40ccadbc14a82f15cb0ad0de95ca3"); !bytes.Equal(c.Session().SessionKey(), expected) {
+		t.Fatalf("expected session key %x, got %x", expected, c.Session().SessionKey())
+	}
+}
+
+func TestClientVersion(t *testing.T) {
+	for _, tc := range []struct {
+		revision uint8
+		want     uint8
+	}{
+		{0, NTLMSSPRevisionW2K3},
+		{0x0A, 0x0A},
+	} {
+		c := &Client{Domain: "isis", User: "malory", Password: "guest", Version: &Version{
+			ProductMajorVersion: 10,
+			ProductBuild:        19041,
+			NTLMRevisionCurrent: tc.revision,
+		}}
+		negotiate, err := c.Step(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := testServer("guest")
+		challenge, err := s.Step(negotiate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		authenticate, err := c.Step(challenge)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the version of the NEGOTIATE message follows its 32 bytes of
+		// fixed fields
+		if got := negotiate[32+7]; got != tc.want {
+			t.Errorf("expected NEGOTIATE revision %#x, got %#x", tc.want, got)
+		}
+		am, err := parseAuthenticateMessage(authenticate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !negotiateFlags(am.NegotiateFlags).Has(negotiateFlagNTLMSSPNEGOTIATEVERSION) {
+			t.Error("expected the version flag in the AUTHENTICATE message")
+		}
+		// the version follows the 64 bytes of fixed fields
+		if got := authenticate[64]; got != 10 {
+			t.Errorf("expected major version 10, got %d", got)
+		}
+		if got := authenticate[64+7]; got != tc.want {
+			t.Errorf("expected revision %#x, got %#x", tc.want, got)
+		}
+		if _, err := s.Step(authenticate); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestClientRequireMIC(t *testing.T) {
+	// a challenge without a timestamp
+	newServer := func() *Server {
+		s := testServer("guest")
+		s.TargetInfo = []AVPair{
+			{ID: MsvAvNbDomainName, Value: toUnicode("DOMAIN")},
+			{ID: MsvAvNbComputerName, Value: toUnicode("SERVER")},
+		}
+		s.RequireMIC = true
+		return s
+	}
+
+	c := &Client{Domain: "isis", User: "malory", Password: "guest"}
+	if err := runHandshake(c, newServer()); !errors.Is(err, ErrAuthenticationFailed) {
+		t.Fatalf("expected the missing MIC to fail authentication, got %v", err)
+	}
+
+	c = &Client{Domain: "isis", User: "malory", Password: "guest", RequireMIC: true}
+	s := newServer()
+	negotiate, err := c.Step(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	challenge, err := s.Step(negotiate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authenticate, err := c.Step(challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	am, err := parseAuthenticateMessage(authenticate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pairs, err := parseAVPairs(am.NtChallengeResponse[44:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var avFlags []byte
+	for _, p := range pairs {
+		if p.ID == MsvAvFlags {
+			avFlags = p.Value
+		}
+	}
+	if !bytes.Equal(avFlags, []byte{msvAvFlagMIC, 0, 0, 0}) {
+		t.Fatalf("expected MsvAvFlags with the MIC bit, got %x", avFlags)
+	}
+	if bytes.Equal(authenticate[micOffset:micOffset+16], make([]byte, 16)) {
+		t.Fatal("expected a MIC")
+	}
+
+	// the server verifies the MIC, so a tampered one is refused
+	tampered := append([]byte{}, authenticate...)
+	tampered[micOffset] ^= 1
+	if _, err := s.Step(tampered); !errors.Is(err, ErrAuthenticationFailed) {
+		t.Fatalf("expected a tampered MIC to fail authentication, got %v", err)
+	}
+	s = newServer()
+	c = &Client{Domain: "isis", User: "malory", Password: "guest", RequireMIC: true}
+	if err := runHandshake(c, s); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientOmitTimestamp(t *testing.T) {
+	flags := negotiateFlagNTLMSSPNEGOTIATEUNICODE |
+		negotiateFlagNTLMSSPNEGOTIATENTLM |
+		negotiateFlagNTLMSSPNEGOTIATEEXTENDEDSESSIONSECURITY |
+		negotiateFlagNTLMSSPNEGOTIATETARGETINFO
+	challenge := newChallenge(flags, specServerChallenge, "Domain", []AVPair{
+		{ID: MsvAvNbDomainName, Value: toUnicode("Domain")},
+		{ID: MsvAvTimestamp, Value: []byte{0x00, 0x90, 0xd3, 0x36, 0xb7, 0x34, 0xc3, 0x01}},
+		{ID: MsvAvNbComputerName, Value: toUnicode("Server")},
+	})
+	c := Client{Domain: "Domain", User: "User", Password: "Password", ClientChallenge: specClientChallenge, OmitTimestamp: true}
+	if _, err := c.Step(nil); err != nil {
+		t.Fatal(err)
+	}
+	authenticate, err := c.Step(challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	am, err := parseAuthenticateMessage(authenticate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the blob following the NTProofStr: version, reserved bytes,
+	// timestamp, client challenge, reserved bytes, target info and
+	// trailing padding
+	blob := am.NtChallengeResponse[16:]
+	if !bytes.Equal(blob[:8], []byte{1, 1, 0, 0, 0, 0, 0, 0}) {
+		t.Errorf("unexpected blob header %x", blob[:8])
+	}
+	if !bytes.Equal(blob[8:16], make([]byte, 8)) {
+		t.Errorf("expected an all zero timestamp, got %x", blob[8:16])
+	}
+	if !bytes.Equal(blob[16:24], specClientChallenge) {
+		t.Errorf("expected client challenge %x, got %x", specClientChallenge, blob[16:24])
+	}
+	pairs, err := parseAVPairs(blob[28:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []AVPair{
+		{ID: MsvAvNbDomainName, Value: toUnicode("Domain")},
+		{ID: MsvAvNbComputerName, Value: toUnicode("Server")},
+	}
+	if !reflect.DeepEqual(pairs, want) {
+		t.Errorf("expected target info %v, got %v", want, pairs)
+	}
+	if !bytes.Equal(blob[len(blob)-4:], make([]byte, 4)) {
+		t.Errorf("expected trailing padding, got %x", blob[len(blob)-4:])
+	}
+	if _, _, _, err := VerifyAuthenticate(challenge, authenticate, GetNtlmHash("Password")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientOEMChallenge(t *testing.T) {
+	// a challenge from a server that only agrees to OEM, with an OEM
+	// encoded target name; without the unicode flag newChallenge encodes
+	// the target name as OEM
+	flags := negotiateFlags(negotiateFlagNTLMNEGOTIATEOEM |
+		negotiateFlagNTLMSSPNEGOTIATENTLM |
+		negotiateFlagNTLMSSPNEGOTIATETARGETINFO)
+	challenge := newChallenge(flags, specServerChallenge, "DOMAIN", []AVPair{
+		{ID: MsvAvNbDomainName, Value: toUnicode("DOMAIN")},
+	})
+
+	cm, err := parseChallengeMessage(challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cm.TargetName != "DOMAIN" {
+		t.Fatalf("expected target name DOMAIN, got %q", cm.TargetName)
+	}
+
+	c := Client{Domain: "isis", User: "malory", Password: "guest"}
+	if _, err := c.Step(nil); err != nil {
+		t.Fatal(err)
+	}
+	authenticate, err := c.Step(challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	am, err := parseAuthenticateMessage(authenticate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flags = negotiateFlags(am.NegotiateFlags)
+	if flags.Has(negotiateFlagNTLMSSPNEGOTIATEUNICODE) || !flags.Has(negotiateFlagNTLMNEGOTIATEOEM) {
+		t.Fatalf("expected OEM rather than unicode, got flags %08x", uint32(flags))
+	}
+	if am.Domain != "isis" || am.User != "malory" {
+		t.Fatalf("expected isis\\malory, got %s\\%s", am.Domain, am.User)
+	}
+	if !bytes.Contains(authenticate, []byte("isismalory")) {
+		t.Fatalf("expected OEM encoded domain and user in %x", authenticate)
+	}
+	for _, s := range []string{"isis", "malory"} {
+		if bytes.Contains(authenticate, toUnicode(s)) {
+			t.Errorf("expected no unicode encoded %q in %x", s, authenticate)
+		}
+	}
+	// the verifier computes the NTLMv2 hash from the OEM decoded names
+	if _, _, _, err := VerifyAuthenticate(challenge, authenticate, GetNtlmHash("guest")); err != nil {
+		t.Fatal(err)
+	}
+}
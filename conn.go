@@ -0,0 +1,90 @@
+package ntlmssp
+
+import (
+	"context"
+	"io"
+	"net"
+	"time"
+)
+
+// Framing delimits the tokens of a handshake on a stream, for protocols that
+// carry NTLM messages directly rather than in HTTP headers.
+type Framing struct {
+	// ReadToken reads the next token from r.
+	ReadToken func(r io.Reader) ([]byte, error)
+	// WriteToken writes token to w.
+	WriteToken func(w io.Writer, token []byte) error
+}
+
+// Handshake runs the handshake of c over rw, e.g. a net.Conn, writing the
+// NEGOTIATE message, reading the CHALLENGE message and writing the
+// AUTHENTICATE message with the framing f. The session is then available
+// from c.Session. Whether the server accepted the AUTHENTICATE message is up
+// to the protocol to tell.
+func (c *Client) Handshake(rw io.ReadWriter, f Framing) error {
+	negotiate, err := c.Step(nil)
+	if err != nil {
+		return err
+	}
+	if err := f.WriteToken(rw, negotiate); err != nil {
+		return err
+	}
+	challenge, err := f.ReadToken(rw)
+	if err != nil {
+		return err
+	}
+	authenticate, err := c.Step(challenge)
+	if err != nil {
+		return err
+	}
+	return f.WriteToken(rw, authenticate)
+}
+
+// Dialer connects to services that carry NTLM messages directly, running
+// the handshake with Framing on every new connection.
+type Dialer struct {
+	Framing Framing
+
+	// DialContext, if not nil, is used to connect instead of a net.Dialer.
+	DialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// Dial connects to addr on the named network and authenticates as creds,
+// returning the connection along with the signing session established by
+// the handshake. The handshake is aborted if ctx is done before it
+// completes. As with Client.Handshake, whether the server accepted the
+// credentials is up to the protocol to tell. The Password and Hash of creds
+// are wiped once the AUTHENTICATE message has been built.
+func (d Dialer) Dial(ctx context.Context, network, addr string, creds Credential) (net.Conn, *Session, error) {
+	defer creds.wipe()
+	dial := d.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	conn, err := dial(ctx, network, addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	hash := creds.ntlmHash()
+	defer clear(hash)
+	c := &Client{Domain: creds.Domain, User: creds.User, Hash: hash, Sign: true}
+
+	// unblock the handshake by expiring the connection's deadline once ctx
+	// is done
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Unix(1, 0)) })
+	err = c.Handshake(conn, d.Framing)
+	stop()
+	if ctx.Err() != nil {
+		conn.Close()
+		return nil, nil, ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, c.Session(), nil
+}
@@ -0,0 +1,141 @@
+package ntlmssp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+// lengthPrefixed frames tokens with a big endian 32 bit length.
+var lengthPrefixed = Framing{
+	ReadToken: func(r io.Reader) ([]byte, error) {
+		var n uint32
+		if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+			return nil, err
+		}
+		token := make([]byte, n)
+		_, err := io.ReadFull(r, token)
+		return token, err
+	},
+	WriteToken: func(w io.Writer, token []byte) error {
+		if err := binary.Write(w, binary.BigEndian, uint32(len(token))); err != nil {
+			return err
+		}
+		_, err := w.Write(token)
+		return err
+	},
+}
+
+func TestClientHandshake(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	s := testServer("guest")
+	done := make(chan error, 1)
+	go func() {
+		defer server.Close()
+		for s.Session() == nil {
+			in, err := lengthPrefixed.ReadToken(server)
+			if err != nil {
+				done <- err
+				return
+			}
+			out, err := s.Step(in)
+			if err != nil {
+				done <- err
+				return
+			}
+			if out != nil {
+				if err := lengthPrefixed.WriteToken(server, out); err != nil {
+					done <- err
+					return
+				}
+			}
+		}
+		done <- nil
+	}()
+
+	c := &Client{Domain: "isis", User: "malory", Password: "guest", Sign: true}
+	if err := c.Handshake(client, lengthPrefixed); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(c.Session().SessionKey(), s.Session().SessionKey()) {
+		t.Fatal("client and server disagree on the session key")
+	}
+}
+
+func TestDialerDial(t *testing.T) {
+	client, server := net.Pipe()
+	s := testServer("guest")
+	done := make(chan error, 1)
+	go func() {
+		defer server.Close()
+		for s.Session() == nil {
+			in, err := lengthPrefixed.ReadToken(server)
+			if err != nil {
+				done <- err
+				return
+			}
+			out, err := s.Step(in)
+			if err != nil {
+				done <- err
+				return
+			}
+			if out != nil {
+				if err := lengthPrefixed.WriteToken(server, out); err != nil {
+					done <- err
+					return
+				}
+			}
+		}
+		done <- nil
+	}()
+
+	d := Dialer{
+		Framing: lengthPrefixed,
+		DialContext: func(context.Context, string, string) (net.Conn, error) {
+			return client, nil
+		},
+	}
+	password := []byte("guest")
+	conn, session, err := d.Dial(context.Background(), "tcp", "server:1433", Credential{Domain: "isis", User: "malory", Password: password})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(session.SessionKey(), s.Session().SessionKey()) {
+		t.Fatal("client and server disagree on the session key")
+	}
+	if string(password) == "guest" {
+		t.Fatal("expected the password to be wiped")
+	}
+}
+
+func TestDialerDialCanceled(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	d := Dialer{
+		Framing: lengthPrefixed,
+		DialContext: func(context.Context, string, string) (net.Conn, error) {
+			return client, nil
+		},
+	}
+	// the server never answers the NEGOTIATE message
+	go func() {
+		lengthPrefixed.ReadToken(server)
+		cancel()
+	}()
+	if _, _, err := d.Dial(ctx, "tcp", "server:1433", Credential{User: "malory", Password: []byte("guest")}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+}
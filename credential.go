@@ -0,0 +1,58 @@
+package ntlmssp
+
+import (
+	"bytes"
+	"net/http"
+)
+
+// Credential identifies a user and the secret used to authenticate them.
+type Credential struct {
+	Domain string
+	User   string
+	// Password is a byte slice rather than a string so that it can be
+	// wiped from memory once it is no longer needed.
+	Password []byte
+	// Hash is the 16 byte NT hash of the password, see Client.Hash. If
+	// set, Password is ignored.
+	Hash []byte
+}
+
+// StaticCredentials returns a function for Negotiator.Credentials that always
+// supplies the given credentials. The domain and user are used as they are,
+// without looking for a domain in the user name, so user names may contain
+// backslashes or at signs. Each call returns a copy of password, since
+// Negotiator wipes it after use.
+func StaticCredentials(domain, user string, password []byte) func(*http.Request) (Credential, error) {
+	password = append([]byte{}, password...)
+	return func(*http.Request) (Credential, error) {
+		return Credential{Domain: domain, User: user, Password: append([]byte{}, password...)}, nil
+	}
+}
+
+// ntlmHash returns the NT hash of the credential, or nil for anonymous
+// credentials.
+func (c *Credential) ntlmHash() []byte {
+	if c.Hash != nil {
+		return c.Hash
+	}
+	if c.User == "" && len(c.Password) == 0 {
+		return nil
+	}
+	return getNtlmHashBytes(c.Password)
+}
+
+// wipe zeroes the password and the hash of the credential.
+func (c *Credential) wipe() {
+	clear(c.Password)
+	clear(c.Hash)
+}
+
+// clone returns a copy of the credential that can be wiped on its own.
+func (c Credential) clone() Credential {
+	return Credential{
+		Domain:   c.Domain,
+		User:     c.User,
+		Password: bytes.Clone(c.Password),
+		Hash:     bytes.Clone(c.Hash),
+	}
+}
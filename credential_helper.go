@@ -0,0 +1,91 @@
+package ntlmssp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// CredentialHelper returns a function for Negotiator.Credentials that asks
+// an external program for the credentials, much like the credential helpers
+// of Git. The program at path is run without arguments and reads the
+// target host from its standard input as
+//
+//	host=example.com
+//
+// followed by an empty line. It answers with domain, username and password
+// lines in the same key=value form on its standard output. Lines with other
+// keys are ignored. If no domain is returned, it is taken from the user name
+// as with basic authentication.
+//
+// The program is killed if it doesn't answer within timeout, if positive, or
+// before the request's context is done.
+func CredentialHelper(path string, timeout time.Duration) func(*http.Request) (Credential, error) {
+	return func(req *http.Request) (Credential, error) {
+		ctx := req.Context()
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		cmd := exec.CommandContext(ctx, path)
+		// don't wait for any children that keep the output open once
+		// the helper itself is killed
+		cmd.WaitDelay = time.Second
+		cmd.Stdin = strings.NewReader("host=" + req.URL.Hostname() + "\n\n")
+		var stdout, stderr bytes.Buffer
+		cmd.Stdout, cmd.Stderr = &stdout, &stderr
+		err := cmd.Run()
+		defer clear(stdout.Bytes())
+		if err != nil {
+			if ctx.Err() != nil {
+				err = ctx.Err()
+			}
+			if msg := strings.TrimSpace(stderr.String()); msg != "" {
+				return Credential{}, fmt.Errorf("ntlmssp: credential helper %s: %w: %s", path, err, msg)
+			}
+			return Credential{}, fmt.Errorf("ntlmssp: credential helper %s: %w", path, err)
+		}
+		return parseHelperCredential(stdout.Bytes())
+	}
+}
+
+// parseHelperCredential parses the output of a credential helper. The
+// password is copied, so that the output can be wiped.
+func parseHelperCredential(out []byte) (Credential, error) {
+	var cred Credential
+	var user string
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		key, value, ok := bytes.Cut(bytes.TrimSuffix(s.Bytes(), []byte("\r")), []byte("="))
+		if !ok {
+			continue
+		}
+		switch string(key) {
+		case "domain":
+			cred.Domain = string(value)
+		case "username":
+			user = string(value)
+		case "password":
+			cred.Password = append([]byte{}, value...)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return Credential{}, err
+	}
+	if user == "" {
+		clear(cred.Password)
+		return Credential{}, errors.New("ntlmssp: credential helper returned no username")
+	}
+	cred.User = user
+	if cred.Domain == "" {
+		cred.User, cred.Domain = GetDomain(user)
+	}
+	return cred, nil
+}
@@ -0,0 +1,97 @@
+package ntlmssp
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// writeHelper writes a credential helper shell script.
+func writeHelper(t *testing.T, script string) string {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("credential helper scripts need a POSIX shell")
+	}
+	path := filepath.Join(t.TempDir(), "helper")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestCredentialHelper(t *testing.T) {
+	helper := writeHelper(t, `
+while read -r line && [ -n "$line" ]; do
+	case "$line" in
+	host=*) host=${line#host=} ;;
+	esac
+done
+if [ "$host" != 127.0.0.1 ]; then
+	echo "unknown host $host" >&2
+	exit 1
+fi
+echo protocol=https
+echo domain=isis
+echo username=malory
+echo password=guest
+`)
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := Negotiator{Credentials: CredentialHelper(helper, 10*time.Second)}.Authenticate(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Response.Body.Close()
+	if r.Domain != "isis" || r.Username != "malory" {
+		t.Fatalf("expected isis\\malory, got %s\\%s", r.Domain, r.Username)
+	}
+
+	req, err = http.NewRequest(http.MethodGet, "http://other.example.com/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CredentialHelper(helper, 10*time.Second)(req); err == nil {
+		t.Fatal("expected the helper to fail for another host")
+	}
+}
+
+func TestCredentialHelperDomainInUsername(t *testing.T) {
+	helper := writeHelper(t, "cat >/dev/null\necho 'username=isis\\malory'\necho password=guest\n")
+	req, err := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cred, err := CredentialHelper(helper, 10*time.Second)(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cred.Domain != "isis" || cred.User != "malory" || string(cred.Password) != "guest" {
+		t.Fatalf("unexpected credential %+v", cred)
+	}
+}
+
+func TestCredentialHelperTimeout(t *testing.T) {
+	helper := writeHelper(t, "exec sleep 10\n")
+	req, err := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	_, err = CredentialHelper(helper, 100*time.Millisecond)(req)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the helper to time out, got %v", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("expected the helper to be killed, took %v", d)
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !windows
+
+package ntlmssp
+
+import (
+	"errors"
+	"net/http"
+)
+
+// CredentialManager reads credentials from the Windows Credential Manager,
+// which only exists on Windows. Elsewhere it returns errors.ErrUnsupported.
+func CredentialManager(req *http.Request) (Credential, error) {
+	return Credential{}, errors.ErrUnsupported
+}
@@ -0,0 +1,88 @@
+//go:build windows
+
+package ntlmssp
+
+import (
+	"fmt"
+	"net/http"
+	"syscall"
+	"unicode/utf16"
+	"unicode/utf8"
+	"unsafe"
+)
+
+var (
+	advapi32      = syscall.NewLazyDLL("advapi32.dll")
+	procCredReadW = advapi32.NewProc("CredReadW")
+	procCredFree  = advapi32.NewProc("CredFree")
+)
+
+const credTypeGeneric = 1
+
+// winCredential is the CREDENTIALW structure.
+type winCredential struct {
+	Flags              uint32
+	Type               uint32
+	TargetName         *uint16
+	Comment            *uint16
+	LastWritten        syscall.Filetime
+	CredentialBlobSize uint32
+	CredentialBlob     *byte
+	Persist            uint32
+	AttributeCount     uint32
+	Attributes         uintptr
+	TargetAlias        *uint16
+	UserName           *uint16
+}
+
+// CredentialManager returns the generic credential stored in the Windows
+// Credential Manager for the host of req, e.g. with
+//
+//	cmdkey /generic:server.example.com /user:DOMAIN\user /pass
+//
+// It can be used as Negotiator.Credentials.
+func CredentialManager(req *http.Request) (Credential, error) {
+	return readCredential(req.URL.Hostname())
+}
+
+func readCredential(target string) (Credential, error) {
+	t, err := syscall.UTF16PtrFromString(target)
+	if err != nil {
+		return Credential{}, err
+	}
+	var c *winCredential
+	r, _, err := procCredReadW.Call(uintptr(unsafe.Pointer(t)), credTypeGeneric, 0, uintptr(unsafe.Pointer(&c)))
+	if r == 0 {
+		return Credential{}, fmt.Errorf("ntlmssp: reading credential for %s: %w", target, err)
+	}
+	defer procCredFree.Call(uintptr(unsafe.Pointer(c)))
+
+	// the password is stored as UTF-16LE, decode it without going through
+	// a string so that it can be wiped
+	blob := unsafe.Slice(c.CredentialBlob, c.CredentialBlobSize)
+	u := make([]uint16, len(blob)/2)
+	for i := range u {
+		u[i] = uint16(blob[2*i]) | uint16(blob[2*i+1])<<8
+	}
+	runes := utf16.Decode(u)
+	clear(u)
+	password := make([]byte, 0, len(runes)*utf8.UTFMax)
+	for _, r := range runes {
+		password = utf8.AppendRune(password, r)
+	}
+	clear(runes)
+
+	user, domain := GetDomain(utf16PtrToString(c.UserName))
+	return Credential{Domain: domain, User: user, Password: password}, nil
+}
+
+func utf16PtrToString(p *uint16) string {
+	if p == nil {
+		return ""
+	}
+	n := 0
+	for ptr := unsafe.Pointer(p); *(*uint16)(ptr) != 0; n++ {
+		ptr = unsafe.Add(ptr, 2)
+	}
+	return syscall.UTF16ToString(unsafe.Slice(p, n))
+}
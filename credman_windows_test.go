@@ -0,0 +1,56 @@
+//go:build windows
+
+package ntlmssp
+
+import (
+	"net/http"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+var (
+	procCredWriteW = advapi32.NewProc("CredWriteW")
+	procCredDelete = advapi32.NewProc("CredDeleteW")
+)
+
+func writeCredential(t *testing.T, target, user, password string) {
+	targetName, err := syscall.UTF16PtrFromString(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userName, err := syscall.UTF16PtrFromString(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob := toUnicode(password)
+	c := winCredential{
+		Type:               credTypeGeneric,
+		TargetName:         targetName,
+		CredentialBlobSize: uint32(len(blob)),
+		CredentialBlob:     &blob[0],
+		Persist:            1, // CRED_PERSIST_SESSION
+		UserName:           userName,
+	}
+	if r, _, err := procCredWriteW.Call(uintptr(unsafe.Pointer(&c)), 0); r == 0 {
+		t.Skipf("can't store a test credential: %v", err)
+	}
+	t.Cleanup(func() {
+		procCredDelete.Call(uintptr(unsafe.Pointer(targetName)), credTypeGeneric, 0)
+	})
+}
+
+func TestCredentialManager(t *testing.T) {
+	writeCredential(t, "ntlmssp-test.invalid", "isis\\malory", "güest")
+	req, err := http.NewRequest(http.MethodGet, "http://ntlmssp-test.invalid:8080/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cred, err := CredentialManager(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cred.Domain != "isis" || cred.User != "malory" || string(cred.Password) != "güest" {
+		t.Fatalf("unexpected credential %s\\%s:%s", cred.Domain, cred.User, cred.Password)
+	}
+}
@@ -0,0 +1,51 @@
+package ntlmssp
+
+import (
+	"net/http"
+	"strings"
+)
+
+// curlCommand reports a failed handshake for req to CurlCommand, if set.
+// authorization is the Authorization header the request came with.
+func (l Negotiator) curlCommand(req *http.Request, h *handshake, authorization []string) {
+	if l.CurlCommand == nil {
+		return
+	}
+	user := h.user
+	if h.domain != "" {
+		user = h.domain + "\\" + h.user
+	}
+	if user == "" {
+		// no AUTHENTICATE message was built, fall back to the user of
+		// the basic authorization header
+		user, _, _ = authheader(authorization).GetBasicCreds()
+	}
+	l.CurlCommand(curlCommandLine(req, h.scheme, user))
+}
+
+// curlCommandLine returns a curl command line sending req with scheme as
+// user, with all arguments quoted for POSIX shells. Any user info of the
+// URL is dropped.
+func curlCommandLine(req *http.Request, scheme, user string) string {
+	args := []string{"curl"}
+	if scheme == "Negotiate" {
+		args = append(args, "--negotiate")
+	} else {
+		args = append(args, "--ntlm")
+	}
+	args = append(args, "-u", shellQuote(user))
+	if req.Method != "" && req.Method != http.MethodGet {
+		args = append(args, "-X", shellQuote(req.Method))
+	}
+	if req.Host != "" && req.Host != req.URL.Host {
+		args = append(args, "-H", shellQuote("Host: "+req.Host))
+	}
+	u := *req.URL
+	u.User = nil
+	return strings.Join(append(args, shellQuote(u.String())), " ")
+}
+
+// shellQuote quotes s for POSIX shells.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -1,5 +1,3 @@
 module github.com/samuong/go-ntlmssp
 
 go 1.22.3
-
-require golang.org/x/crypto v0.24.0
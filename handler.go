@@ -0,0 +1,91 @@
+package ntlmssp
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// Handler is an http.Handler that authenticates requests with NTLM, e.g. to
+// test clients against with httptest. Since NTLM authenticates connections
+// rather than requests, it runs a Server per connection, told apart by their
+// remote address, and grants all further requests on an authenticated
+// connection. Authenticated requests are answered with 200 OK, all others
+// with 401 Unauthorized. Set ConnState as the ConnState of the http.Server
+// to forget about connections once they are closed.
+type Handler struct {
+	// NewServer returns the Server for the handshake on the connection of
+	// req, configured with the credentials, AV pairs and channel bindings
+	// to check the client against.
+	NewServer func(req *http.Request) *Server
+
+	mu      sync.Mutex
+	servers map[string]*Server
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	h.mu.Lock()
+	s := h.servers[req.RemoteAddr]
+	h.mu.Unlock()
+	if s != nil && s.Session() != nil {
+		domain, user := s.User()
+		fmt.Fprintf(w, "access granted to %s\\%s\n", domain, user)
+		return
+	}
+	authz := authheader(req.Header.Values("Authorization"))
+	in, err := authz.GetData()
+	if !authz.IsNTLM() || err != nil || len(in) == 0 {
+		unauthorized(w, "")
+		return
+	}
+	// a NEGOTIATE message starts the handshake over
+	if typ, _, err := ParseMessage(in); s == nil || err == nil && typ == NegotiateMessageType {
+		s = h.NewServer(req)
+		h.mu.Lock()
+		if h.servers == nil {
+			h.servers = make(map[string]*Server)
+		}
+		h.servers[req.RemoteAddr] = s
+		h.mu.Unlock()
+	}
+	out, err := s.Step(in)
+	if err != nil {
+		// start over with the next NEGOTIATE message
+		h.mu.Lock()
+		delete(h.servers, req.RemoteAddr)
+		h.mu.Unlock()
+		unauthorized(w, "")
+		fmt.Fprintf(w, "access denied: %v\n", err)
+		return
+	}
+	if out != nil {
+		unauthorized(w, base64.StdEncoding.EncodeToString(out))
+		return
+	}
+	domain, user := s.User()
+	fmt.Fprintf(w, "access granted to %s\\%s\n", domain, user)
+}
+
+// ConnState forgets about the handshake on conn once it is closed, for use
+// as the ConnState of an http.Server.
+func (h *Handler) ConnState(conn net.Conn, state http.ConnState) {
+	if state != http.StateClosed && state != http.StateHijacked {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.servers, conn.RemoteAddr().String())
+}
+
+// unauthorized sends a 401 Unauthorized response offering NTLM, along with
+// the given token if any.
+func unauthorized(w http.ResponseWriter, token string) {
+	if token == "" {
+		w.Header().Set("WWW-Authenticate", "NTLM")
+	} else {
+		w.Header().Set("WWW-Authenticate", "NTLM "+token)
+	}
+	w.WriteHeader(http.StatusUnauthorized)
+}
@@ -0,0 +1,181 @@
+package ntlmssp
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func handlerGet(t *testing.T, rt http.RoundTripper, url, password string) (int, string) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("isis\\malory", password)
+	resp, err := Negotiator{RoundTripper: rt}.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(body)
+}
+
+func TestHandler(t *testing.T) {
+	server := httptest.NewServer(&Handler{NewServer: func(*http.Request) *Server {
+		return testServer("guest")
+	}})
+	defer server.Close()
+	// each handshake on a connection of its own
+	if status, body := handlerGet(t, &http.Transport{}, server.URL, "guest"); status != http.StatusOK || body != "access granted to isis\\malory\n" {
+		t.Fatalf("expected access to be granted, got %d: %s", status, body)
+	}
+	if status, body := handlerGet(t, &http.Transport{}, server.URL, "secret"); status != http.StatusUnauthorized ||
+		!strings.Contains(body, ErrAuthenticationFailed.Error()) {
+		t.Fatalf("expected access to be denied, got %d: %s", status, body)
+	}
+}
+
+func TestHandlerChannelBindings(t *testing.T) {
+	var server *httptest.Server
+	handler := &Handler{NewServer: func(*http.Request) *Server {
+		s := testServer("guest")
+		s.ChannelBindings = TLSServerEndPoint(server.Certificate())
+		return s
+	}}
+	server = httptest.NewTLSServer(handler)
+	defer server.Close()
+	if status, body := handlerGet(t, server.Client().Transport, server.URL, "guest"); status != http.StatusOK {
+		t.Fatalf("expected access to be granted, got %d: %s", status, body)
+	}
+
+	// the same handshake relayed over plain HTTP carries no channel
+	// bindings
+	plain := httptest.NewServer(handler)
+	defer plain.Close()
+	if status, body := handlerGet(t, plain.Client().Transport, plain.URL, "guest"); status != http.StatusUnauthorized ||
+		!strings.Contains(body, "channel bindings") {
+		t.Fatalf("expected access to be denied, got %d: %s", status, body)
+	}
+}
+
+func TestHandlerFixedChallenge(t *testing.T) {
+	server := httptest.NewServer(&Handler{NewServer: func(*http.Request) *Server {
+		s := testServer("guest")
+		s.Rand = bytes.NewReader([]byte("srvchall"))
+		s.TargetInfo = []AVPair{
+			{ID: MsvAvNbDomainName, Value: toUnicode("DOMAIN")},
+			{ID: MsvAvNbComputerName, Value: toUnicode("SERVER")},
+			{ID: MsvAvTimestamp, Value: fileTime(time.Date(2024, 2, 29, 12, 0, 0, 0, time.UTC))},
+		}
+		return s
+	}})
+	defer server.Close()
+	// with both challenges fixed, every handshake sends the same message
+	for i := 0; i < 2; i++ {
+		var transcript *Transcript
+		negotiator := Negotiator{
+			RoundTripper:    &http.Transport{},
+			ClientChallenge: []byte("clientch"),
+			Transcript:      func(tr *Transcript) { transcript = tr },
+		}
+		req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth("isis\\malory", "guest")
+		resp, err := negotiator.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected access to be granted, got %s", resp.Status)
+		}
+		if expected := "4e544c4d53535000030000000000000040000000600060004000000008000800a00000000c000c00a800000000000000b400000000000000b4000000010289a0540e3c401aebc329adac996f759b58fc010100000000000000e01dd2066bda01636c69656e7463680000000002000c0044004f004d00410049004e0001000c005300450052005600450052000700080000e01dd2066bda01000000000000000069007300690073006d0061006c006f0072007900"; hex.EncodeToString(transcript.Authenticate) != expected {
+			t.Fatalf("handshake %d: expected AUTHENTICATE message %s, got %x", i, expected, transcript.Authenticate)
+		}
+	}
+}
+
+func TestHandlerRestart(t *testing.T) {
+	server := httptest.NewServer(&Handler{NewServer: func(*http.Request) *Server {
+		return testServer("guest")
+	}})
+	defer server.Close()
+	// all messages go over the same connection
+	rt := &http.Transport{}
+	defer rt.CloseIdleConnections()
+	send := func(msg []byte) (*http.Response, []byte) {
+		req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "NTLM "+base64.StdEncoding.EncodeToString(msg))
+		resp, err := rt.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		challenge, _ := authheader(resp.Header.Values("Www-Authenticate")).GetData()
+		return resp, challenge
+	}
+	abandoned := Client{Domain: "isis", User: "malory", Password: "guest"}
+	negotiate, err := abandoned.Step(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	send(negotiate)
+	// a NEGOTIATE message in the middle of the handshake starts it over
+	c := Client{Domain: "isis", User: "malory", Password: "guest"}
+	if negotiate, err = c.Step(nil); err != nil {
+		t.Fatal(err)
+	}
+	_, challenge := send(negotiate)
+	authenticate, err := c.Step(challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp, _ := send(authenticate); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected access to be granted, got %s", resp.Status)
+	}
+}
+
+func TestHandlerConnState(t *testing.T) {
+	handler := &Handler{NewServer: func(*http.Request) *Server {
+		return testServer("guest")
+	}}
+	server := httptest.NewUnstartedServer(handler)
+	server.Config.ConnState = handler.ConnState
+	server.Start()
+	defer server.Close()
+	rt := &http.Transport{}
+	if status, body := handlerGet(t, rt, server.URL, "guest"); status != http.StatusOK {
+		t.Fatalf("expected access to be granted, got %d: %s", status, body)
+	}
+	rt.CloseIdleConnections()
+	// the handshake is forgotten along with the connection
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		handler.mu.Lock()
+		n := len(handler.servers)
+		handler.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the handshake to be forgotten, %d left", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,89 @@
+//go:build interop
+
+// Interoperability tests, run with
+//
+//	go test -tags interop
+//
+// They authenticate curl's NTLM implementation against Server, and Negotiator
+// against both Server and, if NTLMSSP_INTEROP_URL is set, a real NTLM server
+// such as IIS, Apache with mod_auth_ntlm or a samba backed proxy. The
+// credentials for the latter are taken from NTLMSSP_INTEROP_USER (as
+// DOMAIN\user) and NTLMSSP_INTEROP_PASSWORD. This package has no SSPI client,
+// so only the pure Go client is covered on Windows as well.
+
+package ntlmssp
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"testing"
+)
+
+// serverHandler authenticates clients against testServer.
+func serverHandler(password string) http.Handler {
+	return &Handler{NewServer: func(*http.Request) *Server {
+		return testServer(password)
+	}}
+}
+
+func TestInteropCurl(t *testing.T) {
+	if _, err := exec.LookPath("curl"); err != nil {
+		t.Skip("curl not available")
+	}
+	server := httptest.NewServer(serverHandler("guest"))
+	defer server.Close()
+	output, err := exec.Command("curl", "-sf", "--ntlm", "-u", "isis\\malory:guest", server.URL).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(output), "access granted to isis\\malory\n"; got != want {
+		t.Fatalf("want %q, got %q", want, got)
+	}
+}
+
+func TestInteropNegotiator(t *testing.T) {
+	server := httptest.NewServer(serverHandler("guest"))
+	defer server.Close()
+	client := http.Client{Transport: Negotiator{}}
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("isis\\malory", "guest")
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(body), "access granted to isis\\malory\n"; got != want {
+		t.Fatalf("want %q, got %q", want, got)
+	}
+}
+
+func TestInteropExternal(t *testing.T) {
+	url := os.Getenv("NTLMSSP_INTEROP_URL")
+	if url == "" {
+		t.Skip("NTLMSSP_INTEROP_URL not set")
+	}
+	client := http.Client{Transport: Negotiator{}}
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth(os.Getenv("NTLMSSP_INTEROP_USER"), os.Getenv("NTLMSSP_INTEROP_PASSWORD"))
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, res.StatusCode)
+	}
+}
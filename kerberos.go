@@ -0,0 +1,54 @@
+package ntlmssp
+
+import (
+	"encoding/asn1"
+	"errors"
+)
+
+// KerberosProvider supplies the Kerberos tokens Negotiator sends under the
+// Negotiate scheme before falling back to NTLM. This package has no Kerberos
+// implementation of its own, so a provider typically wraps a library such as
+// gokrb5 or the platform's GSS-API.
+type KerberosProvider interface {
+	// InitSecContext returns the initial Kerberos context token, i.e. the
+	// AP-REQ, for the service principal name spn, e.g. HTTP/host.
+	InitSecContext(spn string) ([]byte, error)
+
+	// VerifyMutual checks the server's final Kerberos token, i.e. the
+	// AP-REP, against the context started by InitSecContext. It must fail
+	// unless the token proves the server's identity, Result.MutualAuth is
+	// only set if it succeeds.
+	VerifyMutual(token []byte) error
+}
+
+// prefersKerberos reports whether a server that offered the Negotiate scheme
+// with the token hint should be sent Kerberos first: servers that list the
+// mechanisms they support in a NegTokenInit2 must list Kerberos first, those
+// that send no list are tried optimistically.
+func prefersKerberos(hint []byte) bool {
+	if len(hint) == 0 {
+		return true
+	}
+	init, err := parseNegTokenInit(hint)
+	if err != nil || len(init.MechTypes) == 0 {
+		return true
+	}
+	return isKerberos(init.MechTypes[0])
+}
+
+func isKerberos(mech asn1.ObjectIdentifier) bool {
+	return mech.Equal(oidKerberos) || mech.Equal(oidMSKerberos)
+}
+
+// kerberosToken returns the Kerberos token for host wrapped in a SPNEGO
+// NegTokenInit, which offers NTLM as the alternative.
+func kerberosToken(p KerberosProvider, host string) ([]byte, error) {
+	token, err := p.InitSecContext("HTTP/" + host)
+	if err != nil {
+		return nil, err
+	}
+	if len(token) == 0 {
+		return nil, errors.New("ntlmssp: Kerberos provider returned no token")
+	}
+	return wrapNegTokenInit([]asn1.ObjectIdentifier{oidKerberos, oidNTLM}, token)
+}
@@ -0,0 +1,182 @@
+package ntlmssp
+
+import (
+	"bytes"
+	"encoding/asn1"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type fakeKerberos struct {
+	token []byte
+	apRep []byte // the server's final token that passes verification
+	spns  []string
+}
+
+func (k *fakeKerberos) InitSecContext(spn string) ([]byte, error) {
+	k.spns = append(k.spns, spn)
+	return k.token, nil
+}
+
+func (k *fakeKerberos) VerifyMutual(token []byte) error {
+	if !bytes.Equal(token, k.apRep) {
+		return errors.New("AP-REP doesn't match")
+	}
+	return nil
+}
+
+// kerberosServer offers Negotiate with a hint listing mechs, accepts the
+// Kerberos token apReq if it is not nil, answering with apRep, and otherwise
+// falls back to handler.
+func kerberosServer(t *testing.T, mechs []asn1.ObjectIdentifier, apReq, apRep []byte) *httptest.Server {
+	hint, err := asn1.Marshal(negTokenInit{MechTypes: mechs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hint, err = asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: hint})
+	if err != nil {
+		t.Fatal(err)
+	}
+	final, err := asn1.Marshal(negTokenResp{NegState: negStateAcceptCompleted, ResponseToken: apRep})
+	if err != nil {
+		t.Fatal(err)
+	}
+	final, err = asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 1, IsCompound: true, Bytes: final})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		scheme, authz, _ := strings.Cut(req.Header.Get("Authorization"), " ")
+		data, _ := base64.StdEncoding.DecodeString(authz)
+		if scheme != "Negotiate" || len(data) == 0 {
+			w.Header().Set("WWW-Authenticate", "Negotiate "+base64.StdEncoding.EncodeToString(hint))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if init, err := parseNegTokenInit(data); err == nil && len(init.MechTypes) > 0 && isKerberos(init.MechTypes[0]) {
+			if apReq == nil || !bytes.Equal(init.MechToken, apReq) {
+				w.Header().Set("WWW-Authenticate", "Negotiate")
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Header().Set("WWW-Authenticate", "Negotiate "+base64.StdEncoding.EncodeToString(final))
+			return
+		}
+		handler(w, req)
+	}))
+}
+
+func TestNegotiatorKerberos(t *testing.T) {
+	apReq, apRep := []byte("fake AP-REQ"), []byte("fake AP-REP")
+	server := kerberosServer(t, []asn1.ObjectIdentifier{oidMSKerberos, oidKerberos, oidNTLM}, apReq, apRep)
+	defer server.Close()
+	k := &fakeKerberos{token: apReq, apRep: apRep}
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := Negotiator{Kerberos: k}.Authenticate(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Response.Body.Close()
+	if r.Response.StatusCode != http.StatusOK || !r.Kerberos || !r.MutualAuth {
+		t.Fatalf("expected Kerberos to be accepted, got status %d, Kerberos %v, MutualAuth %v",
+			r.Response.StatusCode, r.Kerberos, r.MutualAuth)
+	}
+	if want := "HTTP/" + req.URL.Hostname(); len(k.spns) != 1 || k.spns[0] != want {
+		t.Fatalf("expected a token for %s, got %v", want, k.spns)
+	}
+
+	// a server that can't prove its identity
+	req, err = http.NewRequest(http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Negotiator{Kerberos: &fakeKerberos{token: apReq, apRep: []byte("other AP-REP")}}.Authenticate(req)
+	if err == nil || !strings.Contains(err.Error(), "AP-REP doesn't match") {
+		t.Fatalf("expected the AP-REP to fail verification, got %v", err)
+	}
+}
+
+func TestNegotiatorKerberosVirtualHost(t *testing.T) {
+	apReq, apRep := []byte("fake AP-REQ"), []byte("fake AP-REP")
+	server := kerberosServer(t, []asn1.ObjectIdentifier{oidKerberos, oidNTLM}, apReq, apRep)
+	defer server.Close()
+	k := &fakeKerberos{token: apReq, apRep: apRep}
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = "intranet.example:8080"
+	r, err := Negotiator{Kerberos: k}.Authenticate(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Response.Body.Close()
+	if want := "HTTP/intranet.example"; len(k.spns) != 1 || k.spns[0] != want {
+		t.Fatalf("expected a token for %s, got %v", want, k.spns)
+	}
+}
+
+func TestNegotiatorKerberosFallback(t *testing.T) {
+	// the server doesn't accept the Kerberos token
+	server := kerberosServer(t, []asn1.ObjectIdentifier{oidKerberos, oidNTLM}, nil, nil)
+	defer server.Close()
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("isis\\malory", "guest")
+	r, err := Negotiator{Kerberos: &fakeKerberos{token: []byte("fake AP-REQ")}}.Authenticate(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Response.Body.Close()
+	if r.Kerberos || r.Username != "malory" {
+		t.Fatalf("expected to fall back to NTLM, got Kerberos %v and user %q", r.Kerberos, r.Username)
+	}
+
+	// a server that prefers NTLM isn't sent Kerberos at all
+	server = kerberosServer(t, []asn1.ObjectIdentifier{oidNTLM, oidKerberos}, []byte("fake AP-REQ"), nil)
+	defer server.Close()
+	req, err = http.NewRequest(http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("isis\\malory", "guest")
+	k := &fakeKerberos{token: []byte("fake AP-REQ")}
+	r, err = Negotiator{Kerberos: k}.Authenticate(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Response.Body.Close()
+	if r.Kerberos || len(k.spns) != 0 {
+		t.Fatalf("expected NTLM without trying Kerberos, got Kerberos %v after %d tokens", r.Kerberos, len(k.spns))
+	}
+}
+
+func TestNegTokenInit(t *testing.T) {
+	token, err := wrapNegTokenInit([]asn1.ObjectIdentifier{oidKerberos, oidNTLM}, []byte("token"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the GSS-API framing of the SPNEGO OID
+	if !bytes.HasPrefix(token[2:], []byte{0x06, 0x06, 0x2b, 0x06, 0x01, 0x05, 0x05, 0x02}) || token[0] != 0x60 {
+		t.Fatalf("expected an InitialContextToken for SPNEGO, got %x", token)
+	}
+	init, err := parseNegTokenInit(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(init.MechTypes) != 2 || !init.MechTypes[0].Equal(oidKerberos) || !init.MechTypes[1].Equal(oidNTLM) {
+		t.Errorf("unexpected mechanisms %v", init.MechTypes)
+	}
+	if string(init.MechToken) != "token" {
+		t.Errorf("expected mechToken %q, got %q", "token", init.MechToken)
+	}
+}
@@ -0,0 +1,39 @@
+package ntlmssp
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// test vectors from RFC 1320
+var md4Vectors = []struct {
+	in, out string
+}{
+	{"", "31d6cfe0d16ae931b73c59d7e0c089c0"},
+	{"a", "bde52cb31de33e46245e05fbdbd6fb24"},
+	{"abc", "a448017aaf21d8525fc10ae87aa6729d"},
+	{"message digest", "d9130a8164549fe818874806e1c7014b"},
+	{"abcdefghijklmnopqrstuvwxyz", "d79e1c308aa5bbcdeea8ed63df412da9"},
+	{"ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789", "043f8582f241db351ce627e153e7f0e4"},
+	{strings.Repeat("1234567890", 8), "e33b4ddc9c38f2199c3e7b164fcc0536"},
+}
+
+func TestMD4(t *testing.T) {
+	for _, v := range md4Vectors {
+		h := newMD4()
+		h.Write([]byte(v.in))
+		if out := hex.EncodeToString(h.Sum(nil)); out != v.out {
+			t.Errorf("%q: expected %s, got %s", v.in, v.out, out)
+		}
+		// the same, written in pieces and summed halfway
+		h.Reset()
+		for i := 0; i < len(v.in); i += 7 {
+			h.Write([]byte(v.in[i:min(i+7, len(v.in))]))
+			h.Sum(nil)
+		}
+		if out := hex.EncodeToString(h.Sum(nil)); out != v.out {
+			t.Errorf("%q in pieces: expected %s, got %s", v.in, v.out, out)
+		}
+	}
+}
@@ -2,6 +2,8 @@ package ntlmssp
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 )
 
 var signature = [8]byte{'N', 'T', 'L', 'M', 'S', 'S', 'P', 0}
@@ -16,6 +18,21 @@ func (h messageHeader) IsValid() bool {
 		h.MessageType > 0 && h.MessageType < 4
 }
 
+// check returns a descriptive error if the header is not valid, or not
+// that of a message of type want, unless want is 0.
+func (h messageHeader) check(want MessageType) error {
+	if !bytes.Equal(h.Signature[:], signature[:]) {
+		return errors.New("invalid signature")
+	}
+	if !h.IsValid() {
+		return fmt.Errorf("invalid message type %d", h.MessageType)
+	}
+	if want != 0 && MessageType(h.MessageType) != want {
+		return fmt.Errorf("expected %v message, got %v", want, MessageType(h.MessageType))
+	}
+	return nil
+}
+
 func newMessageHeader(messageType uint32) messageHeader {
 	return messageHeader{signature, messageType}
 }
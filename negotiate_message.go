@@ -19,6 +19,9 @@ type negotiateMessageFields struct {
 	Version
 }
 
+// defaultFlags are requested in every NEGOTIATE message. TARGETINFO asks for
+// the AV pairs of the server; servers that ignore it get an NTLMv2 response
+// without them.
 var defaultFlags = negotiateFlagNTLMSSPNEGOTIATETARGETINFO |
 	negotiateFlagNTLMSSPNEGOTIATE56 |
 	negotiateFlagNTLMSSPNEGOTIATE128 |
@@ -28,15 +31,26 @@ var defaultFlags = negotiateFlagNTLMSSPNEGOTIATETARGETINFO |
 //NewNegotiateMessage creates a new NEGOTIATE message with the
 //flags that this package supports.
 func NewNegotiateMessage(domainName, workstationName string) ([]byte, error) {
-	payloadOffset := expMsgBodyLen
 	flags := defaultFlags
+	if workstationName != "" {
+		flags |= negotiateFlagNTLMSSPNEGOTIATEOEMWORKSTATIONSUPPLIED
+	}
+	return newNegotiateMessage(domainName, workstationName, flags, nil)
+}
+
+// newNegotiateMessage sets the domain supplied flag for a non-empty domain
+// name, the workstation supplied flag is up to the caller. The version, if
+// not nil, is sent instead of DefaultVersion along with the version flag.
+func newNegotiateMessage(domainName, workstationName string, flags negotiateFlags, version *Version) ([]byte, error) {
+	payloadOffset := expMsgBodyLen
 
 	if domainName != "" {
 		flags |= negotiateFlagNTLMSSPNEGOTIATEOEMDOMAINSUPPLIED
 	}
-
-	if workstationName != "" {
-		flags |= negotiateFlagNTLMSSPNEGOTIATEOEMWORKSTATIONSUPPLIED
+	v := DefaultVersion()
+	if version != nil {
+		flags |= negotiateFlagNTLMSSPNEGOTIATEVERSION
+		v = version.withRevision()
 	}
 
 	msg := negotiateMessageFields{
@@ -44,7 +58,7 @@ func NewNegotiateMessage(domainName, workstationName string) ([]byte, error) {
 		NegotiateFlags: flags,
 		Domain:         newVarField(&payloadOffset, len(domainName)),
 		Workstation:    newVarField(&payloadOffset, len(workstationName)),
-		Version:        DefaultVersion(),
+		Version:        v,
 	}
 
 	b := bytes.Buffer{}
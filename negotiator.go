@@ -2,11 +2,18 @@ package ntlmssp
 
 import (
 	"bytes"
+	"context"
+	"encoding/asn1"
 	"encoding/base64"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httptrace"
 	"strings"
+	"time"
 )
 
 // GetDomain : parse domain name from based on slashes in the input
@@ -19,120 +26,1087 @@ func GetDomain(user string) (string, string) {
 
 // Negotiator is a http.Roundtripper decorator that automatically
 // converts basic authentication to NTLM/Negotiate authentication when appropriate.
-type Negotiator struct{ http.RoundTripper }
+type Negotiator struct {
+	http.RoundTripper
+
+	// TargetInfo, if not nil, replaces the AV pairs echoed from the
+	// server's challenge in the NTLMv2 response. This is an expert option
+	// meant for interoperability testing; by default the server's target
+	// info is sent back unchanged.
+	TargetInfo []AVPair
+
+	// Metrics, if not nil, is called at the end of every RoundTrip with
+	// a summary of the handshake. It is called synchronously and should
+	// return quickly.
+	Metrics func(HandshakeMetrics)
+
+	// NeedsReauth, if not nil, is called with the response to the first,
+	// unauthenticated leg of RoundTrip when it isn't a 401, and reports
+	// whether the server nevertheless wants a fresh handshake, e.g. because
+	// of a header marking the session as stale. The handshake is then run
+	// as if the server had answered with a 401 offering the schemes of its
+	// WWW-Authenticate header, or NTLM if it sent none.
+	NeedsReauth func(*http.Response) bool
+
+	// ProbeMethod, if set, is the method (e.g. "HEAD" or "OPTIONS") of the
+	// body-less requests used to elicit the authentication challenge. The
+	// real request is then only sent once, when it can be authenticated,
+	// which keeps non-idempotent endpoints from seeing it more than once.
+	// The trade-off is an extra round trip when the server doesn't require
+	// authentication.
+	ProbeMethod string
+
+	// MaxBodySize, if positive, is the size of the largest request body
+	// RoundTrip accepts. The body is buffered so that it can be sent
+	// again once the handshake completes, larger ones are refused with
+	// ErrBodyTooLarge before anything is sent.
+	MaxBodySize int64
+
+	// RetryThrottled, if positive, is the number of times the handshake
+	// is started over when the server throttles it, i.e. fails it with a
+	// 401 that carries a Retry-After header. RoundTrip first waits for the
+	// indicated time, or fails with the error of the request's context if
+	// that is done sooner. By default throttled handshakes fail like any
+	// other.
+	RetryThrottled int
+
+	// ProbeLength selects how the body-less requests sent by Probe, for
+	// ProbeMethod and along with the NEGOTIATE message declare their
+	// length, for servers and firewalls that reject some forms of empty
+	// request. The default sends Content-Length: 0 where net/http does,
+	// i.e. for POST, PUT and PATCH.
+	ProbeLength ProbeLength
+
+	// HandshakeTimeout, if positive, bounds the total time spent on all
+	// legs of the handshake, independently of the request's context. When
+	// it expires RoundTrip returns ErrHandshakeTimeout.
+	HandshakeTimeout time.Duration
+
+	// VerifyConnection makes RoundTrip check, by tracing the connections
+	// the transport hands out, that the AUTHENTICATE message is sent on
+	// the connection the challenge was received on, since NTLM
+	// authenticates the connection rather than the request. If it isn't,
+	// e.g. because of a pooling bug, RoundTrip fails with
+	// ErrConnectionChanged.
+	VerifyConnection bool
+
+	// Credentials, if not nil, supplies the credentials used to
+	// authenticate a request, instead of the request's basic
+	// authorization header. RoundTrip wipes the Password and Hash of the
+	// returned Credential, along with the NT hash derived from it, as soon
+	// as the AUTHENTICATE message has been built.
+	Credentials func(req *http.Request) (Credential, error)
+
+	// Anonymous allows anonymous authentication when the credentials from
+	// the basic authorization header, Credentials or RealmCredentials are
+	// empty. Otherwise RoundTrip fails with ErrNoCredentials before any
+	// AUTHENTICATE message is sent.
+	Anonymous bool
+
+	// RealmCredentials, if not nil, is used instead of Credentials to pick
+	// the credentials based on the realm the server belongs to, i.e. the
+	// target name of its challenge (usually its domain). This allows using
+	// the right credentials for any host of a realm. The returned
+	// Credential is wiped just like with Credentials.
+	RealmCredentials func(realm string, req *http.Request) (Credential, error)
+
+	// Rewrite, if not nil, is called with every NTLM message just before
+	// it is sent and may modify it, e.g. to test how servers deal with
+	// tampered messages. If it returns nil, the original message is sent.
+	Rewrite func(messageType MessageType, msg []byte) []byte
+
+	// Transcript, if not nil, is called with the messages of every
+	// handshake, as sent, once the AUTHENTICATE message has been built.
+	Transcript func(*Transcript)
+
+	// CurlCommand, if not nil, is called whenever a handshake fails or the
+	// server rejects the AUTHENTICATE message, with a curl command line
+	// that reproduces it, e.g. for support tickets. The command carries
+	// the method, URL and Host of the request and the user, but never a
+	// password: curl prompts for it. Other headers and the body are left
+	// out.
+	CurlCommand func(cmd string)
+
+	// SingleHost, if not nil, is sent to the server as an MsvAvSingleHost
+	// AV pair along with the NTLMv2 response.
+	SingleHost *SingleHostData
+
+	// TargetName, if set, is sent as the domain of the AUTHENTICATE
+	// message instead of the domain of the credentials, see
+	// Client.TargetName.
+	TargetName string
+
+	// NegotiateDomain and NegotiateWorkstation, if set, are sent in the
+	// NEGOTIATE message only, see Client.NegotiateDomain.
+	NegotiateDomain      string
+	NegotiateWorkstation string
+
+	// VerifyTargetName, if set, makes RoundTrip abort the handshake when
+	// the server's challenge carries an MsvAvTargetName that isn't the SPN
+	// of the requested host, i.e. HTTP/<host>, where the host is that of
+	// the request's Host if set and otherwise that of its URL. This
+	// protects against the challenge being relayed from another server.
+	// Challenges without a target name are accepted as usual.
+	VerifyTargetName bool
+
+	// ChannelBinding, if not nil, is the 16 byte MsvAvChannelBindings value
+	// sent instead of the one derived from the TLS connection, for when
+	// the TLS layer isn't visible to RoundTrip, e.g. behind a TLS
+	// terminating proxy. It is the Hash of the channel bindings, such as
+	// TLSServerEndPoint(cert).Hash() or that of ChannelBindings with the
+	// application data of the outer channel.
+	ChannelBinding []byte
+
+	// AllowedTargets, if not empty, lists the servers RoundTrip is willing
+	// to authenticate to, by the target name or the NetBIOS or DNS
+	// computer name of their challenge, compared case-insensitively. The
+	// handshake is aborted with ErrTargetNotAllowed before the
+	// AUTHENTICATE message is sent to any other server.
+	AllowedTargets []string
+
+	// Identify requests an identify level rather than an impersonation
+	// token, see Client.Identify.
+	Identify bool
+
+	// Version, if not nil, is sent in the NEGOTIATE and AUTHENTICATE
+	// messages, see Client.Version.
+	Version *Version
+
+	// RequireMIC sends a MIC in the AUTHENTICATE message, even if the
+	// server's challenge has no timestamp, see Client.RequireMIC.
+	RequireMIC bool
+
+	// ForceOEM encodes the strings of the AUTHENTICATE message as OEM, see
+	// Client.ForceOEM.
+	ForceOEM bool
+
+	// RefuseNTLMv1 aborts the handshake with ErrNTLMv1Refused if the
+	// server's challenge only allows an NTLMv1 response.
+	RefuseNTLMv1 bool
+
+	// OmitTimestamp builds the NTLMv2 response without a timestamp, see
+	// Client.OmitTimestamp.
+	OmitTimestamp bool
+
+	// ZeroLMResponse sends Z(24) rather than an empty LM response, see
+	// Client.ZeroLMResponse.
+	ZeroLMResponse bool
+
+	// Scheme, if set, is the scheme name (e.g. "Negotiate") used in the
+	// Authorization header of the handshake, regardless of the scheme
+	// offered by the server. By default the offered scheme is used,
+	// preferring NTLM if the server offers both.
+	Scheme string
+
+	// Kerberos, if not nil, is tried first when the server offers the
+	// Negotiate scheme and, if it hints at the mechanisms it supports,
+	// lists Kerberos first. Its token is sent in a SPNEGO NegTokenInit;
+	// if the provider fails or the server turns the token down, the
+	// handshake falls back to NTLM.
+	Kerberos KerberosProvider
+
+	// NewClient, if not nil, returns the NTLMClient that builds the NTLM
+	// messages of the handshake for req in place of the package's Client,
+	// e.g. SSPIClient on Windows, which authenticates as the logged-on
+	// user. Its messages are sent exactly as they are, with the flags and
+	// version it chose, so the options that shape them, e.g. Credentials,
+	// RealmCredentials, Version, ChannelBinding and Rewrite, don't apply.
+	// The challenge is still parsed for VerifyTargetName and
+	// AllowedTargets.
+	NewClient func(req *http.Request) (NTLMClient, error)
+
+	// RawNegotiate sends the NTLM messages under the Negotiate scheme as
+	// they are, rather than wrapped in SPNEGO, for servers that only
+	// accept raw NTLM there. By default the NEGOTIATE message is sent in
+	// a NegTokenInit that offers NTLM as the only mechanism.
+	RawNegotiate bool
+
+	// PinAuthenticatedConnection, if set, sends every request over a
+	// connection of its own for the whole handshake, and keeps that
+	// connection for follow-up requests that authenticate as the same user
+	// once the response body has been closed. The server then finds them
+	// already authenticated, so no further handshakes are needed until it
+	// answers with a 401, e.g. because a gateway expired the
+	// authentication. The handshake is then run again on the same
+	// connection and the request sent once more. Concurrent requests each
+	// get their own connection. This requires the RoundTripper to be an
+	// *http.Transport (or nil), otherwise the option is ignored.
+	PinAuthenticatedConnection bool
+
+	// IgnoreBasicAuthHeader, if set, leaves a basic authorization header of
+	// the request alone, e.g. when it is meant for a service behind the
+	// server. It is then neither used as NTLM credentials nor as a fallback
+	// to basic authentication, and is sent unchanged unless replaced by an
+	// NTLM message. Credentials must then come from Credentials or
+	// RealmCredentials.
+	IgnoreBasicAuthHeader bool
+
+	// Now, if not nil, is used instead of time.Now for the timestamp of
+	// the NTLMv2 response when the server sent none, e.g. to reproduce a
+	// handshake or to correct for clock skew.
+	Now func() time.Time
+
+	// ClientChallenge, if not nil, is the 8 byte client challenge used
+	// instead of a random one, see Client.ClientChallenge.
+	ClientChallenge []byte
+
+	// MaxDrain is the number of bytes read from the bodies of intermediate
+	// responses, e.g. error pages sent along with a challenge, before they
+	// are closed. Reading a body to the end allows reusing the connection,
+	// but isn't worth downloading large ones. It defaults to 64 KiB, a
+	// negative value means no limit.
+	MaxDrain int64
+
+	// CandidateCredentials, if not empty, are tried in order until the
+	// server accepts one, instead of Credentials or the basic
+	// authorization header, e.g. cached credentials followed by prompted
+	// ones. Each attempt after the first runs on a fresh connection.
+	// MaxAttempts, if positive, limits the number of credentials tried.
+	// Unlike Credentials, they aren't wiped after use.
+	CandidateCredentials []Credential
+	MaxAttempts          int
+
+	// ProxyCredentials, if not nil, supplies the credentials used to
+	// authenticate to an NTLM proxy in front of the server, i.e. the
+	// Proxy of the RoundTripper, independently of those used for the
+	// server. Whenever a leg of the handshake is answered with a 407, the
+	// handshake with the proxy is run first, using the Proxy-Authorization
+	// and Proxy-Authenticate headers, before the leg goes on to the
+	// server. The returned Credential is wiped just like with Credentials.
+	// Only plain HTTP proxies are covered, the transport sends the CONNECT
+	// requests for HTTPS itself. Since NTLM authenticates the connection
+	// to the proxy, this is best combined with PinAuthenticatedConnection.
+	ProxyCredentials func(req *http.Request) (Credential, error)
+
+	// proxy makes the Negotiator authenticate to a proxy rather than to
+	// the server.
+	proxy bool
+}
+
+// HandshakeMetrics describes the outcome of a single call to
+// Negotiator.RoundTrip.
+type HandshakeMetrics struct {
+	RoundTrips int           // number of requests sent to the server
+	Scheme     string        // "NTLM", "Negotiate", "Basic" or "" if no authentication was attempted
+	Duration   time.Duration // total time spent in RoundTrip
+	StatusCode int           // status code of the final response, 0 if RoundTrip failed
+	Err        error         // error returned by RoundTrip, if any
+}
+
+// Result describes an authenticated exchange with the server.
+type Result struct {
+	Response *http.Response // final response of the server
+
+	// Domain and Username are those the client authenticated as using
+	// NTLM, and SessionKey the exported session key of the handshake. They
+	// are empty if no NTLM AUTHENTICATE message was sent.
+	Domain          string
+	Username        string
+	SessionKey      []byte
+	NegotiatedFlags uint32 // see Session.NegotiatedFlags
+
+	Scheme       string // as in HandshakeMetrics
+	RoundTrips   int    // as in HandshakeMetrics
+	ChannelBound bool   // whether the authentication was bound to the TLS connection
+	// TLS is set if the final response was received over TLS, and
+	// PeerCertificateHash is the hash of the server certificate that the
+	// authentication was bound to, if any, as in tls-server-end-point
+	// channel bindings.
+	TLS                 bool
+	PeerCertificateHash []byte
+	// MutualAuth is set if the server proved its identity with the final
+	// token of a Kerberos handshake, as verified by Negotiator.Kerberos.
+	// NTLM doesn't authenticate the server, so it is never set otherwise.
+	MutualAuth bool
+	// Kerberos is set if the server accepted the token of
+	// Negotiator.Kerberos, in which case no NTLM handshake took place.
+	Kerberos bool
+}
+
+// handshake tracks the requests sent on behalf of a single call to RoundTrip.
+type handshake struct {
+	rt         http.RoundTripper
+	roundTrips int
+	scheme     string
+
+	// the CHALLENGE message, once received
+	challenge []byte
+
+	// set once the AUTHENTICATE message has been built
+	authenticate bool
+	domain, user string
+	session      *Session
+	channelBound bool
+	certHash     []byte
+	mutualAuth   bool
+	kerberos     bool
+
+	// traceConn records the connection of every request in conn
+	traceConn bool
+	conn      net.Conn
+
+	// the Retry-After of the last response, if it was a 401
+	retryAfter time.Duration
+}
+
+func (h *handshake) roundTrip(req *http.Request) (*http.Response, error) {
+	h.roundTrips++
+	if h.traceConn {
+		h.conn = nil
+		trace := &httptrace.ClientTrace{GotConn: func(info httptrace.GotConnInfo) { h.conn = info.Conn }}
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	}
+	res, err := h.rt.RoundTrip(req)
+	h.retryAfter = 0
+	if err == nil && res.StatusCode == http.StatusUnauthorized {
+		h.retryAfter = retryAfter(res, time.Now())
+	}
+	return res, err
+}
+
+// ErrBodyTooLarge is returned by RoundTrip when the request body is larger
+// than Negotiator.MaxBodySize.
+var ErrBodyTooLarge = errors.New("ntlmssp: request body too large to buffer for the handshake")
+
+// ErrConnectionChanged is returned by RoundTrip when VerifyConnection is set
+// and the AUTHENTICATE message went out on a different connection than the
+// one the challenge was received on.
+var ErrConnectionChanged = errors.New("ntlmssp: AUTHENTICATE message sent on a different connection than the challenge")
 
 // RoundTrip sends the request to the server, handling any authentication
-// re-sends as needed.
-func (l Negotiator) RoundTrip(req *http.Request) (res *http.Response, err error) {
+// re-sends as needed. Every leg of the handshake is sent with the URL, Host
+// and headers of the original request, so that virtual hosting and header
+// based routing keep working. Only the bodies of the intermediate responses
+// are drained, the body of the final response is streamed from the server
+// as usual.
+func (l Negotiator) RoundTrip(req *http.Request) (*http.Response, error) {
+	r, err := l.Authenticate(req)
+	var rejected *RejectedError
+	if errors.As(err, &rejected) {
+		// a RoundTripper must not interpret the status of the response
+		return rejected.Response, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return r.Response, nil
+}
+
+// RejectReason is the best-effort reason why a server rejected the
+// AUTHENTICATE message.
+type RejectReason int
+
+const (
+	RejectUnknown RejectReason = iota
+	// RejectCredentials means the server asked to authenticate again.
+	// Servers don't tell a wrong password from an unknown or locked
+	// account.
+	RejectCredentials
+	// RejectPolicy means the server turned the user down for other
+	// reasons, e.g. missing channel bindings or because the user isn't
+	// allowed access.
+	RejectPolicy
+)
+
+func (r RejectReason) String() string {
+	switch r {
+	case RejectCredentials:
+		return "credentials rejected"
+	case RejectPolicy:
+		return "rejected by policy"
+	}
+	return "rejected"
+}
+
+// RejectedError is returned by Authenticate when the server rejects the
+// AUTHENTICATE message. The caller must close the body of Response.
+type RejectedError struct {
+	Reason   RejectReason
+	Response *http.Response
+	// Challenge is the CHALLENGE message the server sent.
+	Challenge []byte
+}
+
+func (e *RejectedError) Error() string {
+	return fmt.Sprintf("ntlmssp: authentication %v (%s)", e.Reason, e.Response.Status)
+}
+
+// ChallengeError is returned by Authenticate and RoundTrip when the handshake
+// fails after the server sent its CHALLENGE message, e.g. because it could
+// not be parsed or answered. The message is kept so that it can be logged
+// and the failure replayed.
+type ChallengeError struct {
+	// Challenge is the decoded CHALLENGE message.
+	Challenge []byte
+	Err       error
+}
+
+func (e *ChallengeError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ChallengeError) Unwrap() error {
+	return e.Err
+}
+
+// ChallengeBase64 returns the CHALLENGE message as sent in the
+// WWW-Authenticate header.
+func (e *ChallengeError) ChallengeBase64() string {
+	return base64.StdEncoding.EncodeToString(e.Challenge)
+}
+
+// rejectReason classifies the response to an AUTHENTICATE message.
+func rejectReason(res *http.Response) (RejectReason, bool) {
+	switch res.StatusCode {
+	case http.StatusUnauthorized:
+		resauth := authheader(res.Header.Values("Www-Authenticate"))
+		if resauth.IsNTLM() || resauth.IsNegotiate() {
+			return RejectCredentials, true
+		}
+		return RejectPolicy, true
+	case http.StatusForbidden:
+		return RejectPolicy, true
+	}
+	return RejectUnknown, false
+}
+
+// Authenticate is like RoundTrip, but also returns the details of the
+// authentication along with the final response. Unlike RoundTrip, it
+// returns a *RejectedError if the server rejects the AUTHENTICATE message.
+func (l Negotiator) Authenticate(req *http.Request) (*Result, error) {
+	if len(l.CandidateCredentials) > 0 {
+		return l.authenticateCandidates(req)
+	}
+	return l.authenticate(req)
+}
+
+func (l Negotiator) authenticate(req *http.Request) (*Result, error) {
+	if l.RetryThrottled > 0 {
+		return l.authenticateThrottled(req)
+	}
+	return l.authenticateOnce(req, &handshake{traceConn: l.VerifyConnection})
+}
+
+// authenticateOnce runs a single handshake with h.
+func (l Negotiator) authenticateOnce(req *http.Request, h *handshake) (*Result, error) {
+	// the request's authorization is replaced during the handshake
+	authorization := req.Header.Values("Authorization")
+	res, err := l.metricRoundTrip(req, h)
+	if err != nil {
+		l.curlCommand(req, h, authorization)
+		if h.challenge != nil {
+			return nil, &ChallengeError{Challenge: h.challenge, Err: err}
+		}
+		return nil, err
+	}
+	if h.authenticate {
+		if reason, rejected := rejectReason(res); rejected {
+			l.curlCommand(req, h, authorization)
+			return nil, &RejectedError{Reason: reason, Response: res, Challenge: h.challenge}
+		}
+	}
+	r := &Result{
+		Response:     res,
+		Domain:       h.domain,
+		Username:     h.user,
+		Scheme:       h.scheme,
+		RoundTrips:   h.roundTrips,
+		ChannelBound: h.channelBound,
+		MutualAuth:   h.mutualAuth,
+		Kerberos:     h.kerberos,
+		TLS:          res.TLS != nil,
+	}
+	if h.channelBound {
+		r.PeerCertificateHash = h.certHash
+	}
+	if h.session != nil {
+		r.SessionKey = h.session.SessionKey()
+		r.NegotiatedFlags = h.session.NegotiatedFlags()
+	}
+	return r, nil
+}
+
+// metricRoundTrip runs the handshake and reports its metrics.
+func (l Negotiator) metricRoundTrip(req *http.Request, h *handshake) (*http.Response, error) {
 	// Use default round tripper if not provided
-	rt := l.RoundTripper
-	if rt == nil {
-		rt = http.DefaultTransport
+	h.rt = l.RoundTripper
+	if h.rt == nil {
+		h.rt = http.DefaultTransport
+	}
+	if l.Metrics == nil {
+		return l.pinnedRoundTrip(req, h)
+	}
+	start := time.Now()
+	res, err := l.pinnedRoundTrip(req, h)
+	m := HandshakeMetrics{
+		RoundTrips: h.roundTrips,
+		Scheme:     h.scheme,
+		Duration:   time.Since(start),
+		Err:        err,
+	}
+	if res != nil {
+		m.StatusCode = res.StatusCode
+	}
+	l.Metrics(m)
+	return res, err
+}
+
+// pinnedRoundTrip runs the handshake on a pinned connection if
+// PinAuthenticatedConnection is set. Requests are told apart by the identity
+// they authenticate with, i.e. the user from Credentials, or else the
+// authorization header, along with the user from ProxyCredentials. These are
+// resolved once up front, so that the handshake authenticates the user the
+// connection is kept for. With RealmCredentials the user isn't known before
+// the challenge, so the connection is closed once the request is done.
+func (l Negotiator) pinnedRoundTrip(req *http.Request, h *handshake) (*http.Response, error) {
+	var p *pinnedTransport
+	if l.PinAuthenticatedConnection {
+		p = pin(h.rt)
+	}
+	if p == nil {
+		return l.timedRoundTrip(req, h)
+	}
+	var t *http.Transport
+	var release func()
+	if l.RealmCredentials != nil {
+		t = p.transport()
+		release = t.CloseIdleConnections
+	} else {
+		fields := []string{"authorization", req.Header.Get("Authorization")}
+		if l.Credentials != nil {
+			cred, credentials, err := resolve(l.Credentials, req)
+			if err != nil {
+				return nil, err
+			}
+			defer cred.wipe()
+			l.Credentials = credentials
+			fields = []string{"credentials", cred.Domain, cred.User}
+		}
+		if l.ProxyCredentials != nil {
+			cred, credentials, err := resolve(l.ProxyCredentials, req)
+			if err != nil {
+				return nil, err
+			}
+			defer cred.wipe()
+			l.ProxyCredentials = credentials
+			fields = append(fields, "proxy", cred.Domain, cred.User)
+		}
+		key := identityKey(fields...)
+		t = p.acquire(key)
+		release = func() { p.release(key, t) }
+	}
+	h.rt = t
+	res, err := l.timedRoundTrip(req, h)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	res.Body = &releaseOnClose{ReadCloser: res.Body, release: release}
+	return res, nil
+}
+
+// ErrHandshakeTimeout is returned by RoundTrip when the handshake takes
+// longer than the Negotiator's HandshakeTimeout.
+var ErrHandshakeTimeout = errors.New("ntlmssp: handshake timed out")
+
+// ErrNoChallenge is returned by RoundTrip when the server answers the
+// NEGOTIATE message with a 401 that carries no CHALLENGE message.
+var ErrNoChallenge = errors.New("ntlmssp: server sent no challenge in response to the NEGOTIATE message")
+
+// timedRoundTrip runs the handshake, aborting it if it takes longer than
+// HandshakeTimeout. The timeout doesn't apply to reading the final response.
+func (l Negotiator) timedRoundTrip(req *http.Request, h *handshake) (*http.Response, error) {
+	if l.HandshakeTimeout <= 0 {
+		return l.roundTrip(req, h)
+	}
+	ctx, cancel := context.WithCancelCause(req.Context())
+	timer := time.AfterFunc(l.HandshakeTimeout, func() { cancel(ErrHandshakeTimeout) })
+	res, err := l.roundTrip(req.WithContext(ctx), h)
+	if !timer.Stop() {
+		if res != nil {
+			res.Body.Close()
+		}
+		cancel(nil)
+		return nil, ErrHandshakeTimeout
+	}
+	if err != nil {
+		cancel(nil)
+		return nil, err
+	}
+	res.Body = cancelOnClose{res.Body, cancel}
+	return res, nil
+}
+
+// cancelOnClose releases the context of the handshake once the final
+// response has been read.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelCauseFunc
+}
+
+func (b cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel(nil)
+	return err
+}
+
+// defaultMaxDrain is the default of Negotiator.MaxDrain.
+const defaultMaxDrain = 64 << 10
+
+// drain discards the body of an intermediate response, up to MaxDrain bytes,
+// and closes it. The connection can only be reused if the whole body was
+// read.
+func (l Negotiator) drain(res *http.Response) {
+	var r io.Reader = res.Body
+	switch {
+	case l.MaxDrain == 0:
+		r = io.LimitReader(r, defaultMaxDrain)
+	case l.MaxDrain > 0:
+		r = io.LimitReader(r, l.MaxDrain)
+	}
+	io.Copy(ioutil.Discard, r)
+	res.Body.Close()
+}
+
+func (l Negotiator) rewrite(messageType MessageType, msg []byte) []byte {
+	if l.Rewrite == nil {
+		return msg
+	}
+	if rewritten := l.Rewrite(messageType, msg); rewritten != nil {
+		return rewritten
+	}
+	return msg
+}
+
+// credentials returns the credentials to authenticate req with.
+func (l Negotiator) credentials(req *http.Request, reqauth authheader) (Credential, error) {
+	if l.Credentials != nil {
+		cred, err := l.Credentials(req)
+		if err != nil {
+			return Credential{}, err
+		}
+		return cred, l.checkCredential(cred)
+	}
+	// recycle credentials
+	u, p, err := reqauth.GetBasicCreds()
+	if err != nil {
+		return Credential{}, err
+	}
+	// get domain from username
+	user, domain := GetDomain(u)
+	cred := Credential{Domain: domain, User: user, Password: []byte(p)}
+	return cred, l.checkCredential(cred)
+}
+
+// ErrNoCredentials is returned by RoundTrip when the credentials to
+// authenticate with are empty and Negotiator.Anonymous isn't set.
+var ErrNoCredentials = errors.New("ntlmssp: no credentials available")
+
+// checkCredential refuses empty credentials unless anonymous authentication
+// was asked for.
+func (l Negotiator) checkCredential(cred Credential) error {
+	if cred.User == "" && len(cred.Password) == 0 && cred.Hash == nil && !l.Anonymous {
+		return ErrNoCredentials
+	}
+	return nil
+}
+
+// ErrMutualAuthRejected is returned when the server rejects the SPNEGO
+// negotiation in its final response, although the response is successful.
+var ErrMutualAuthRejected = errors.New("ntlmssp: server rejected the SPNEGO negotiation")
+
+// checkMutualAuth looks for a final SPNEGO token in the given header of the
+// response to the AUTHENTICATE message or Kerberos token. If the negotiation
+// completed with a response token, it is checked with verify, which proves
+// the server's identity. Tokens that can't be parsed are ignored.
+func (h *handshake) checkMutualAuth(res *http.Response, header string, verify func(token []byte) error) error {
+	data, err := authheader(res.Header.Values(header)).GetData()
+	if err != nil || len(data) == 0 {
+		return nil
+	}
+	token, err := parseNegTokenResp(data)
+	if err != nil {
+		return nil
+	}
+	switch token.NegState {
+	case negStateAcceptCompleted:
+		if verify == nil || len(token.ResponseToken) == 0 || res.StatusCode >= 300 {
+			return nil
+		}
+		if err := verify(token.ResponseToken); err != nil {
+			return fmt.Errorf("ntlmssp: verifying the server's final token: %w", err)
+		}
+		h.mutualAuth = true
+	case negStateReject:
+		// a 401 is left to be reported as a rejection of the
+		// AUTHENTICATE message
+		if res.StatusCode >= 200 && res.StatusCode < 300 {
+			return ErrMutualAuthRejected
+		}
+	}
+	return nil
+}
+
+// ErrTargetNotAllowed is returned when the challenge came from a server that
+// isn't one of Negotiator.AllowedTargets.
+var ErrTargetNotAllowed = errors.New("ntlmssp: server is not an allowed target")
+
+// allowedTarget reports whether the challenge names one of targets.
+func allowedTarget(cm *ChallengeMessage, targets []string) bool {
+	for _, target := range targets {
+		for _, name := range []string{cm.TargetName, cm.NbComputerName, cm.DNSComputerName} {
+			if name != "" && strings.EqualFold(name, target) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// requestHost returns the name of the host req is meant for, i.e. that of its
+// Host header, which names the virtual host, or else of its URL.
+func requestHost(req *http.Request) string {
+	if req.Host == "" {
+		return req.URL.Hostname()
+	}
+	if host, _, err := net.SplitHostPort(req.Host); err == nil {
+		return host
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(req.Host, "["), "]")
+}
+
+// verifyTargetName checks that the MsvAvTargetName of a challenge, if any,
+// is the HTTP SPN of host.
+func verifyTargetName(cm *ChallengeMessage, host string) error {
+	for _, p := range cm.TargetInfo {
+		if p.ID != MsvAvTargetName {
+			continue
+		}
+		name, err := fromUnicode(p.Value)
+		if err != nil {
+			return &ParseError{ChallengeMessageType, "TargetInfo", err}
+		}
+		if spn := "HTTP/" + host; !strings.EqualFold(name, spn) {
+			return fmt.Errorf("ntlmssp: challenge target name %q doesn't match %q", name, spn)
+		}
+	}
+	return nil
+}
+
+func (l Negotiator) roundTrip(req *http.Request, h *handshake) (res *http.Response, err error) {
+	hdr := l.headers()
+	if l.ProxyCredentials != nil && !l.proxy {
+		// every leg of the handshake authenticates to the proxy first,
+		// if the proxy asks for it
+		h.rt = proxyTransport{l: l.proxyNegotiator(), h: h, rt: h.rt}
 	}
 	// If it is not basic auth, just round trip the request as usual
-	reqauth := authheader(req.Header.Values("Authorization"))
-	if !reqauth.IsBasic() {
-		return rt.RoundTrip(req)
+	reqauth := authheader(req.Header.Values(hdr.authorization))
+	useBasic := reqauth.IsBasic() && !l.IgnoreBasicAuthHeader
+	haveCredentials := useBasic || l.Credentials != nil || l.RealmCredentials != nil || l.NewClient != nil
+	if !haveCredentials && l.Kerberos == nil {
+		return h.roundTrip(req)
+	}
+	reqauthBasic := ""
+	// the authorization sent on the anonymous legs
+	anonymous := ""
+	if useBasic {
+		reqauthBasic = reqauth.Basic()
+	} else {
+		anonymous = req.Header.Get(hdr.authorization)
 	}
-	reqauthBasic := reqauth.Basic()
 	// Save request body
 	body := bytes.Buffer{}
 	if req.Body != nil {
-		_, err = body.ReadFrom(req.Body)
+		r := io.Reader(req.Body)
+		if l.MaxBodySize > 0 {
+			r = io.LimitReader(r, l.MaxBodySize+1)
+		}
+		_, err = body.ReadFrom(r)
+		req.Body.Close()
 		if err != nil {
 			return nil, err
 		}
-
-		req.Body.Close()
-		req.Body = ioutil.NopCloser(bytes.NewReader(body.Bytes()))
+		if l.MaxBodySize > 0 && int64(body.Len()) > l.MaxBodySize {
+			return nil, ErrBodyTooLarge
+		}
+	}
+	// send sends the request with the given Authorization header. If probe
+	// is set, a body-less probe is sent in place of the real request, with
+	// the ProbeMethod if one is configured.
+	send := func(authorization string, probe bool) (*http.Response, error) {
+		if authorization == "" {
+			req.Header.Del(hdr.authorization)
+		} else {
+			req.Header.Set(hdr.authorization, authorization)
+		}
+		if probe {
+			probe := req.Clone(req.Context())
+			if l.ProbeMethod != "" {
+				probe.Method = l.ProbeMethod
+			}
+			l.removeBody(probe)
+			return h.roundTrip(probe)
+		}
+		if req.Body != nil {
+			req.Body = ioutil.NopCloser(bytes.NewReader(body.Bytes()))
+		}
+		return h.roundTrip(req)
 	}
 	// first try anonymous, in case the server still finds us
 	// authenticated from previous traffic
-	req.Header.Del("Authorization")
-	res, err = rt.RoundTrip(req)
+	res, err = send(anonymous, l.ProbeMethod != "")
 	if err != nil {
 		return nil, err
 	}
-	if res.StatusCode != http.StatusUnauthorized {
-		return res, err
+	reauth := res.StatusCode != hdr.status && l.NeedsReauth != nil && l.NeedsReauth(res)
+	if res.StatusCode != hdr.status && !reauth {
+		if l.ProbeMethod == "" {
+			return res, err
+		}
+		// no authentication needed after all, send the real request
+		l.drain(res)
+		return send(anonymous, false)
+	}
+	resauth := authheader(res.Header.Values(hdr.authenticate))
+	if reauth && !resauth.IsNegotiate() && !resauth.IsNTLM() {
+		resauth = authheader{"NTLM"}
 	}
-	resauth := authheader(res.Header.Values("Www-Authenticate"))
 	if !resauth.IsNegotiate() && !resauth.IsNTLM() {
+		if reqauthBasic == "" {
+			// no basic auth to fall back to
+			return res, nil
+		}
 		// Unauthorized, Negotiate not requested, let's try with basic auth
-		req.Header.Set("Authorization", string(reqauthBasic))
-		io.Copy(ioutil.Discard, res.Body)
-		res.Body.Close()
-		req.Body = ioutil.NopCloser(bytes.NewReader(body.Bytes()))
+		h.scheme = "Basic"
+		l.drain(res)
 
-		res, err = rt.RoundTrip(req)
+		res, err = send(reqauthBasic, false)
 		if err != nil {
 			return nil, err
 		}
-		if res.StatusCode != http.StatusUnauthorized {
+		if res.StatusCode != hdr.status {
 			return res, err
 		}
-		resauth = authheader(res.Header.Values("Www-Authenticate"))
+		resauth = authheader(res.Header.Values(hdr.authenticate))
+	}
+
+	if l.Kerberos != nil && resauth.IsNegotiate() {
+		// try Kerberos first, falling back to NTLM if it fails
+		hint, _ := resauth.NegotiateData()
+		if prefersKerberos(hint) {
+			if token, err := kerberosToken(l.Kerberos, requestHost(req)); err == nil {
+				l.drain(res)
+				h.scheme = "Negotiate"
+				res, err = send("Negotiate "+base64.StdEncoding.EncodeToString(token), false)
+				if err != nil {
+					return nil, err
+				}
+				if res.StatusCode != hdr.status {
+					h.kerberos = true
+					if err := h.checkMutualAuth(res, hdr.authenticate, l.Kerberos.VerifyMutual); err != nil {
+						res.Body.Close()
+						return nil, err
+					}
+					return res, nil
+				}
+				resauth = authheader(res.Header.Values(hdr.authenticate))
+			}
+		}
+		if !haveCredentials {
+			// no credentials to fall back to NTLM with
+			return res, nil
+		}
 	}
 
 	if resauth.IsNegotiate() || resauth.IsNTLM() {
 		// 401 with request:Basic and response:Negotiate
-		io.Copy(ioutil.Discard, res.Body)
-		res.Body.Close()
+		l.drain(res)
 
-		// recycle credentials
-		u, p, err := reqauth.GetBasicCreds()
-		if err != nil {
-			return nil, err
+		// unless they depend on the realm of the server, the credentials
+		// are needed right away for the domain in the NEGOTIATE message
+		var cred Credential
+		if l.RealmCredentials == nil && l.NewClient == nil {
+			cred, err = l.credentials(req, reqauth)
+			if err != nil {
+				return nil, err
+			}
+			defer cred.wipe()
 		}
 
-		// get domain from username
-		user, domain := GetDomain(u)
+		c := Client{
+			Domain:     cred.Domain,
+			TargetName: l.TargetName,
+			TargetInfo: l.TargetInfo,
+			SingleHost: l.SingleHost,
+
+			ClientChallenge: l.ClientChallenge,
+
+			NegotiateDomain:      l.NegotiateDomain,
+			NegotiateWorkstation: l.NegotiateWorkstation,
+
+			Identify:     l.Identify,
+			Version:      l.Version,
+			RequireMIC:   l.RequireMIC,
+			ForceOEM:     l.ForceOEM,
+			RefuseNTLMv1: l.RefuseNTLMv1,
+			Now:          l.Now,
+
+			OmitTimestamp:  l.OmitTimestamp,
+			ZeroLMResponse: l.ZeroLMResponse,
+		}
+		var nc NTLMClient = &c
+		if l.NewClient != nil {
+			if nc, err = l.NewClient(req); err != nil {
+				return nil, err
+			}
+			if closer, ok := nc.(io.Closer); ok {
+				defer closer.Close()
+			}
+		}
 
 		// send negotiate
-		negotiateMessage, err := NewNegotiateMessage(domain, "")
+		negotiateMessage, err := nc.Step(nil)
 		if err != nil {
 			return nil, err
 		}
-		if resauth.IsNTLM() {
-			req.Header.Set("Authorization", "NTLM "+base64.StdEncoding.EncodeToString(negotiateMessage))
-		} else {
-			req.Header.Set("Authorization", "Negotiate "+base64.StdEncoding.EncodeToString(negotiateMessage))
+		switch {
+		case l.Scheme != "":
+			h.scheme = l.Scheme
+		case resauth.IsNTLM():
+			h.scheme = "NTLM"
+		default:
+			h.scheme = "Negotiate"
 		}
-
-		req.Body = ioutil.NopCloser(bytes.NewReader(body.Bytes()))
-
-		res, err = rt.RoundTrip(req)
+		if l.NewClient == nil {
+			negotiateMessage = l.rewrite(NegotiateMessageType, negotiateMessage)
+		}
+		token := negotiateMessage
+		if h.scheme == "Negotiate" && !l.RawNegotiate {
+			// offer NTLM as the only SPNEGO mechanism, with the
+			// NEGOTIATE message as its optimistic token
+			if token, err = wrapNegTokenInit([]asn1.ObjectIdentifier{oidNTLM}, negotiateMessage); err != nil {
+				return nil, err
+			}
+		}
+		// the NEGOTIATE message is always answered with a challenge, so
+		// the body is only uploaded along with the AUTHENTICATE message
+		negotiateAuthorization := h.scheme + " " + base64.StdEncoding.EncodeToString(token)
+		res, err = send(negotiateAuthorization, true)
 		if err != nil {
 			return nil, err
 		}
 
-		// receive challenge?
-		resauth = authheader(res.Header.Values("Www-Authenticate"))
+		// receive challenge? Any Location sent along with it is ignored,
+		// redirects are only followed (by the http.Client) once the
+		// handshake is complete
+		resauth = authheader(res.Header.Values(hdr.authenticate))
 		challengeMessage, err := resauth.GetData()
 		if err != nil {
 			return nil, err
 		}
 		if !(resauth.IsNegotiate() || resauth.IsNTLM()) || len(challengeMessage) == 0 {
-			// Negotiation failed, let client deal with response
-			return res, nil
+			if res.StatusCode == hdr.status {
+				// the server rejected the NEGOTIATE message outright
+				l.drain(res)
+				return nil, ErrNoChallenge
+			}
+			// Negotiation failed, let client deal with the response to
+			// the real request, which has to be sent again if the
+			// NEGOTIATE message went without its body or method
+			if body.Len() == 0 && l.ProbeMethod == "" {
+				return res, nil
+			}
+			l.drain(res)
+			return send(negotiateAuthorization, false)
+		}
+		l.drain(res)
+		var wrapped bool
+		if h.scheme == "Negotiate" {
+			challengeMessage, wrapped = unwrapNegotiate(challengeMessage)
 		}
-		io.Copy(ioutil.Discard, res.Body)
-		res.Body.Close()
+		h.challenge = challengeMessage
+
+		var cm *ChallengeMessage
+		if l.RealmCredentials != nil && l.NewClient == nil || l.VerifyTargetName || len(l.AllowedTargets) > 0 {
+			cm, err = parseChallengeMessage(challengeMessage)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if l.VerifyTargetName {
+			if err := verifyTargetName(cm, requestHost(req)); err != nil {
+				return nil, err
+			}
+		}
+		if len(l.AllowedTargets) > 0 && !allowedTarget(cm, l.AllowedTargets) {
+			return nil, ErrTargetNotAllowed
+		}
+		if l.RealmCredentials != nil && l.NewClient == nil {
+			cred, err = l.RealmCredentials(cm.TargetName, req)
+			if err != nil {
+				return nil, err
+			}
+			defer cred.wipe()
+			if err := l.checkCredential(cred); err != nil {
+				return nil, err
+			}
+			c.Domain = cred.Domain
+		}
+		// bind the authentication to the TLS connection the challenge was
+		// received on (Extended Protection for Authentication)
+		if l.NewClient == nil && l.ChannelBinding == nil && res.TLS != nil && len(res.TLS.PeerCertificates) > 0 {
+			c.ChannelBindings = TLSServerEndPoint(res.TLS.PeerCertificates[0])
+			h.certHash = certificateHash(res.TLS.PeerCertificates[0])
+		}
+		c.channelBindingHash = l.ChannelBinding
+		hash := cred.ntlmHash()
+		defer clear(hash)
+		c.User, c.Hash = cred.User, hash
 
 		// send authenticate
-		authenticateMessage, err := ProcessChallenge(challengeMessage, domain, user, p)
+		authenticateMessage, err := nc.Step(challengeMessage)
+		cred.wipe()
+		clear(hash)
 		if err != nil {
 			return nil, err
 		}
-		if resauth.IsNTLM() {
-			req.Header.Set("Authorization", "NTLM "+base64.StdEncoding.EncodeToString(authenticateMessage))
-		} else {
-			req.Header.Set("Authorization", "Negotiate "+base64.StdEncoding.EncodeToString(authenticateMessage))
+		h.authenticate = true
+		if l.NewClient == nil {
+			h.domain, h.user, h.session = c.Domain, c.User, c.Session()
+			if c.TargetName != "" {
+				h.domain = c.TargetName
+			}
+			h.channelBound = c.ChannelBindings != nil || c.channelBindingHash != nil
+			authenticateMessage = l.rewrite(AuthenticateMessageType, authenticateMessage)
+		} else if am, err := parseAuthenticateMessage(authenticateMessage); err == nil {
+			h.domain, h.user = am.Domain, am.User
 		}
-
-		req.Body = ioutil.NopCloser(bytes.NewReader(body.Bytes()))
-
-		return rt.RoundTrip(req)
+		if l.Transcript != nil {
+			l.Transcript(newTranscript(negotiateMessage, challengeMessage, authenticateMessage, h.session))
+		}
+		if wrapped {
+			if authenticateMessage, err = wrapNegTokenResp(authenticateMessage); err != nil {
+				return nil, err
+			}
+		}
+		challengeConn := h.conn
+		res, err = send(h.scheme+" "+base64.StdEncoding.EncodeToString(authenticateMessage), false)
+		if err != nil {
+			return nil, err
+		}
+		if l.VerifyConnection && h.conn != challengeConn {
+			res.Body.Close()
+			return nil, ErrConnectionChanged
+		}
+		if h.scheme != "Negotiate" {
+			return res, nil
+		}
+		if err := h.checkMutualAuth(res, hdr.authenticate, nil); err != nil {
+			res.Body.Close()
+			return nil, err
+		}
+		return res, nil
 	}
 
 	return res, err
@@ -6,15 +6,30 @@ import (
 	"encoding/base64"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/http/httptrace"
+	"reflect"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
+// exampleChallenge is the example type 2 message from
+// <https://davenport.sourceforge.net/ntlm.html#type2MessageExample>.
+const exampleChallenge = "4e544c4d53535000020000000c000c0030000000010281000123456789abcdef0000000000000000620062003c00000044004f004d00410049004e0002000c0044004f004d00410049004e0001000c005300450052005600450052000400140064006f006d00610069006e002e0063006f006d00030022007300650072007600650072002e0064006f006d00610069006e002e0063006f006d0000000000"
+
 func handler(w http.ResponseWriter, req *http.Request) {
+	serveChallenge(w, req, exampleChallenge)
+}
+
+// serveChallenge is handler with a different CHALLENGE message, in hex.
+func serveChallenge(w http.ResponseWriter, req *http.Request, challengeHex string) {
 	w.Header().Set("WWW-Authenticate", "NTLM")
 	scheme, authz, ok := strings.Cut(req.Header.Get("Authorization"), " ")
 	if !ok {
@@ -32,6 +47,9 @@ func handler(w http.ResponseWriter, req *http.Request) {
 		fmt.Fprintf(w, "access denied: %v\n", err)
 		return
 	}
+	if scheme == "Negotiate" {
+		data, _ = unwrapNegotiate(data)
+	}
 	r := bytes.NewReader(data)
 	var h messageHeader
 	if err := binary.Read(r, binary.LittleEndian, &h); err != nil {
@@ -46,9 +64,8 @@ func handler(w http.ResponseWriter, req *http.Request) {
 	}
 	switch h.MessageType {
 	case 1:
-		// Got NTLM type 1 message; respond with example challenge from
-		// <https://davenport.sourceforge.net/ntlm.html#type2MessageExample>.
-		challenge, err := hex.DecodeString("4e544c4d53535000020000000c000c0030000000010281000123456789abcdef0000000000000000620062003c00000044004f004d00410049004e0002000c0044004f004d00410049004e0001000c005300450052005600450052000400140064006f006d00610069006e002e0063006f006d00030022007300650072007600650072002e0064006f006d00610069006e002e0063006f006d0000000000")
+		// Got NTLM type 1 message; respond with example challenge.
+		challenge, err := hex.DecodeString(challengeHex)
 		if err != nil {
 			panic(err)
 		}
@@ -89,6 +106,40 @@ func unmarshal(data []byte) (string, string, error) {
 	return target, user, nil
 }
 
+// recorder wraps h, recording every NTLM message received from the client.
+// Messages sent under Negotiate are recorded without their SPNEGO wrapping.
+func recorder(h http.HandlerFunc, msgs *[][]byte) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if scheme, authz, ok := strings.Cut(req.Header.Get("Authorization"), " "); ok {
+			if data, err := base64.StdEncoding.DecodeString(authz); err == nil {
+				if scheme == "Negotiate" {
+					data, _ = unwrapNegotiate(data)
+				}
+				*msgs = append(*msgs, data)
+			}
+		}
+		h(w, req)
+	}
+}
+
+// ntlmV2ResponseAVPairs extracts the AV pairs from the NTLMv2 response of an
+// AUTHENTICATE message.
+func ntlmV2ResponseAVPairs(t *testing.T, data []byte) []AVPair {
+	_, m, err := ParseMessage(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	am, ok := m.(*AuthenticateMessage)
+	if !ok {
+		t.Fatalf("expected an authenticate message, got %T", m)
+	}
+	v2, err := am.NTLMv2()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v2.TargetInfo
+}
+
 func TestNegotiator(t *testing.T) {
 	server := httptest.NewServer(http.HandlerFunc(handler))
 	defer server.Close()
@@ -129,3 +180,1525 @@ func TestCurl(t *testing.T) {
 		t.Fatalf("want %q, got %q", want, got)
 	}
 }
+
+func TestNegotiatorTargetInfo(t *testing.T) {
+	var msgs [][]byte
+	server := httptest.NewServer(recorder(handler, &msgs))
+	defer server.Close()
+	targetInfo := []AVPair{
+		{ID: MsvAvNbDomainName, Value: toUnicode("OTHER")},
+		{ID: MsvAvTargetName, Value: toUnicode("HTTP/example.com")},
+	}
+	negotiator := Negotiator{TargetInfo: targetInfo}
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("isis\\malory", "guest")
+	resp, err := negotiator.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %v", resp.Status)
+	}
+	if len(msgs) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(msgs))
+	}
+	got := ntlmV2ResponseAVPairs(t, msgs[1])
+	if !reflect.DeepEqual(got, targetInfo) {
+		t.Fatalf("want %+v, got %+v", targetInfo, got)
+	}
+}
+
+func TestNegotiatorMetrics(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+	var metrics []HandshakeMetrics
+	negotiator := Negotiator{Metrics: func(m HandshakeMetrics) {
+		metrics = append(metrics, m)
+	}}
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("isis\\malory", "guest")
+	resp, err := negotiator.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if len(metrics) != 1 {
+		t.Fatalf("expected metrics to be reported once, got %d", len(metrics))
+	}
+	m := metrics[0]
+	if m.RoundTrips != 3 || m.Scheme != "NTLM" || m.StatusCode != http.StatusOK || m.Err != nil || m.Duration <= 0 {
+		t.Fatalf("unexpected metrics: %+v", m)
+	}
+}
+
+func TestNegotiatorProbeMethod(t *testing.T) {
+	type request struct {
+		method, path, route, body string
+	}
+	for _, method := range []string{http.MethodOptions, http.MethodHead} {
+		var requests []request
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			body, _ := io.ReadAll(req.Body)
+			requests = append(requests, request{req.Method, req.URL.Path, req.Header.Get("X-Route"), string(body)})
+			handler(w, req)
+		}))
+		negotiator := Negotiator{ProbeMethod: method}
+		req, err := http.NewRequest(http.MethodPost, server.URL+"/orders", strings.NewReader("side effect"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Route", "blue")
+		req.SetBasicAuth("isis\\malory", "guest")
+		resp, err := negotiator.RoundTrip(req)
+		server.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: unexpected status %v", method, resp.Status)
+		}
+		want := []request{
+			{method, "/orders", "blue", ""},
+			{method, "/orders", "blue", ""},
+			{http.MethodPost, "/orders", "blue", "side effect"},
+		}
+		if !reflect.DeepEqual(requests, want) {
+			t.Fatalf("%s: want %+v, got %+v", method, want, requests)
+		}
+	}
+}
+
+func TestNegotiatorHandshakeTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if strings.HasPrefix(req.Header.Get("Authorization"), "NTLM ") {
+			select {
+			case <-req.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+		}
+		handler(w, req)
+	}))
+	defer server.Close()
+	negotiator := Negotiator{HandshakeTimeout: 100 * time.Millisecond}
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("isis\\malory", "guest")
+	start := time.Now()
+	resp, err := negotiator.RoundTrip(req)
+	if err == nil {
+		resp.Body.Close()
+	}
+	if !errors.Is(err, ErrHandshakeTimeout) {
+		t.Fatalf("expected ErrHandshakeTimeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("handshake took %v despite the timeout", elapsed)
+	}
+}
+
+func TestNegotiatorHandshakeTimeoutNotExpired(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+	negotiator := Negotiator{HandshakeTimeout: 5 * time.Second}
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("isis\\malory", "guest")
+	resp, err := negotiator.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "access granted to isis\\malory\n"; string(body) != want {
+		t.Fatalf("want %q, got %q", want, body)
+	}
+}
+
+func TestNegotiatorCredentialsWiped(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+	password := []byte("guest")
+	negotiator := Negotiator{Credentials: func(*http.Request) (Credential, error) {
+		return Credential{Domain: "isis", User: "malory", Password: password}, nil
+	}}
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := negotiator.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "access granted to isis\\malory\n"; string(body) != want {
+		t.Fatalf("want %q, got %q", want, body)
+	}
+	if !bytes.Equal(password, make([]byte, len(password))) {
+		t.Fatalf("expected password to be wiped, got %q", password)
+	}
+}
+
+func TestNegotiatorRewrite(t *testing.T) {
+	var msgs [][]byte
+	server := httptest.NewServer(recorder(handler, &msgs))
+	defer server.Close()
+	var rewritten []MessageType
+	negotiator := Negotiator{Rewrite: func(messageType MessageType, msg []byte) []byte {
+		rewritten = append(rewritten, messageType)
+		if messageType != NegotiateMessageType {
+			return nil
+		}
+		m := append([]byte{}, msg...)
+		flags := negotiateFlags(binary.LittleEndian.Uint32(m[12:]))
+		flags.Unset(negotiateFlagNTLMSSPNEGOTIATE56)
+		binary.LittleEndian.PutUint32(m[12:], uint32(flags))
+		return m
+	}}
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("isis\\malory", "guest")
+	resp, err := negotiator.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if want := []MessageType{NegotiateMessageType, AuthenticateMessageType}; !reflect.DeepEqual(rewritten, want) {
+		t.Fatalf("want %v, got %v", want, rewritten)
+	}
+	if len(msgs) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(msgs))
+	}
+	if flags := negotiateFlags(binary.LittleEndian.Uint32(msgs[0][12:])); flags.Has(negotiateFlagNTLMSSPNEGOTIATE56) {
+		t.Fatalf("expected NTLMSSP_NEGOTIATE_56 to be cleared, got flags %08x", uint32(flags))
+	}
+	if _, _, err := unmarshal(msgs[1]); err != nil {
+		t.Fatalf("expected the authenticate message to be sent unchanged: %v", err)
+	}
+}
+
+// recordingClient is an NTLMClient that records the messages of client.
+type recordingClient struct {
+	client NTLMClient
+	msgs   [][]byte
+	closed bool
+}
+
+func (c *recordingClient) Step(in []byte) ([]byte, error) {
+	out, err := c.client.Step(in)
+	c.msgs = append(c.msgs, out)
+	return out, err
+}
+
+func (c *recordingClient) Close() error {
+	c.closed = true
+	if closer, ok := c.client.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func TestNegotiatorNewClient(t *testing.T) {
+	var msgs [][]byte
+	server := httptest.NewServer(recorder(handler, &msgs))
+	defer server.Close()
+	// a version and flags of its own
+	client := &recordingClient{client: &Client{
+		Domain: "isis", User: "malory", Password: "guest",
+		Version: &Version{ProductMajorVersion: 5, ProductMinorVersion: 2, ProductBuild: 3790, NTLMRevisionCurrent: 15},
+	}}
+	negotiator := Negotiator{
+		NewClient: func(*http.Request) (NTLMClient, error) { return client, nil },
+		// neither applies to the client's messages
+		Version: &Version{ProductMajorVersion: 10},
+		Rewrite: func(MessageType, []byte) []byte { return []byte("rewritten") },
+	}
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := negotiator.Authenticate(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Response.Body.Close()
+	if r.Response.StatusCode != http.StatusOK || r.Domain != "isis" || r.Username != "malory" {
+		t.Fatalf("unexpected result: status %d, user %s\\%s", r.Response.StatusCode, r.Domain, r.Username)
+	}
+	if !reflect.DeepEqual(msgs, client.msgs) {
+		t.Fatalf("expected the client's messages to be sent unchanged, sent %x, got %x", client.msgs, msgs)
+	}
+	if !client.closed {
+		t.Fatal("expected the client to be closed")
+	}
+}
+
+func TestNegotiatorPreservesHostAndHeaders(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Host != "intranet.example.com" || req.UserAgent() != "test-agent/1.0" || req.Header.Get("X-Route") != "blue" {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "unknown virtual host %q (user agent %q)\n", req.Host, req.UserAgent())
+			return
+		}
+		handler(w, req)
+	}))
+	defer server.Close()
+	for _, negotiator := range []Negotiator{{}, {ProbeMethod: http.MethodHead}} {
+		req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = "intranet.example.com"
+		req.Header.Set("User-Agent", "test-agent/1.0")
+		req.Header.Set("X-Route", "blue")
+		req.SetBasicAuth("isis\\malory", "guest")
+		resp, err := negotiator.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "access granted to isis\\malory\n"; string(body) != want {
+			t.Fatalf("probe method %q: want %q, got %q", negotiator.ProbeMethod, want, body)
+		}
+	}
+}
+
+func TestNegotiatorAnonymous(t *testing.T) {
+	var msgs [][]byte
+	server := httptest.NewServer(recorder(handler, &msgs))
+	defer server.Close()
+	negotiator := Negotiator{Anonymous: true, Credentials: func(*http.Request) (Credential, error) {
+		return Credential{}, nil
+	}}
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := negotiator.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "access granted to \\\n"; string(body) != want {
+		t.Fatalf("want %q, got %q", want, body)
+	}
+	if len(msgs) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(msgs))
+	}
+	_, m, err := ParseMessage(msgs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	am := m.(*AuthenticateMessage)
+	if !negotiateFlags(am.NegotiateFlags).Has(negotiateFlagANONYMOUS) {
+		t.Errorf("expected the anonymous flag to be set, got flags %08x", am.NegotiateFlags)
+	}
+	if len(am.NtChallengeResponse) != 0 || !bytes.Equal(am.LmChallengeResponse, []byte{0}) {
+		t.Errorf("expected empty responses, got LM %x and NT %x", am.LmChallengeResponse, am.NtChallengeResponse)
+	}
+	if len(am.EncryptedRandomSessionKey) != 0 {
+		t.Errorf("expected no session key, got %x", am.EncryptedRandomSessionKey)
+	}
+}
+
+func TestNegotiatorChallengeWithRedirect(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/start", func(w http.ResponseWriter, req *http.Request) {
+		// a gateway that adds a Location to every response, including the
+		// challenge, and redirects once authenticated
+		w.Header().Set("Location", "/done")
+		if strings.HasPrefix(req.Header.Get("Authorization"), "NTLM ") {
+			data, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(req.Header.Get("Authorization"), "NTLM "))
+			if len(data) > 8 && MessageType(data[8]) == AuthenticateMessageType {
+				w.WriteHeader(http.StatusFound)
+				return
+			}
+		}
+		handler(w, req)
+	})
+	mux.HandleFunc("/done", handler)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	var metrics []HandshakeMetrics
+	client := &http.Client{Transport: Negotiator{Metrics: func(m HandshakeMetrics) {
+		metrics = append(metrics, m)
+	}}}
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/start", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("isis\\malory", "guest")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "access granted to isis\\malory\n"; string(body) != want {
+		t.Fatalf("want %q, got %q", want, body)
+	}
+	if resp.Request.URL.Path != "/done" {
+		t.Fatalf("expected the final redirect to be followed, ended up at %s", resp.Request.URL)
+	}
+	// one complete handshake for each of /start and /done
+	if len(metrics) != 2 || metrics[0].RoundTrips != 3 || metrics[0].StatusCode != http.StatusFound {
+		t.Fatalf("unexpected handshakes: %+v", metrics)
+	}
+}
+
+func TestNegotiatorSingleHost(t *testing.T) {
+	var msgs [][]byte
+	server := httptest.NewServer(recorder(handler, &msgs))
+	defer server.Close()
+	singleHost := &SingleHostData{CustomData: [8]byte{1, 2, 3, 4, 5, 6, 7, 8}}
+	for i := range singleHost.MachineID {
+		singleHost.MachineID[i] = byte(i)
+	}
+	negotiator := Negotiator{SingleHost: singleHost}
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("isis\\malory", "guest")
+	resp, err := negotiator.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	pairs := ntlmV2ResponseAVPairs(t, msgs[1])
+	var cm challengeMessage
+	if err := cm.UnmarshalBinary(unhex(t, exampleChallenge)); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(pairs[:len(pairs)-1], cm.AVPairs) {
+		t.Fatalf("expected the server's AV pairs to be echoed, got %+v", pairs)
+	}
+	p := pairs[len(pairs)-1]
+	if p.ID != MsvAvSingleHost || len(p.Value) != 48 {
+		t.Fatalf("unexpected AV pair %+v", p)
+	}
+	if size := binary.LittleEndian.Uint32(p.Value[0:]); size != 48 {
+		t.Errorf("expected size 48, got %d", size)
+	}
+	if z4 := binary.LittleEndian.Uint32(p.Value[4:]); z4 != 0 {
+		t.Errorf("expected Z4 to be zero, got %d", z4)
+	}
+	if !bytes.Equal(p.Value[8:16], singleHost.CustomData[:]) {
+		t.Errorf("expected custom data %x, got %x", singleHost.CustomData, p.Value[8:16])
+	}
+	if !bytes.Equal(p.Value[16:], singleHost.MachineID[:]) {
+		t.Errorf("expected machine ID %x, got %x", singleHost.MachineID, p.Value[16:])
+	}
+}
+
+func TestNegotiatorRealmCredentials(t *testing.T) {
+	flags := negotiateFlagNTLMSSPNEGOTIATEUNICODE | negotiateFlagNTLMSSPNEGOTIATENTLM | negotiateFlagNTLMSSPTARGETTYPEDOMAIN
+	realmServer := func(realm string) *httptest.Server {
+		challenge := hex.EncodeToString(newChallenge(flags, challenge, realm, []AVPair{
+			{ID: MsvAvNbDomainName, Value: toUnicode(realm)},
+		}))
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			serveChallenge(w, req, challenge)
+		}))
+	}
+	serverA, serverB := realmServer("EAST"), realmServer("WEST")
+	defer serverA.Close()
+	defer serverB.Close()
+	users := map[string]string{"EAST": "alice", "WEST": "bob"}
+	negotiator := Negotiator{RealmCredentials: func(realm string, req *http.Request) (Credential, error) {
+		user, ok := users[realm]
+		if !ok {
+			return Credential{}, fmt.Errorf("unknown realm %q", realm)
+		}
+		return Credential{Domain: realm, User: user, Password: []byte("secret")}, nil
+	}}
+	for _, table := range []struct {
+		url  string
+		want string
+	}{
+		{serverA.URL, "access granted to EAST\\alice\n"},
+		{serverB.URL, "access granted to WEST\\bob\n"},
+	} {
+		req, err := http.NewRequest(http.MethodGet, table.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := negotiator.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != table.want {
+			t.Fatalf("want %q, got %q", table.want, body)
+		}
+	}
+}
+
+func TestNegotiatorAuthenticate(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(handler))
+	defer server.Close()
+	negotiator := Negotiator{RoundTripper: server.Client().Transport}
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("isis\\malory", "guest")
+	r, err := negotiator.Authenticate(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Response.Body.Close()
+	if r.Response.StatusCode != http.StatusOK {
+		t.Errorf("expected status %d, got %d", http.StatusOK, r.Response.StatusCode)
+	}
+	if r.Domain != "isis" || r.Username != "malory" {
+		t.Errorf("expected isis\\malory, got %s\\%s", r.Domain, r.Username)
+	}
+	if len(r.SessionKey) != 16 {
+		t.Errorf("expected a 16 byte session key, got %x", r.SessionKey)
+	}
+	if r.NegotiatedFlags != 0x00810201 {
+		t.Errorf("expected the flags of the example challenge, got %08x", r.NegotiatedFlags)
+	}
+	if r.Scheme != "NTLM" || r.RoundTrips != 3 || !r.ChannelBound {
+		t.Errorf("unexpected result: %+v", r)
+	}
+}
+
+func TestNegotiatorVerifyTargetName(t *testing.T) {
+	flags := negotiateFlagNTLMSSPNEGOTIATEUNICODE |
+		negotiateFlagNTLMSSPNEGOTIATENTLM |
+		negotiateFlagNTLMSSPNEGOTIATETARGETINFO
+	for _, tc := range []struct {
+		targetName string
+		host       string
+		ok         bool
+	}{
+		{"HTTP/127.0.0.1", "", true},
+		{"http/127.0.0.1", "", true},
+		{"HTTP/relay.example.com", "", false},
+		// the Host header names the virtual host
+		{"HTTP/intranet.example", "intranet.example:8080", true},
+		{"HTTP/127.0.0.1", "intranet.example", false},
+	} {
+		challenge := newChallenge(flags, []byte("8bytes!!"), "DOMAIN", []AVPair{
+			{ID: MsvAvNbDomainName, Value: toUnicode("DOMAIN")},
+			{ID: MsvAvTargetName, Value: toUnicode(tc.targetName)},
+		})
+		var msgs [][]byte
+		server := httptest.NewServer(recorder(func(w http.ResponseWriter, req *http.Request) {
+			serveChallenge(w, req, hex.EncodeToString(challenge))
+		}, &msgs))
+		negotiator := Negotiator{VerifyTargetName: true}
+		req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.host != "" {
+			req.Host = tc.host
+		}
+		req.SetBasicAuth("isis\\malory", "guest")
+		resp, err := negotiator.RoundTrip(req)
+		server.Close()
+		if tc.ok {
+			if err != nil {
+				t.Errorf("%s: %v", tc.targetName, err)
+				continue
+			}
+			resp.Body.Close()
+		} else if err == nil {
+			resp.Body.Close()
+			t.Errorf("%s: expected the handshake to be aborted", tc.targetName)
+		}
+		if tc.ok != (len(msgs) == 2) {
+			t.Errorf("%s: unexpected number of NTLM messages sent: %d", tc.targetName, len(msgs))
+		}
+	}
+}
+
+func TestNegotiatorNoChallenge(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// always ask for NTLM, but never send a challenge
+		w.Header().Set("WWW-Authenticate", "NTLM")
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("isis\\malory", "guest")
+	if _, err := (Negotiator{}).RoundTrip(req); !errors.Is(err, ErrNoChallenge) {
+		t.Fatalf("expected ErrNoChallenge, got %v", err)
+	}
+}
+
+func TestNegotiatorScheme(t *testing.T) {
+	for _, tc := range []struct {
+		offered, override, expected string
+	}{
+		{"NTLM", "", "NTLM"},
+		{"Negotiate", "", "Negotiate"},
+		{"NTLM", "Negotiate", "Negotiate"},
+	} {
+		var schemes []string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			scheme, _, ok := strings.Cut(req.Header.Get("Authorization"), " ")
+			if !ok {
+				w.Header().Set("WWW-Authenticate", tc.offered)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			schemes = append(schemes, scheme)
+			handler(w, req)
+		}))
+		negotiator := Negotiator{Scheme: tc.override}
+		req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth("isis\\malory", "guest")
+		resp, err := negotiator.RoundTrip(req)
+		server.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if expected := []string{tc.expected, tc.expected}; !reflect.DeepEqual(schemes, expected) {
+			t.Errorf("offered %q, override %q: expected schemes %q, got %q", tc.offered, tc.override, expected, schemes)
+		}
+	}
+}
+
+// connAuthHandler is handler for a server that, like IIS, treats connections
+// as authenticated once a handshake completed on them. It counts the
+// handshakes started. If expireAfter is positive, a connection is challenged
+// again after that many requests following its handshake, like gateways that
+// expire authentication.
+func connAuthHandler(handshakes *int, expireAfter int) http.HandlerFunc {
+	var mu sync.Mutex
+	authenticated := map[string]string{}
+	requests := map[string]int{}
+	return func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if user, ok := authenticated[req.RemoteAddr]; ok {
+			requests[req.RemoteAddr]++
+			if expireAfter <= 0 || requests[req.RemoteAddr] <= expireAfter {
+				fmt.Fprintf(w, "access granted to %s\n", user)
+				return
+			}
+			delete(authenticated, req.RemoteAddr)
+		}
+		var msgs [][]byte
+		recorder(handler, &msgs)(w, req)
+		if len(msgs) > 0 {
+			switch msgs[0][8] {
+			case 1:
+				*handshakes++
+			case 3:
+				domain, user, _ := unmarshal(msgs[0])
+				authenticated[req.RemoteAddr] = domain + "\\" + user
+				requests[req.RemoteAddr] = 0
+			}
+		}
+	}
+}
+
+func TestNegotiatorPinAuthenticatedConnection(t *testing.T) {
+	handshakes := 0
+	server := httptest.NewServer(connAuthHandler(&handshakes, 0))
+	defer server.Close()
+	negotiator := Negotiator{
+		RoundTripper:               server.Client().Transport,
+		PinAuthenticatedConnection: true,
+	}
+	for i := 0; i < 5; i++ {
+		req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth("isis\\malory", "guest")
+		resp, err := negotiator.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status %d, got %d", http.StatusOK, resp.StatusCode)
+		}
+	}
+	if handshakes != 1 {
+		t.Fatalf("expected a single handshake, got %d", handshakes)
+	}
+}
+
+func TestNegotiatorPinAuthenticatedConnectionConcurrent(t *testing.T) {
+	handshakes := 0
+	server := httptest.NewServer(connAuthHandler(&handshakes, 0))
+	defer server.Close()
+	negotiator := Negotiator{
+		RoundTripper:               server.Client().Transport,
+		PinAuthenticatedConnection: true,
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+		go func(user string) {
+			defer wg.Done()
+			req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			req.SetBasicAuth("isis\\"+user, "guest")
+			resp, err := negotiator.RoundTrip(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if expected := "access granted to isis\\" + user + "\n"; string(body) != expected {
+				t.Errorf("expected %q, got %q", expected, body)
+			}
+		}(fmt.Sprintf("user%d", i%10))
+	}
+	wg.Wait()
+}
+
+func TestNegotiatorPinAuthenticatedConnectionCredentials(t *testing.T) {
+	handshakes := 0
+	server := httptest.NewServer(connAuthHandler(&handshakes, 0))
+	defer server.Close()
+	negotiator := Negotiator{
+		RoundTripper:               server.Client().Transport,
+		PinAuthenticatedConnection: true,
+		Credentials: func(req *http.Request) (Credential, error) {
+			return Credential{Domain: "isis", User: req.Header.Get("X-User"), Password: []byte("guest")}, nil
+		},
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// every user follows up on a connection of the other
+			for j := 0; j < 10; j++ {
+				user := []string{"malory", "archer"}[j%2]
+				req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				req.Header.Set("X-User", user)
+				resp, err := negotiator.RoundTrip(req)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				body, err := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if expected := "access granted to isis\\" + user + "\n"; string(body) != expected {
+					t.Errorf("expected %q, got %q", expected, body)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestNegotiatorPinAuthenticatedConnectionIdle(t *testing.T) {
+	handshakes := 0
+	closed := make(chan struct{}, 3)
+	server := httptest.NewUnstartedServer(connAuthHandler(&handshakes, 0))
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			closed <- struct{}{}
+		}
+	}
+	server.Start()
+	defer server.Close()
+	transport := server.Client().Transport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = 1
+	negotiator := Negotiator{
+		RoundTripper:               transport,
+		PinAuthenticatedConnection: true,
+	}
+	waitClosed := func(n int) {
+		for i := 0; i < n; i++ {
+			select {
+			case <-closed:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("expected %d more connections to be closed", n-i)
+			}
+		}
+	}
+	// requests in flight at the same time get a connection each
+	var bodies []io.ReadCloser
+	for i := 0; i < 3; i++ {
+		req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth("isis\\malory", "guest")
+		resp, err := negotiator.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bodies = append(bodies, resp.Body)
+	}
+	for _, body := range bodies {
+		io.Copy(io.Discard, body)
+		body.Close()
+	}
+	// only one of them is kept
+	waitClosed(2)
+	negotiator.CloseIdleConnections()
+	waitClosed(1)
+	if handshakes != 3 {
+		t.Fatalf("expected 3 handshakes, got %d", handshakes)
+	}
+}
+
+func TestNegotiatorPinAuthenticatedConnectionEviction(t *testing.T) {
+	handshakes := 0
+	closed := make(chan struct{}, 4)
+	server := httptest.NewUnstartedServer(connAuthHandler(&handshakes, 0))
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			closed <- struct{}{}
+		}
+	}
+	server.Start()
+	defer server.Close()
+	transport := server.Client().Transport.(*http.Transport).Clone()
+	transport.MaxIdleConns = 2
+	negotiator := Negotiator{
+		RoundTripper:               transport,
+		PinAuthenticatedConnection: true,
+	}
+	for _, user := range []string{"malory", "archer", "lana", "malory"} {
+		req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth("isis\\"+user, "guest")
+		resp, err := negotiator.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	// the connection kept the longest made room for lana's
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the oldest connection to be closed")
+	}
+	if handshakes != 4 {
+		t.Fatalf("expected 4 handshakes, got %d", handshakes)
+	}
+	negotiator.CloseIdleConnections()
+}
+
+func TestNegotiatorPinAuthenticatedConnectionIdleTimeout(t *testing.T) {
+	handshakes := 0
+	server := httptest.NewServer(connAuthHandler(&handshakes, 0))
+	defer server.Close()
+	transport := server.Client().Transport.(*http.Transport).Clone()
+	transport.IdleConnTimeout = 10 * time.Millisecond
+	negotiator := Negotiator{
+		RoundTripper:               transport,
+		PinAuthenticatedConnection: true,
+	}
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("isis\\malory", "guest")
+	resp, err := negotiator.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	// the pinned transports are forgotten once none is kept any longer
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := pinnedTransports.Load(transport); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the idle transport to expire")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNegotiatorIgnoreBasicAuthHeader(t *testing.T) {
+	var authorizations []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		authorizations = append(authorizations, req.Header.Get("Authorization"))
+		w.Header().Set("WWW-Authenticate", "NTLM")
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+	negotiator := Negotiator{IgnoreBasicAuthHeader: true}
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("downstream", "secret")
+	basic := req.Header.Get("Authorization")
+	resp, err := negotiator.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected the server's response to be returned, got status %d", resp.StatusCode)
+	}
+	if expected := []string{basic}; !reflect.DeepEqual(authorizations, expected) {
+		t.Fatalf("expected authorizations %q, got %q", expected, authorizations)
+	}
+}
+
+func TestNegotiatorNow(t *testing.T) {
+	var msgs [][]byte
+	server := httptest.NewServer(recorder(handler, &msgs))
+	defer server.Close()
+	now := time.Date(2024, 2, 29, 12, 0, 0, 0, time.UTC)
+	negotiator := Negotiator{Now: func() time.Time { return now }}
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("isis\\malory", "guest")
+	resp, err := negotiator.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	_, m, err := ParseMessage(msgs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the timestamp follows the NTProofStr and the blob signature and
+	// reserved fields of the NTLMv2 response
+	nt := m.(*AuthenticateMessage).NtChallengeResponse
+	if expected := unhex(t, "00e01dd2066bda01"); !bytes.Equal(nt[24:32], expected) {
+		t.Fatalf("expected timestamp %x, got %x", expected, nt[24:32])
+	}
+}
+
+func TestNegotiatorRejected(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		reject func(w http.ResponseWriter)
+		reason RejectReason
+	}{
+		{"wrong password", func(w http.ResponseWriter) {
+			w.Header().Set("WWW-Authenticate", "NTLM")
+			w.WriteHeader(http.StatusUnauthorized)
+		}, RejectCredentials},
+		{"basic only", func(w http.ResponseWriter) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="intranet"`)
+			w.WriteHeader(http.StatusUnauthorized)
+		}, RejectPolicy},
+		{"forbidden", func(w http.ResponseWriter) {
+			w.WriteHeader(http.StatusForbidden)
+		}, RejectPolicy},
+	} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			var msgs [][]byte
+			recorder(func(http.ResponseWriter, *http.Request) {}, &msgs)(w, req)
+			if len(msgs) > 0 && msgs[0][8] == 3 {
+				tc.reject(w)
+				return
+			}
+			handler(w, req)
+		}))
+		req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth("isis\\malory", "wrong")
+		_, err = Negotiator{}.Authenticate(req)
+		var rejected *RejectedError
+		if !errors.As(err, &rejected) {
+			t.Errorf("%s: expected a RejectedError, got %v", tc.name, err)
+		} else {
+			rejected.Response.Body.Close()
+			if rejected.Reason != tc.reason {
+				t.Errorf("%s: expected reason %v, got %v", tc.name, tc.reason, rejected.Reason)
+			}
+		}
+
+		// RoundTrip returns the rejection as is
+		req.SetBasicAuth("isis\\malory", "wrong")
+		resp, err := Negotiator{}.RoundTrip(req)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+		} else {
+			resp.Body.Close()
+		}
+		server.Close()
+	}
+}
+
+// countingTransport counts the bytes read from response bodies.
+type countingTransport struct {
+	http.RoundTripper
+	n *int64
+}
+
+func (t countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.RoundTripper.RoundTrip(req)
+	if err == nil {
+		res.Body = countingBody{res.Body, t.n}
+	}
+	return res, err
+}
+
+type countingBody struct {
+	io.ReadCloser
+	n *int64
+}
+
+func (b countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	*b.n += int64(n)
+	return n, err
+}
+
+func TestNegotiatorMaxDrain(t *testing.T) {
+	errorPage := strings.Repeat("x", 1<<20)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") == "" {
+			w.Header().Set("WWW-Authenticate", "NTLM")
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, errorPage)
+			return
+		}
+		handler(w, req)
+	}))
+	defer server.Close()
+	for _, tc := range []struct {
+		maxDrain, expected int64
+	}{
+		{0, 64 << 10},
+		{1024, 1024},
+		{-1, 1 << 20},
+	} {
+		var n int64
+		negotiator := Negotiator{
+			RoundTripper: countingTransport{http.DefaultTransport, &n},
+			MaxDrain:     tc.maxDrain,
+		}
+		req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth("isis\\malory", "guest")
+		resp, err := negotiator.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		// besides the error page, only the short "challenge sent" body
+		// is drained
+		if challengeBody := int64(len("challenge sent\n")); n != tc.expected+challengeBody {
+			t.Errorf("MaxDrain %d: expected %d bytes to be read, got %d", tc.maxDrain, tc.expected+challengeBody, n)
+		}
+	}
+}
+
+func TestNegotiatorStaticCredentials(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+	negotiator := Negotiator{Credentials: StaticCredentials("isis", "malory\\jr@example", []byte("guest"))}
+	// the password must survive being wiped after the first request
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := negotiator.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := "access granted to isis\\malory\\jr@example\n"; string(body) != expected {
+			t.Fatalf("expected %q, got %q", expected, body)
+		}
+	}
+}
+
+func TestNegotiatorProbeLength(t *testing.T) {
+	type probe struct {
+		contentLength    string
+		transferEncoding []string
+	}
+	for _, tc := range []struct {
+		length ProbeLength
+		want   probe
+	}{
+		{ProbeContentLengthZero, probe{"0", nil}},
+		{ProbeOmitContentLength, probe{"", nil}},
+		{ProbeChunked, probe{"", []string{"chunked"}}},
+	} {
+		var probes []probe
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			body, _ := io.ReadAll(req.Body)
+			if string(body) != "side effect" {
+				probes = append(probes, probe{req.Header.Get("Content-Length"), req.TransferEncoding})
+			}
+			handler(w, req)
+		}))
+		negotiator := Negotiator{ProbeMethod: http.MethodPost, ProbeLength: tc.length}
+		req, err := http.NewRequest(http.MethodPost, server.URL, strings.NewReader("side effect"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth("isis\\malory", "guest")
+		resp, err := negotiator.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		server.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("probe length %d: unexpected status %v", tc.length, resp.Status)
+		}
+		if want := []probe{tc.want, tc.want}; !reflect.DeepEqual(probes, want) {
+			t.Fatalf("probe length %d: want %+v, got %+v", tc.length, want, probes)
+		}
+	}
+}
+
+func TestNegotiatorChallengeError(t *testing.T) {
+	v1 := newChallenge(negotiateFlagNTLMSSPNEGOTIATEUNICODE|negotiateFlagNTLMSSPNEGOTIATENTLM,
+		[]byte("8bytes!!"), "DOMAIN", nil)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		serveChallenge(w, req, hex.EncodeToString(v1))
+	}))
+	defer server.Close()
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("isis\\malory", "guest")
+	_, err = Negotiator{RefuseNTLMv1: true}.Authenticate(req)
+	if !errors.Is(err, ErrNTLMv1Refused) {
+		t.Fatalf("expected ErrNTLMv1Refused, got %v", err)
+	}
+	var cerr *ChallengeError
+	if !errors.As(err, &cerr) {
+		t.Fatalf("expected a *ChallengeError, got %T", err)
+	}
+	if !bytes.Equal(cerr.Challenge, v1) {
+		t.Fatalf("expected challenge %x, got %x", v1, cerr.Challenge)
+	}
+	if want := base64.StdEncoding.EncodeToString(v1); cerr.ChallengeBase64() != want {
+		t.Fatalf("expected challenge %s, got %s", want, cerr.ChallengeBase64())
+	}
+}
+
+func TestNegotiatorAllowedTargets(t *testing.T) {
+	for _, tc := range []struct {
+		allowed []string
+		ok      bool
+	}{
+		{[]string{"other", "SERVER.domain.com"}, true},
+		{[]string{"domain"}, true},
+		{[]string{"rogue.domain.com"}, false},
+	} {
+		var msgs [][]byte
+		server := httptest.NewServer(recorder(handler, &msgs))
+		negotiator := Negotiator{AllowedTargets: tc.allowed}
+		req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth("isis\\malory", "guest")
+		resp, err := negotiator.RoundTrip(req)
+		server.Close()
+		if tc.ok {
+			if err != nil {
+				t.Errorf("%v: %v", tc.allowed, err)
+				continue
+			}
+			resp.Body.Close()
+		} else if !errors.Is(err, ErrTargetNotAllowed) {
+			t.Errorf("%v: expected ErrTargetNotAllowed, got %v", tc.allowed, err)
+		}
+		if tc.ok != (len(msgs) == 2) {
+			t.Errorf("%v: unexpected number of NTLM messages sent: %d", tc.allowed, len(msgs))
+		}
+	}
+}
+
+func TestNegotiatorStreamsFinalResponse(t *testing.T) {
+	const chunk = 1 << 20
+	for _, negotiator := range []Negotiator{{}, {HandshakeTimeout: time.Minute}, {PinAuthenticatedConnection: true}} {
+		proceed := make(chan struct{})
+		stalled := make(chan bool, 1)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			_, authz, _ := strings.Cut(req.Header.Get("Authorization"), " ")
+			data, _ := base64.StdEncoding.DecodeString(authz)
+			if len(data) < 12 || data[8] != 3 {
+				handler(w, req)
+				return
+			}
+			// send the second half only once the client has read the
+			// first, which it can't if RoundTrip buffers the body
+			w.Write(make([]byte, chunk))
+			w.(http.Flusher).Flush()
+			select {
+			case <-proceed:
+				stalled <- false
+			case <-time.After(5 * time.Second):
+				stalled <- true
+			}
+			w.Write(make([]byte, chunk))
+		}))
+		req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth("isis\\malory", "guest")
+		resp, err := negotiator.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(resp.Body, make([]byte, chunk)); err != nil {
+			t.Fatal(err)
+		}
+		close(proceed)
+		n, err := io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		server.Close()
+		if err != nil || n != chunk {
+			t.Fatalf("%+v: expected %d more bytes, got %d (%v)", negotiator, chunk, n, err)
+		}
+		if <-stalled {
+			t.Fatalf("%+v: the final response was buffered", negotiator)
+		}
+	}
+}
+
+func TestNegotiatorPinAuthenticatedConnectionExpiry(t *testing.T) {
+	handshakes := 0
+	var mu sync.Mutex
+	conns := map[string]bool{}
+	auth := connAuthHandler(&handshakes, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		conns[req.RemoteAddr] = true
+		mu.Unlock()
+		auth(w, req)
+	}))
+	defer server.Close()
+	negotiator := Negotiator{
+		RoundTripper:               server.Client().Transport,
+		PinAuthenticatedConnection: true,
+	}
+	for i := 0; i < 7; i++ {
+		req, err := http.NewRequest(http.MethodPost, server.URL, strings.NewReader("body"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth("isis\\malory", "guest")
+		resp, err := negotiator.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("request %d: expected status %d, got %d", i, http.StatusOK, resp.StatusCode)
+		}
+	}
+	// every third request finds the authentication expired
+	if handshakes != 3 {
+		t.Fatalf("expected 3 handshakes, got %d", handshakes)
+	}
+	if len(conns) != 1 {
+		t.Fatalf("expected a single connection, got %d", len(conns))
+	}
+}
+
+func TestNegotiatorNoCredentials(t *testing.T) {
+	var msgs [][]byte
+	server := httptest.NewServer(recorder(handler, &msgs))
+	defer server.Close()
+	for _, tc := range []struct {
+		negotiator Negotiator
+		basic      bool
+	}{
+		{Negotiator{Credentials: func(*http.Request) (Credential, error) { return Credential{}, nil }}, false},
+		{Negotiator{RealmCredentials: func(string, *http.Request) (Credential, error) { return Credential{}, nil }}, false},
+		{Negotiator{}, true},
+	} {
+		req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.basic {
+			req.SetBasicAuth("", "")
+		}
+		negotiator := tc.negotiator
+		if _, err := negotiator.RoundTrip(req); !errors.Is(err, ErrNoCredentials) {
+			t.Fatalf("expected ErrNoCredentials, got %v", err)
+		}
+	}
+	// the realm is only known from the challenge, but no AUTHENTICATE
+	// message is sent either way
+	if len(msgs) != 1 {
+		t.Fatalf("expected only the NEGOTIATE message to be sent, got %d messages", len(msgs))
+	}
+}
+
+func TestNegotiatorVerifyConnection(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+	for _, tc := range []struct {
+		rt   http.RoundTripper
+		want error
+	}{
+		{&http.Transport{}, nil},
+		// without keep-alives, every leg gets a connection of its own
+		{&http.Transport{DisableKeepAlives: true}, ErrConnectionChanged},
+	} {
+		req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth("isis\\malory", "guest")
+		var conns []net.Conn
+		trace := &httptrace.ClientTrace{GotConn: func(info httptrace.GotConnInfo) { conns = append(conns, info.Conn) }}
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+		res, err := Negotiator{RoundTripper: tc.rt, VerifyConnection: true}.RoundTrip(req)
+		if !errors.Is(err, tc.want) {
+			t.Fatalf("expected %v, got %v", tc.want, err)
+		}
+		if err != nil {
+			continue
+		}
+		res.Body.Close()
+		// the caller's trace still sees every leg, all on one connection
+		if len(conns) != 3 || conns[1] != conns[0] || conns[2] != conns[0] {
+			t.Fatalf("expected 3 requests on the same connection, got %v", conns)
+		}
+	}
+}
+
+func TestNegotiatorBodyUpload(t *testing.T) {
+	// a server that issues challenges but never accepts the AUTHENTICATE
+	// message
+	var uploaded int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		n, _ := io.Copy(io.Discard, req.Body)
+		uploaded += n
+		if strings.HasPrefix(req.Header.Get("Authorization"), "NTLM TlRMTVNTUAABAAAA") {
+			w.Header().Set("WWW-Authenticate", "NTLM "+base64.StdEncoding.EncodeToString(unhex(t, exampleChallenge)))
+		} else {
+			w.Header().Set("WWW-Authenticate", "NTLM")
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+	body := bytes.Repeat([]byte("x"), 1<<20)
+	for _, tc := range []struct {
+		negotiator Negotiator
+		uploads    int64
+		err        error
+	}{
+		// along with the anonymous request and the AUTHENTICATE message
+		{Negotiator{}, 2, nil},
+		// only along with the AUTHENTICATE message
+		{Negotiator{ProbeMethod: http.MethodHead}, 1, nil},
+		{Negotiator{MaxBodySize: 1 << 10}, 0, ErrBodyTooLarge},
+	} {
+		uploaded = 0
+		req, err := http.NewRequest(http.MethodPost, server.URL, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth("isis\\malory", "guest")
+		negotiator := tc.negotiator
+		res, err := negotiator.RoundTrip(req)
+		if !errors.Is(err, tc.err) {
+			t.Fatalf("expected %v, got %v", tc.err, err)
+		}
+		if err == nil {
+			res.Body.Close()
+			if res.StatusCode != http.StatusUnauthorized {
+				t.Fatalf("expected status %d, got %d", http.StatusUnauthorized, res.StatusCode)
+			}
+		}
+		if want := tc.uploads * int64(len(body)); uploaded != want {
+			t.Errorf("%+v: expected %d bytes to be uploaded, got %d", tc.negotiator, want, uploaded)
+		}
+	}
+}
+
+func TestNegotiatorBodyWithoutAuthentication(t *testing.T) {
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		requests = append(requests, req.Method+":"+string(body))
+		w.Write(body)
+	}))
+	defer server.Close()
+	req, err := http.NewRequest(http.MethodPost, server.URL, strings.NewReader("body"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("isis\\malory", "guest")
+	resp, err := Negotiator{}.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a server that needs no authentication sees the request just once
+	if string(body) != "body" {
+		t.Fatalf("expected body %q, got %q", "body", body)
+	}
+	if want := []string{"POST:body"}; !reflect.DeepEqual(requests, want) {
+		t.Fatalf("expected requests %q, got %q", want, requests)
+	}
+}
+
+func TestNegotiatorNegotiateAccepted(t *testing.T) {
+	// a server that asks for NTLM, but then serves the NEGOTIATE message
+	// without a challenge
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		authz := req.Header.Get("Authorization")
+		requests = append(requests, req.Method+":"+authz[:min(len(authz), 10)])
+		if authz == "" {
+			w.Header().Set("WWW-Authenticate", "NTLM")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, "deleted\n")
+	}))
+	defer server.Close()
+	req, err := http.NewRequest(http.MethodDelete, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("isis\\malory", "guest")
+	resp, err := Negotiator{}.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// nothing was held back from the NEGOTIATE message, so its response
+	// is the final one
+	if string(body) != "deleted\n" {
+		t.Fatalf("expected body %q, got %q", "deleted\n", body)
+	}
+	if want := []string{"DELETE:", "DELETE:NTLM TlRMT"}; !reflect.DeepEqual(requests, want) {
+		t.Fatalf("expected requests %q, got %q", want, requests)
+	}
+}
+
+func TestNegotiatorNeedsReauth(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") == "" {
+			// the session of the previous request has gone stale
+			w.Header().Set("X-Session-Stale", "1")
+			fmt.Fprint(w, "stale session\n")
+			return
+		}
+		handler(w, req)
+	}))
+	defer server.Close()
+	needsReauth := func(res *http.Response) bool { return res.Header.Get("X-Session-Stale") != "" }
+	for _, tc := range []struct {
+		needsReauth func(*http.Response) bool
+		body        string
+	}{
+		{nil, "stale session\n"},
+		{needsReauth, "access granted to isis\\malory\n"},
+	} {
+		req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth("isis\\malory", "guest")
+		resp, err := Negotiator{NeedsReauth: tc.needsReauth}.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != tc.body {
+			t.Errorf("expected body %q, got %q", tc.body, body)
+		}
+	}
+}
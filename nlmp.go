@@ -2,16 +2,20 @@
 //
 // Protocol details from https://msdn.microsoft.com/en-us/library/cc236621.aspx,
 // implementation hints from http://davenport.sourceforge.net/ntlm.html .
-// This package only implements authentication, no key exchange or encryption. It
-// only supports Unicode (UTF16LE) encoding of protocol strings, no OEM encoding.
+// Besides authentication, Client can establish a Session for message signing
+// and sealing. This package prefers Unicode (UTF16LE) encoding of protocol
+// strings, OEM encoding is assumed to be ASCII.
 // This package implements NTLMv2.
 package ntlmssp
 
 import (
+	"crypto/cipher"
 	"crypto/hmac"
-	"crypto/md5"
-	"golang.org/x/crypto/md4"
+	"encoding/binary"
+	"hash"
 	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
 )
 
 func getNtlmV2Hash(password, username, target string) []byte {
@@ -19,33 +23,121 @@ func getNtlmV2Hash(password, username, target string) []byte {
 }
 
 func GetNtlmHash(password string) []byte {
-	hash := md4.New()
+	hash := backend.newMD4()
 	hash.Write(toUnicode(password))
 	return hash.Sum(nil)
 }
 
+// getNtlmHashBytes is GetNtlmHash for a password held in a byte slice. The
+// UTF-16 copy of the password is wiped before returning.
+func getNtlmHashBytes(password []byte) []byte {
+	var u []uint16
+	for p := password; len(p) > 0; {
+		r, size := utf8.DecodeRune(p)
+		u = utf16.AppendRune(u, r)
+		p = p[size:]
+	}
+	b := make([]byte, 2*len(u))
+	for i, c := range u {
+		binary.LittleEndian.PutUint16(b[2*i:], c)
+	}
+	clear(u)
+	hash := backend.newMD4()
+	hash.Write(b)
+	clear(b)
+	return hash.Sum(nil)
+}
+
 func computeNtlmV2Response(ntlmV2Hash, serverChallenge, clientChallenge,
 	timestamp, targetInfo []byte) []byte {
 
-	temp := []byte{1, 1, 0, 0, 0, 0, 0, 0}
-	temp = append(temp, timestamp...)
-	temp = append(temp, clientChallenge...)
-	temp = append(temp, 0, 0, 0, 0)
-	temp = append(temp, targetInfo...)
-	temp = append(temp, 0, 0, 0, 0)
+	return newNtlmV2MAC(ntlmV2Hash).response(serverChallenge, clientChallenge, timestamp, targetInfo)
+}
+
+// computeSessionBaseKey returns the NTLMv2 session base key, the HMAC-MD5 of
+// the NTProofStr (the first 16 bytes of the NTLMv2 response) under the
+// NTLMv2 hash. It is also the key exchange key, and so the exported session
+// key unless a random one is exchanged.
+func computeSessionBaseKey(ntlmV2Hash, ntProofStr []byte) []byte {
+	return newNtlmV2MAC(ntlmV2Hash).sessionBaseKey(ntProofStr)
+}
 
-	NTProofStr := hmacMd5(ntlmV2Hash, serverChallenge, temp)
-	return append(NTProofStr, temp...)
+// LMv2Response returns the 24 byte LMv2 response of user in domain, whose
+// password has the NT hash ntHash, to serverChallenge: the HMAC-MD5 of the
+// server and client challenges under the NTLMv2 hash, followed by the 8 byte
+// clientChallenge.
+func LMv2Response(ntHash []byte, user, domain string, serverChallenge, clientChallenge []byte) []byte {
+	ntlmV2Hash := hmacMd5(ntHash, toUnicode(strings.ToUpper(user)+domain))
+	return computeLmV2Response(ntlmV2Hash, serverChallenge, clientChallenge)
 }
 
 func computeLmV2Response(ntlmV2Hash, serverChallenge, clientChallenge []byte) []byte {
-	return append(hmacMd5(ntlmV2Hash, serverChallenge, clientChallenge), clientChallenge...)
+	return newNtlmV2MAC(ntlmV2Hash).lmV2Response(serverChallenge, clientChallenge)
+}
+
+// ntlmV2MAC computes the HMAC-MD5s keyed by an NTLMv2 hash: the NTLMv2 and
+// LMv2 responses and the session base key. They all share one HMAC state,
+// which is reset in between.
+type ntlmV2MAC struct {
+	mac hash.Hash
+}
+
+func newNtlmV2MAC(ntlmV2Hash []byte) ntlmV2MAC {
+	return ntlmV2MAC{hmac.New(backend.newMD5, ntlmV2Hash)}
+}
+
+// sum appends the HMAC-MD5 of data to b.
+func (m ntlmV2MAC) sum(b []byte, data ...[]byte) []byte {
+	m.mac.Reset()
+	for _, d := range data {
+		m.mac.Write(d)
+	}
+	return m.mac.Sum(b)
+}
+
+// response returns the NTLMv2 response. The blob is assembled in a single
+// buffer, after room for the NTProofStr that is then filled in place.
+func (m ntlmV2MAC) response(serverChallenge, clientChallenge, timestamp, targetInfo []byte) []byte {
+	b := make([]byte, 16, 32+len(timestamp)+len(clientChallenge)+len(targetInfo))
+	b = append(b, 1, 1, 0, 0, 0, 0, 0, 0)
+	b = append(b, timestamp...)
+	b = append(b, clientChallenge...)
+	b = append(b, 0, 0, 0, 0)
+	b = append(b, targetInfo...)
+	b = append(b, 0, 0, 0, 0)
+	m.sum(b[:0], serverChallenge, b[16:])
+	return b
+}
+
+// lmV2Response returns the 24 byte LMv2 response.
+func (m ntlmV2MAC) lmV2Response(serverChallenge, clientChallenge []byte) []byte {
+	b := m.sum(make([]byte, 0, 16+len(clientChallenge)), serverChallenge, clientChallenge)
+	return append(b, clientChallenge...)
+}
+
+// sessionBaseKey returns the session base key for the NTProofStr.
+func (m ntlmV2MAC) sessionBaseKey(ntProofStr []byte) []byte {
+	return m.sum(nil, ntProofStr)
 }
 
 func hmacMd5(key []byte, data ...[]byte) []byte {
-	mac := hmac.New(md5.New, key)
+	mac := hmac.New(backend.newMD5, key)
 	for _, d := range data {
 		mac.Write(d)
 	}
 	return mac.Sum(nil)
 }
+
+func rc4K(key, data []byte) []byte {
+	result := make([]byte, len(data))
+	newRC4(key).XORKeyStream(result, data)
+	return result
+}
+
+func newRC4(key []byte) cipher.Stream {
+	c, err := backend.newRC4(key)
+	if err != nil {
+		panic(err) // only returned for keys that aren't 1 to 256 bytes long
+	}
+	return c
+}
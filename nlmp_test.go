@@ -5,6 +5,7 @@ import (
 	"encoding/hex"
 	"strings"
 	"testing"
+	"time"
 )
 
 // test cases from http://davenport.sourceforge.net/ntlm.html
@@ -150,9 +151,97 @@ func TestNTLMhash(t *testing.T) {
 	}
 }
 
+func TestNTLMhashVectors(t *testing.T) {
+	for _, tc := range []struct {
+		password, hash string
+	}{
+		{"Password", "a4f49c406510bdcab6824ee7c30fd852"}, // MS-NLMP 4.2.2.1.2
+		{"", "31d6cfe0d16ae931b73c59d7e0c089c0"},
+		{password, "cd06ca7c7e10c99b1d33b7485a2ed808"},
+	} {
+		if v := hex.EncodeToString(GetNtlmHash(tc.password)); v != tc.hash {
+			t.Errorf("%q: expected %s, got %s", tc.password, tc.hash, v)
+		}
+		if v := hex.EncodeToString(getNtlmHashBytes([]byte(tc.password))); v != tc.hash {
+			t.Errorf("%q: expected %s, got %s", tc.password, tc.hash, v)
+		}
+	}
+}
+
 func TestNTLMv2Hash(t *testing.T) {
 	v := getNtlmV2Hash(password, username, target)
 	if expected := []byte{0x04, 0xb8, 0xe0, 0xba, 0x74, 0x28, 0x9c, 0xc5, 0x40, 0x82, 0x6b, 0xab, 0x1d, 0xee, 0x63, 0xae}; !bytes.Equal(v, expected) {
 		t.Fatalf("expected %v, got %v", expected, v)
 	}
 }
+
+func TestNTLMhashBytes(t *testing.T) {
+	for _, p := range []string{password, "", "pässwörd", "\U0001f511"} {
+		if v, expected := getNtlmHashBytes([]byte(p)), GetNtlmHash(p); !bytes.Equal(v, expected) {
+			t.Fatalf("%q: expected %x, got %x", p, expected, v)
+		}
+	}
+}
+
+func TestFileTime(t *testing.T) {
+	tables := []struct {
+		t  time.Time
+		ft []byte
+	}{
+		// timestamp from the NTLMv2 response example above
+		{time.Date(2003, 6, 17, 10, 0, 0, 0, time.UTC), []byte{0x00, 0x90, 0xd3, 0x36, 0xb7, 0x34, 0xc3, 0x01}},
+		{time.Date(1601, 1, 1, 0, 0, 0, 0, time.UTC), []byte{0, 0, 0, 0, 0, 0, 0, 0}},
+		{time.Date(1601, 1, 1, 0, 0, 0, 100, time.UTC), []byte{1, 0, 0, 0, 0, 0, 0, 0}},
+		{time.Unix(0, 0), []byte{0x00, 0x80, 0x3e, 0xd5, 0xde, 0xb1, 0x9d, 0x01}},
+	}
+	for _, table := range tables {
+		if v := fileTime(table.t); !bytes.Equal(v, table.ft) {
+			t.Errorf("%v: expected %x, got %x", table.t, table.ft, v)
+		}
+	}
+}
+
+func TestLMv2ResponseVector(t *testing.T) {
+	// MS-NLMP 4.2.4.2.1
+	v := LMv2Response(GetNtlmHash("Password"), "User", "Domain", specServerChallenge, specClientChallenge)
+	if expected := unhex(t, "86c35097ac9cec102554764a57cccc19aaaaaaaaaaaaaaaa"); !bytes.Equal(v, expected) {
+		t.Fatalf("expected %x, got %x", expected, v)
+	}
+}
+
+func TestNTLMv2MAC(t *testing.T) {
+	// MS-NLMP 4.2.4, computed in either order with one shared HMAC
+	mac := newNtlmV2MAC(getNtlmV2Hash("Password", "User", "Domain"))
+	for i := 0; i < 2; i++ {
+		if i == 1 {
+			mac.sessionBaseKey(make([]byte, 16))
+		}
+		response := mac.response(specServerChallenge, specClientChallenge, make([]byte, 8), specTargetInfo)
+		if expected := unhex(t, "68cd0ab851e51c96aabc927bebef6a1c"); !bytes.Equal(response[:16], expected) {
+			t.Fatalf("expected NTProofStr %x, got %x", expected, response[:16])
+		}
+		if len(response) != 48+len(specTargetInfo) || cap(response) != len(response) {
+			t.Fatalf("unexpected NTLMv2 response length %d and capacity %d", len(response), cap(response))
+		}
+		if v, expected := mac.lmV2Response(specServerChallenge, specClientChallenge), unhex(t, "86c35097ac9cec102554764a57cccc19aaaaaaaaaaaaaaaa"); !bytes.Equal(v, expected) {
+			t.Fatalf("expected LMv2 response %x, got %x", expected, v)
+		}
+		if v, expected := mac.sessionBaseKey(response[:16]), unhex(t, "8de40ccadbc14a82f15cb0ad0de95ca3"); !bytes.Equal(v, expected) {
+			t.Fatalf("expected session base key %x, got %x", expected, v)
+		}
+	}
+}
+
+func BenchmarkNTLMv2Response(b *testing.B) {
+	ntlmV2Hash := getNtlmV2Hash(password, username, target)
+	clientChallenge := []byte{0xff, 0xff, 0xff, 0x00, 0x11, 0x22, 0x33, 0x44}
+	timestamp := []byte{0x00, 0x90, 0xd3, 0x36, 0xb7, 0x34, 0xc3, 0x01}
+	targetInfo := make([]byte, 128)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		mac := newNtlmV2MAC(ntlmV2Hash)
+		response := mac.response(challenge, clientChallenge, timestamp, targetInfo)
+		mac.lmV2Response(challenge, clientChallenge)
+		mac.sessionBaseKey(response[:16])
+	}
+}
@@ -0,0 +1,310 @@
+package ntlmssp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// MessageType identifies the kind of an NTLM message.
+type MessageType uint32
+
+// Message types defined by MS-NLMP
+const (
+	NegotiateMessageType    MessageType = 1
+	ChallengeMessageType    MessageType = 2
+	AuthenticateMessageType MessageType = 3
+)
+
+func (t MessageType) String() string {
+	switch t {
+	case NegotiateMessageType:
+		return "NEGOTIATE"
+	case ChallengeMessageType:
+		return "CHALLENGE"
+	case AuthenticateMessageType:
+		return "AUTHENTICATE"
+	}
+	return fmt.Sprintf("MessageType(%d)", uint32(t))
+}
+
+// ParseError is returned when an NTLM message is malformed.
+type ParseError struct {
+	Type  MessageType // type of the message being parsed, 0 if unknown
+	Field string      // field that could not be parsed
+	Err   error
+}
+
+func (e *ParseError) Error() string {
+	if e.Type == 0 {
+		return fmt.Sprintf("malformed NTLM message %s: %v", e.Field, e.Err)
+	}
+	return fmt.Sprintf("malformed %v message %s: %v", e.Type, e.Field, e.Err)
+}
+
+func (e *ParseError) Unwrap() error { return e.Err }
+
+// NegotiateMessage is the parsed form of a NEGOTIATE message.
+type NegotiateMessage struct {
+	NegotiateFlags uint32
+	Domain         string
+	Workstation    string
+	// Version is only set if the client sent NTLMSSP_NEGOTIATE_VERSION.
+	Version *Version
+}
+
+// ChallengeMessage is the parsed form of a CHALLENGE message.
+type ChallengeMessage struct {
+	NegotiateFlags  uint32
+	TargetName      string
+	ServerChallenge [8]byte
+	TargetInfo      []AVPair
+
+	// server identity taken from the target info, empty if not sent
+	NbDomainName    string
+	NbComputerName  string
+	DNSDomainName   string
+	DNSComputerName string
+}
+
+// Features are the security features a server asks the client for in its
+// challenge. Whether channel bindings are required can't be told from the
+// challenge, as that depends on the Extended Protection policy the server
+// applies to the AUTHENTICATE message.
+type Features struct {
+	// MIC is set if the target info has a timestamp, in which case
+	// MS-NLMP has clients send a MIC in the AUTHENTICATE message. Servers
+	// only insist on it when hardened, so Client only sends one with
+	// RequireMIC.
+	MIC         bool
+	Sign        bool
+	Seal        bool
+	Key128      bool // 128-bit session keys
+	Key56       bool // 56-bit session keys
+	KeyExchange bool
+}
+
+// RequiredFeatures summarizes the features the server asks for.
+func (m *ChallengeMessage) RequiredFeatures() Features {
+	flags := negotiateFlags(m.NegotiateFlags)
+	f := Features{
+		Sign:        flags.Has(negotiateFlagNTLMSSPNEGOTIATESIGN),
+		Seal:        flags.Has(negotiateFlagNTLMSSPNEGOTIATESEAL),
+		Key128:      flags.Has(negotiateFlagNTLMSSPNEGOTIATE128),
+		Key56:       flags.Has(negotiateFlagNTLMSSPNEGOTIATE56),
+		KeyExchange: flags.Has(negotiateFlagNTLMSSPNEGOTIATEKEYEXCH),
+	}
+	for _, p := range m.TargetInfo {
+		if p.ID == MsvAvTimestamp {
+			f.MIC = true
+		}
+	}
+	return f
+}
+
+// AuthenticateMessage is the parsed form of an AUTHENTICATE message.
+type AuthenticateMessage struct {
+	NegotiateFlags            uint32
+	LmChallengeResponse       []byte
+	NtChallengeResponse       []byte
+	Domain                    string
+	User                      string
+	Workstation               string
+	EncryptedRandomSessionKey []byte
+	// Version is only set if the client sent NTLMSSP_NEGOTIATE_VERSION.
+	Version *Version
+	// MIC is only set if the MsvAvFlags of the NTLMv2 response announce
+	// one.
+	MIC []byte
+}
+
+// NTLMv2Response is the parsed form of the NTLMv2 response of an
+// AUTHENTICATE message.
+type NTLMv2Response struct {
+	NTProofStr      []byte
+	Timestamp       time.Time
+	ClientChallenge []byte
+	// TargetInfo are the AV pairs sent by the client: those of the
+	// server's challenge, followed by those the client added, such as
+	// MsvAvFlags or MsvAvChannelBindings.
+	TargetInfo []AVPair
+}
+
+// NTLMv2 parses the NTLMv2 response of the message, which fails for NTLMv1
+// responses and anonymous authentication.
+func (m *AuthenticateMessage) NTLMv2() (*NTLMv2Response, error) {
+	// NTProofStr (16 bytes), followed by the header of the NTLMv2 client
+	// challenge (28 bytes) and the AV pairs
+	nt := m.NtChallengeResponse
+	if len(nt) < 44 {
+		return nil, &ParseError{AuthenticateMessageType, "NtChallengeResponse", errors.New("not an NTLMv2 response")}
+	}
+	pairs, err := parseAVPairs(nt[44:])
+	if err != nil {
+		return nil, &ParseError{AuthenticateMessageType, "NtChallengeResponse", err}
+	}
+	return &NTLMv2Response{
+		NTProofStr:      nt[:16:16],
+		Timestamp:       parseFileTime(nt[24:32]),
+		ClientChallenge: nt[32:40:40],
+		TargetInfo:      pairs,
+	}, nil
+}
+
+// ParseMessage parses an NTLM message of any type. The returned value is a
+// *NegotiateMessage, *ChallengeMessage or *AuthenticateMessage depending on
+// the message type. Malformed input results in a *ParseError, ParseMessage
+// never panics.
+func ParseMessage(data []byte) (MessageType, any, error) {
+	var h messageHeader
+	if err := binary.Read(bytes.NewReader(data), binary.LittleEndian, &h); err != nil {
+		return 0, nil, &ParseError{0, "header", err}
+	}
+	if err := h.check(0); err != nil {
+		return 0, nil, &ParseError{0, "header", err}
+	}
+	t := MessageType(h.MessageType)
+	var m any
+	var err error
+	switch t {
+	case NegotiateMessageType:
+		m, err = parseNegotiateMessage(data)
+	case ChallengeMessageType:
+		m, err = parseChallengeMessage(data)
+	case AuthenticateMessageType:
+		m, err = parseAuthenticateMessage(data)
+	}
+	if err != nil {
+		return t, nil, err
+	}
+	return t, m, nil
+}
+
+// ParseNegotiate parses a NEGOTIATE message, e.g. to log what a client
+// requests. Malformed input results in a *ParseError.
+func ParseNegotiate(data []byte) (*NegotiateMessage, error) {
+	return parseNegotiateMessage(data)
+}
+
+func parseNegotiateMessage(data []byte) (*NegotiateMessage, error) {
+	var f struct {
+		messageHeader
+		NegotiateFlags negotiateFlags
+		Domain         varField
+		Workstation    varField
+	}
+	if err := binary.Read(bytes.NewReader(data), binary.LittleEndian, &f); err != nil {
+		return nil, &ParseError{NegotiateMessageType, "header", err}
+	}
+	if err := f.messageHeader.check(NegotiateMessageType); err != nil {
+		return nil, &ParseError{NegotiateMessageType, "header", err}
+	}
+	m := &NegotiateMessage{NegotiateFlags: uint32(f.NegotiateFlags)}
+	var err error
+	// the supplied domain and workstation are always OEM encoded
+	if m.Domain, err = f.Domain.ReadStringFrom(data, false); err != nil {
+		return nil, &ParseError{NegotiateMessageType, "Domain", err}
+	}
+	if m.Workstation, err = f.Workstation.ReadStringFrom(data, false); err != nil {
+		return nil, &ParseError{NegotiateMessageType, "Workstation", err}
+	}
+	if f.NegotiateFlags.Has(negotiateFlagNTLMSSPNEGOTIATEVERSION) {
+		// the version follows the fixed fields
+		m.Version = new(Version)
+		r := bytes.NewReader(data[binary.Size(&f):])
+		if err := binary.Read(r, binary.LittleEndian, m.Version); err != nil {
+			return nil, &ParseError{NegotiateMessageType, "Version", err}
+		}
+	}
+	return m, nil
+}
+
+func parseChallengeMessage(data []byte) (*ChallengeMessage, error) {
+	var cm challengeMessage
+	if err := cm.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+	m := &ChallengeMessage{
+		NegotiateFlags:  uint32(cm.NegotiateFlags),
+		TargetName:      cm.TargetName,
+		ServerChallenge: cm.ServerChallenge,
+		TargetInfo:      cm.AVPairs,
+	}
+	for _, f := range []struct {
+		id AvID
+		s  *string
+	}{
+		{MsvAvNbDomainName, &m.NbDomainName},
+		{MsvAvNbComputerName, &m.NbComputerName},
+		{MsvAvDNSDomainName, &m.DNSDomainName},
+		{MsvAvDNSComputerName, &m.DNSComputerName},
+	} {
+		v, ok := cm.TargetInfo[f.id]
+		if !ok {
+			continue
+		}
+		var err error
+		if *f.s, err = fromUnicode(v); err != nil {
+			return nil, &ParseError{ChallengeMessageType, "TargetInfo", err}
+		}
+	}
+	return m, nil
+}
+
+func parseAuthenticateMessage(data []byte) (*AuthenticateMessage, error) {
+	var f authenticateMessageFields
+	if err := binary.Read(bytes.NewReader(data), binary.LittleEndian, &f); err != nil {
+		return nil, &ParseError{AuthenticateMessageType, "header", err}
+	}
+	if err := f.messageHeader.check(AuthenticateMessageType); err != nil {
+		return nil, &ParseError{AuthenticateMessageType, "header", err}
+	}
+	unicode := f.NegotiateFlags.Has(negotiateFlagNTLMSSPNEGOTIATEUNICODE)
+	m := &AuthenticateMessage{NegotiateFlags: uint32(f.NegotiateFlags)}
+	var err error
+	if m.LmChallengeResponse, err = f.LmChallengeResponse.ReadFrom(data); err != nil {
+		return nil, &ParseError{AuthenticateMessageType, "LmChallengeResponse", err}
+	}
+	if m.NtChallengeResponse, err = f.NtChallengeResponse.ReadFrom(data); err != nil {
+		return nil, &ParseError{AuthenticateMessageType, "NtChallengeResponse", err}
+	}
+	if m.Domain, err = f.TargetName.ReadStringFrom(data, unicode); err != nil {
+		return nil, &ParseError{AuthenticateMessageType, "DomainName", err}
+	}
+	if m.User, err = f.UserName.ReadStringFrom(data, unicode); err != nil {
+		return nil, &ParseError{AuthenticateMessageType, "UserName", err}
+	}
+	if m.Workstation, err = f.Workstation.ReadStringFrom(data, unicode); err != nil {
+		return nil, &ParseError{AuthenticateMessageType, "Workstation", err}
+	}
+	if m.EncryptedRandomSessionKey, err = f.EncryptedRandomSessionKey.ReadFrom(data); err != nil {
+		return nil, &ParseError{AuthenticateMessageType, "EncryptedRandomSessionKey", err}
+	}
+	if f.NegotiateFlags.Has(negotiateFlagNTLMSSPNEGOTIATEVERSION) {
+		// the version follows the fixed fields
+		m.Version = new(Version)
+		r := bytes.NewReader(data[binary.Size(&f):])
+		if err := binary.Read(r, binary.LittleEndian, m.Version); err != nil {
+			return nil, &ParseError{AuthenticateMessageType, "Version", err}
+		}
+	}
+	if v2, err := m.NTLMv2(); err == nil {
+		for _, p := range v2.TargetInfo {
+			if p.ID != MsvAvFlags || len(p.Value) != 4 || binary.LittleEndian.Uint32(p.Value)&msvAvFlagMIC == 0 {
+				continue
+			}
+			if m.Version == nil {
+				// the MIC follows the version, there's no telling
+				// where it is without one
+				return nil, &ParseError{AuthenticateMessageType, "MIC", errors.New("MIC without version")}
+			}
+			if len(data) < micOffset+16 {
+				return nil, &ParseError{AuthenticateMessageType, "MIC", errors.New("message too short")}
+			}
+			m.MIC = data[micOffset : micOffset+16 : micOffset+16]
+		}
+	}
+	return m, nil
+}
@@ -0,0 +1,369 @@
+package ntlmssp
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func exampleMessages(t testing.TB) [][]byte {
+	negotiate, err := NewNegotiateMessage("isis", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	challenge, err := hex.DecodeString(exampleChallenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authenticate, err := ProcessChallenge(challenge, "isis", "malory", "guest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return [][]byte{negotiate, challenge, authenticate}
+}
+
+func TestParseMessage(t *testing.T) {
+	msgs := exampleMessages(t)
+
+	typ, m, err := ParseMessage(msgs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nm, ok := m.(*NegotiateMessage); typ != NegotiateMessageType || !ok || nm.Domain != "ISIS" {
+		t.Fatalf("unexpected negotiate message: %v %+v", typ, m)
+	}
+
+	typ, m, err = ParseMessage(msgs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	cm, ok := m.(*ChallengeMessage)
+	if typ != ChallengeMessageType || !ok {
+		t.Fatalf("unexpected challenge message: %v %+v", typ, m)
+	}
+	if cm.TargetName != "DOMAIN" || len(cm.TargetInfo) != 4 {
+		t.Fatalf("unexpected challenge message: %+v", cm)
+	}
+
+	typ, m, err = ParseMessage(msgs[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	am, ok := m.(*AuthenticateMessage)
+	if typ != AuthenticateMessageType || !ok {
+		t.Fatalf("unexpected authenticate message: %v %+v", typ, m)
+	}
+	if am.Domain != "isis" || am.User != "malory" {
+		t.Fatalf("unexpected authenticate message: %+v", am)
+	}
+}
+
+func TestParseMessageMalformed(t *testing.T) {
+	challenge, _ := hex.DecodeString(exampleChallenge)
+	tables := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"bad signature", []byte("NTLMSSX\x00\x02\x00\x00\x00")},
+		{"truncated", challenge[:40]},
+		// target info offset pointing far beyond the end of the message
+		{"offset overflow", append(append([]byte{}, challenge[:40]...), 0x62, 0x00, 0x62, 0x00, 0xff, 0xff, 0xff, 0xff)},
+		// target info that is not terminated by MsvAvEOL
+		{"unterminated target info", append(append([]byte{}, challenge[:len(challenge)-4]...), 1, 0, 0, 0)},
+	}
+	for _, table := range tables {
+		_, m, err := ParseMessage(table.data)
+		var perr *ParseError
+		if !errors.As(err, &perr) {
+			t.Errorf("%s: expected a *ParseError, got %v (%+v)", table.name, err, m)
+		}
+	}
+}
+
+func FuzzParseMessage(f *testing.F) {
+	for _, m := range exampleMessages(f) {
+		f.Add(m)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		typ, m, err := ParseMessage(data)
+		if err != nil {
+			var perr *ParseError
+			if !errors.As(err, &perr) {
+				t.Fatalf("expected a *ParseError, got %v", err)
+			}
+			return
+		}
+		switch m.(type) {
+		case *NegotiateMessage:
+			if typ != NegotiateMessageType {
+				t.Fatalf("got %v for a negotiate message", typ)
+			}
+		case *ChallengeMessage:
+			if typ != ChallengeMessageType {
+				t.Fatalf("got %v for a challenge message", typ)
+			}
+		case *AuthenticateMessage:
+			if typ != AuthenticateMessageType {
+				t.Fatalf("got %v for an authenticate message", typ)
+			}
+		default:
+			t.Fatalf("unexpected message %T", m)
+		}
+	})
+}
+
+func TestParseChallengeServerNames(t *testing.T) {
+	_, m, err := ParseMessage(unhex(t, exampleChallenge))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cm := m.(*ChallengeMessage)
+	if cm.NbDomainName != "DOMAIN" {
+		t.Errorf("expected NetBIOS domain name %q, got %q", "DOMAIN", cm.NbDomainName)
+	}
+	if cm.NbComputerName != "SERVER" {
+		t.Errorf("expected NetBIOS computer name %q, got %q", "SERVER", cm.NbComputerName)
+	}
+	if cm.DNSDomainName != "domain.com" {
+		t.Errorf("expected DNS domain name %q, got %q", "domain.com", cm.DNSDomainName)
+	}
+	if cm.DNSComputerName != "server.domain.com" {
+		t.Errorf("expected DNS computer name %q, got %q", "server.domain.com", cm.DNSComputerName)
+	}
+}
+
+func TestChallengeMessageRequiredFeatures(t *testing.T) {
+	_, m, err := ParseMessage(unhex(t, exampleChallenge))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f := m.(*ChallengeMessage).RequiredFeatures(); f != (Features{}) {
+		t.Errorf("expected no features for the example challenge, got %+v", f)
+	}
+
+	flags := negotiateFlagNTLMSSPNEGOTIATEUNICODE |
+		negotiateFlagNTLMSSPNEGOTIATESIGN |
+		negotiateFlagNTLMSSPNEGOTIATE128 |
+		negotiateFlagNTLMSSPNEGOTIATEKEYEXCH
+	_, m, err = ParseMessage(newChallenge(flags, []byte("8bytes!!"), "DOMAIN", []AVPair{
+		{ID: MsvAvTimestamp, Value: fileTime(time.Now())},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Features{MIC: true, Sign: true, Key128: true, KeyExchange: true}
+	if f := m.(*ChallengeMessage).RequiredFeatures(); f != expected {
+		t.Errorf("expected %+v, got %+v", expected, f)
+	}
+}
+
+func TestParseMessageType(t *testing.T) {
+	challenge, _ := hex.DecodeString(exampleChallenge)
+	bad := append([]byte{}, challenge...)
+	bad[8] = 7
+	_, _, err := ParseMessage(bad)
+	if err == nil || !strings.Contains(err.Error(), "invalid message type 7") {
+		t.Fatalf("expected an invalid message type error, got %v", err)
+	}
+
+	c := Client{Domain: "isis", User: "malory", Password: "guest"}
+	if _, err := c.Step(nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Step(bad); err == nil || !strings.Contains(err.Error(), "invalid message type 7") {
+		t.Fatalf("expected an invalid message type error, got %v", err)
+	}
+
+	// a valid message of the wrong type
+	s := testServer("guest")
+	if _, err := s.Step(challenge); err == nil || !strings.Contains(err.Error(), "expected NEGOTIATE message, got CHALLENGE") {
+		t.Fatalf("expected a message type error, got %v", err)
+	}
+}
+
+func TestParseMaximalTargetInfo(t *testing.T) {
+	flags := negotiateFlagNTLMSSPNEGOTIATEUNICODE |
+		negotiateFlagNTLMSSPNEGOTIATENTLM |
+		negotiateFlagNTLMSSPNEGOTIATETARGETINFO
+	// a target info of maxVarFieldLen bytes: the pair and MsvAvEOL take 4
+	// bytes of header each
+	value := make([]byte, maxVarFieldLen-8)
+	for i := range value {
+		value[i] = byte(i)
+	}
+	challenge := newChallenge(flags, specServerChallenge, "Domain", []AVPair{{ID: MsvAvDNSTreeName, Value: value}})
+	_, m, err := ParseMessage(challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cm := m.(*ChallengeMessage)
+	if len(cm.TargetInfo) != 1 || !bytes.Equal(cm.TargetInfo[0].Value, value) {
+		t.Fatalf("expected a single AV pair of %d bytes, got %d pairs", len(value), len(cm.TargetInfo))
+	}
+
+	// that is too much to echo in an NTLMv2 response
+	c := &Client{Domain: "isis", User: "malory", Password: "guest"}
+	if _, err := c.Step(nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Step(challenge); err == nil || !strings.Contains(err.Error(), "target info") {
+		t.Fatalf("expected an error about the target info, got %v", err)
+	}
+
+	// but the largest target info that fits is echoed in full
+	challenge = newChallenge(flags, specServerChallenge, "Domain", []AVPair{{ID: MsvAvDNSTreeName, Value: value[:len(value)-48]}})
+	c = &Client{Domain: "isis", User: "malory", Password: "guest"}
+	if _, err := c.Step(nil); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := c.Step(challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	am, err := parseAuthenticateMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(am.NtChallengeResponse) != maxVarFieldLen {
+		t.Fatalf("expected an NTLMv2 response of %d bytes, got %d", maxVarFieldLen, len(am.NtChallengeResponse))
+	}
+}
+
+func TestParseNegotiate(t *testing.T) {
+	c := &Client{
+		Domain:      "isis",
+		Workstation: "MYPC",
+		Sign:        true,
+		Version:     &Version{ProductMajorVersion: 10, ProductBuild: 19041},
+	}
+	msg, err := c.Step(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nm, err := ParseNegotiate(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nm.Domain != "ISIS" || nm.Workstation != "MYPC" {
+		t.Errorf("expected ISIS and MYPC, got %q and %q", nm.Domain, nm.Workstation)
+	}
+	flags := negotiateFlags(nm.NegotiateFlags)
+	for _, f := range []negotiateFlags{
+		negotiateFlagNTLMSSPNEGOTIATESIGN,
+		negotiateFlagNTLMSSPNEGOTIATEOEMDOMAINSUPPLIED,
+		negotiateFlagNTLMSSPNEGOTIATEOEMWORKSTATIONSUPPLIED,
+		negotiateFlagNTLMSSPNEGOTIATEVERSION,
+	} {
+		if !flags.Has(f) {
+			t.Errorf("expected flag %#x in %#x", uint32(f), uint32(flags))
+		}
+	}
+	want := Version{ProductMajorVersion: 10, ProductBuild: 19041, NTLMRevisionCurrent: NTLMSSPRevisionW2K3}
+	if nm.Version == nil || *nm.Version != want {
+		t.Errorf("expected version %+v, got %+v", want, nm.Version)
+	}
+
+	// without the version flag, the version is left out
+	msg, err = (&Client{}).Step(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nm, err = ParseNegotiate(msg); err != nil {
+		t.Fatal(err)
+	}
+	if nm.Version != nil {
+		t.Errorf("expected no version, got %+v", nm.Version)
+	}
+
+	if _, err := ParseNegotiate(msg[:20]); err == nil {
+		t.Error("expected a truncated message to be refused")
+	}
+}
+
+func TestParseAuthenticateNTLMv2(t *testing.T) {
+	flags := negotiateFlagNTLMSSPNEGOTIATEUNICODE |
+		negotiateFlagNTLMSSPNEGOTIATENTLM |
+		negotiateFlagNTLMSSPNEGOTIATEEXTENDEDSESSIONSECURITY |
+		negotiateFlagNTLMSSPNEGOTIATETARGETINFO
+	timestamp := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	server := []AVPair{
+		{ID: MsvAvNbDomainName, Value: toUnicode("DOMAIN")},
+		{ID: MsvAvTimestamp, Value: fileTime(timestamp)},
+	}
+	challenge := newChallenge(flags, specServerChallenge, "DOMAIN", server)
+	singleHost := &SingleHostData{}
+	bindings := &ChannelBindings{ApplicationData: []byte("tls-server-end-point:test")}
+	c := Client{
+		Domain: "isis", User: "malory", Password: "guest",
+		ClientChallenge: specClientChallenge,
+		SingleHost:      singleHost,
+		ChannelBindings: bindings,
+		RequireMIC:      true,
+	}
+	negotiate, err := c.Step(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authenticate, err := c.Step(challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, m, err := ParseMessage(authenticate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	am := m.(*AuthenticateMessage)
+	v2, err := am.NTLMv2()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !v2.Timestamp.Equal(timestamp) {
+		t.Errorf("expected timestamp %v, got %v", timestamp, v2.Timestamp)
+	}
+	if !bytes.Equal(v2.ClientChallenge, specClientChallenge) {
+		t.Errorf("expected client challenge %x, got %x", specClientChallenge, v2.ClientChallenge)
+	}
+	want := append(server,
+		AVPair{ID: MsvAvFlags, Value: []byte{msvAvFlagMIC, 0, 0, 0}},
+		AVPair{ID: MsvAvSingleHost, Value: singleHost.marshal()},
+		AVPair{ID: MsvAvChannelBindings, Value: bindings.Hash()},
+	)
+	if !reflect.DeepEqual(v2.TargetInfo, want) {
+		t.Errorf("expected AV pairs %v, got %v", want, v2.TargetInfo)
+	}
+	if am.Version == nil || *am.Version != DefaultVersion() {
+		t.Errorf("expected the default version, got %+v", am.Version)
+	}
+	zeroed := append([]byte{}, authenticate...)
+	clear(zeroed[micOffset : micOffset+16])
+	mic := hmacMd5(c.Session().SessionKey(), negotiate, challenge, zeroed)
+	if !bytes.Equal(am.MIC, mic) {
+		t.Errorf("expected MIC %x, got %x", mic, am.MIC)
+	}
+
+	// without the version the MIC can't be located
+	noVersion := append([]byte{}, authenticate...)
+	noVersion[63] &^= byte(negotiateFlagNTLMSSPNEGOTIATEVERSION >> 24)
+	var perr *ParseError
+	if _, err := parseAuthenticateMessage(noVersion); !errors.As(err, &perr) || perr.Field != "MIC" {
+		t.Errorf("expected the MIC to be refused without a version, got %v", err)
+	}
+
+	// an anonymous AUTHENTICATE message has no NTLMv2 response
+	anonymous := Client{}
+	anonymous.Step(nil)
+	if authenticate, err = anonymous.Step(challenge); err != nil {
+		t.Fatal(err)
+	}
+	if am, err = parseAuthenticateMessage(authenticate); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := am.NTLMv2(); err == nil {
+		t.Error("expected no NTLMv2 response for anonymous authentication")
+	}
+}
@@ -0,0 +1,251 @@
+package ntlmssp
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// pinnedTransport hands out the transports used for
+// PinAuthenticatedConnection. Each of them keeps a single connection per host
+// and is only used by one request at a time, so that no other request can get
+// in between the legs of a handshake or steal an authenticated connection.
+// Once a request is done, its transport is kept for the next request with the
+// same identity, which then finds its connection already authenticated. Kept
+// transports are bounded like the idle connections of the base transport:
+// per identity by MaxIdleConnsPerHost, in total by MaxIdleConns and in time
+// by IdleConnTimeout.
+type pinnedTransport struct {
+	base *http.Transport
+
+	mu     sync.Mutex
+	idle   map[[sha256.Size]byte][]idleTransport // by identity
+	total  int                                   // of the idle transports
+	active int                                   // transports handed out
+	closed bool
+}
+
+// idleTransport is a transport kept for the next request, which closes its
+// connections once it expires.
+type idleTransport struct {
+	t     *http.Transport
+	since time.Time
+	timer *time.Timer
+}
+
+// defaultPinnedIdleTimeout is how long transports are kept when the base
+// transport has no IdleConnTimeout, as for http.DefaultTransport.
+const defaultPinnedIdleTimeout = 90 * time.Second
+
+// pinnedTransports maps the transports wrapped by Negotiators to their
+// pinnedTransport, until Negotiator.CloseIdleConnections is called or all
+// the transports it kept expired.
+var pinnedTransports sync.Map // *http.Transport -> *pinnedTransport
+
+// pin returns the pinnedTransport for rt, or nil if rt isn't an
+// *http.Transport and can't be pinned.
+func pin(rt http.RoundTripper) *pinnedTransport {
+	t, ok := rt.(*http.Transport)
+	if !ok {
+		return nil
+	}
+	if p, ok := pinnedTransports.Load(t); ok {
+		return p.(*pinnedTransport)
+	}
+	p, _ := pinnedTransports.LoadOrStore(t, &pinnedTransport{
+		base: t,
+		idle: map[[sha256.Size]byte][]idleTransport{},
+	})
+	return p.(*pinnedTransport)
+}
+
+// CloseIdleConnections closes the idle connections of the RoundTripper,
+// along with those kept for PinAuthenticatedConnection. Connections of
+// requests still in progress are closed once their response body is. It is
+// called by http.Client.CloseIdleConnections when the Negotiator is the
+// client's transport.
+func (l Negotiator) CloseIdleConnections() {
+	rt := l.RoundTripper
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	if t, ok := rt.(*http.Transport); ok {
+		if p, ok := pinnedTransports.LoadAndDelete(t); ok {
+			p.(*pinnedTransport).close()
+		}
+	}
+	if c, ok := rt.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
+
+// transport returns a new transport that keeps a single connection per host.
+func (p *pinnedTransport) transport() *http.Transport {
+	t := p.base.Clone()
+	t.MaxConnsPerHost = 1
+	return t
+}
+
+// acquire returns a transport for the exclusive use of a request with the
+// given identity.
+func (p *pinnedTransport) acquire(key [sha256.Size]byte) *http.Transport {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.active++
+	idle := p.idle[key]
+	if len(idle) == 0 {
+		return p.transport()
+	}
+	it := idle[len(idle)-1]
+	p.remove(key, len(idle)-1)
+	// should it fire anyway, expire no longer finds the transport
+	it.timer.Stop()
+	return it.t
+}
+
+// release makes a transport available to the next request with the same
+// identity. As many transports are kept per identity and in total as the base
+// transport keeps idle connections, the connections of any others are closed
+// and the oldest evicted to make room.
+func (p *pinnedTransport) release(key [sha256.Size]byte, t *http.Transport) {
+	perKey := p.base.MaxIdleConnsPerHost
+	if perKey <= 0 {
+		perKey = http.DefaultMaxIdleConnsPerHost
+	}
+	timeout := p.base.IdleConnTimeout
+	if timeout <= 0 {
+		timeout = defaultPinnedIdleTimeout
+	}
+	var closing []*http.Transport
+	p.mu.Lock()
+	p.active--
+	if p.closed || len(p.idle[key]) >= perKey {
+		closing = append(closing, t)
+	} else {
+		for p.base.MaxIdleConns > 0 && p.total >= p.base.MaxIdleConns {
+			closing = append(closing, p.evictOldest())
+		}
+		p.idle[key] = append(p.idle[key], idleTransport{
+			t:     t,
+			since: time.Now(),
+			timer: time.AfterFunc(timeout, func() { p.expire(key, t) }),
+		})
+		p.total++
+	}
+	p.mu.Unlock()
+	for _, t := range closing {
+		t.CloseIdleConnections()
+	}
+}
+
+// remove drops the i-th idle transport of key. p.mu must be held.
+func (p *pinnedTransport) remove(key [sha256.Size]byte, i int) {
+	idle := p.idle[key]
+	if len(idle) == 1 {
+		delete(p.idle, key)
+	} else {
+		p.idle[key] = append(idle[:i], idle[i+1:]...)
+	}
+	p.total--
+}
+
+// evictOldest drops the transport that has been idle the longest and returns
+// it. p.mu must be held, with at least one transport idle.
+func (p *pinnedTransport) evictOldest() *http.Transport {
+	var oldest [sha256.Size]byte
+	var since time.Time
+	for key, idle := range p.idle {
+		// the transports of a key are appended as they are released
+		if since.IsZero() || idle[0].since.Before(since) {
+			oldest, since = key, idle[0].since
+		}
+	}
+	it := p.idle[oldest][0]
+	p.remove(oldest, 0)
+	it.timer.Stop()
+	return it.t
+}
+
+// expire closes the connections of a transport that has been idle for too
+// long. Once none are left, p is forgotten, and a pinnedTransport is made
+// afresh for the next request.
+func (p *pinnedTransport) expire(key [sha256.Size]byte, t *http.Transport) {
+	p.mu.Lock()
+	found := false
+	for i, it := range p.idle[key] {
+		if it.t == t {
+			p.remove(key, i)
+			found = true
+			break
+		}
+	}
+	unused := p.total == 0 && p.active == 0
+	p.mu.Unlock()
+	if !found {
+		return
+	}
+	if unused {
+		pinnedTransports.CompareAndDelete(p.base, p)
+	}
+	t.CloseIdleConnections()
+}
+
+// close closes the connections of the idle transports, and makes release
+// close those of the others.
+func (p *pinnedTransport) close() {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = map[[sha256.Size]byte][]idleTransport{}
+	p.total = 0
+	p.closed = true
+	p.mu.Unlock()
+	for _, its := range idle {
+		for _, it := range its {
+			it.timer.Stop()
+			it.t.CloseIdleConnections()
+		}
+	}
+}
+
+// identityKey returns the key of the transports kept for the identity
+// described by fields. Each field is prefixed with its length, so that
+// different fields never share a key.
+func identityKey(fields ...string) [sha256.Size]byte {
+	d := sha256.New()
+	for _, f := range fields {
+		d.Write(binary.LittleEndian.AppendUint32(nil, uint32(len(f))))
+		io.WriteString(d, f)
+	}
+	var key [sha256.Size]byte
+	d.Sum(key[:0])
+	return key
+}
+
+// resolve calls credentials once for req, returning the credential along
+// with a function that supplies copies of it in place of credentials.
+func resolve(credentials func(*http.Request) (Credential, error), req *http.Request) (Credential, func(*http.Request) (Credential, error), error) {
+	cred, err := credentials(req)
+	if err != nil {
+		return Credential{}, nil, err
+	}
+	return cred, func(*http.Request) (Credential, error) {
+		return cred.clone(), nil
+	}, nil
+}
+
+// releaseOnClose releases the transport of a request once its response has
+// been read.
+type releaseOnClose struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releaseOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
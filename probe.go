@@ -0,0 +1,92 @@
+package ntlmssp
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// ProbeLength selects how a body-less probe request declares its length.
+type ProbeLength int
+
+const (
+	// ProbeContentLengthZero leaves it to net/http, which sends
+	// Content-Length: 0 for methods that usually have a body.
+	ProbeContentLengthZero ProbeLength = iota
+	// ProbeOmitContentLength sends neither Content-Length nor
+	// Transfer-Encoding.
+	ProbeOmitContentLength
+	// ProbeChunked sends an empty chunked body.
+	ProbeChunked
+)
+
+// removeBody strips the body from probe, declaring its length as
+// configured by ProbeLength.
+func (l Negotiator) removeBody(probe *http.Request) {
+	probe.Body, probe.GetBody, probe.ContentLength = nil, nil, 0
+	probe.TransferEncoding = nil
+	switch l.ProbeLength {
+	case ProbeOmitContentLength:
+		// net/http only leaves out the length of a body it can't measure,
+		// and only sends it unchunked when told to use the identity
+		// encoding
+		probe.Body, probe.ContentLength = io.NopCloser(bytes.NewReader(nil)), -1
+		probe.TransferEncoding = []string{"identity"}
+	case ProbeChunked:
+		probe.Body, probe.ContentLength = io.NopCloser(bytes.NewReader(nil)), -1
+		probe.TransferEncoding = []string{"chunked"}
+	}
+}
+
+// Probe sends a NEGOTIATE message to the server addressed by req and returns
+// the CHALLENGE it responds with, without completing the handshake. No
+// credentials are needed, which makes it useful to inventory the NTLM
+// capabilities of servers. The request is sent without its body.
+func (l Negotiator) Probe(req *http.Request) (*ChallengeMessage, error) {
+	rt := l.RoundTripper
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	probe := req.Clone(req.Context())
+	l.removeBody(probe)
+	probe.Header.Del("Authorization")
+
+	res, err := rt.RoundTrip(probe)
+	if err != nil {
+		return nil, err
+	}
+	l.drain(res)
+	resauth := authheader(res.Header.Values("Www-Authenticate"))
+	if res.StatusCode != http.StatusUnauthorized || !(resauth.IsNegotiate() || resauth.IsNTLM()) {
+		return nil, fmt.Errorf("ntlmssp: server did not offer NTLM authentication (%s)", res.Status)
+	}
+	scheme := "Negotiate"
+	if resauth.IsNTLM() {
+		scheme = "NTLM"
+	}
+
+	var c Client
+	negotiateMessage, err := c.Step(nil)
+	if err != nil {
+		return nil, err
+	}
+	negotiateMessage = l.rewrite(NegotiateMessageType, negotiateMessage)
+	probe.Header.Set("Authorization", scheme+" "+base64.StdEncoding.EncodeToString(negotiateMessage))
+	res, err = rt.RoundTrip(probe)
+	if err != nil {
+		return nil, err
+	}
+	l.drain(res)
+
+	challengeMessage, err := authheader(res.Header.Values("Www-Authenticate")).GetData()
+	if err != nil {
+		return nil, err
+	}
+	if len(challengeMessage) == 0 {
+		return nil, errors.New("ntlmssp: server did not send a challenge")
+	}
+	return parseChallengeMessage(challengeMessage)
+}
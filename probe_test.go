@@ -0,0 +1,47 @@
+package ntlmssp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestProbe(t *testing.T) {
+	var msgs [][]byte
+	server := httptest.NewServer(recorder(handler, &msgs))
+	defer server.Close()
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var negotiator Negotiator
+	cm, err := negotiator.Probe(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cm.TargetName != "DOMAIN" || cm.DNSComputerName != "server.domain.com" {
+		t.Fatalf("unexpected challenge: %+v", cm)
+	}
+	if cm.ServerChallenge != [8]byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef} {
+		t.Fatalf("unexpected server challenge: %x", cm.ServerChallenge)
+	}
+	if len(msgs) != 1 {
+		t.Fatalf("expected only a negotiate message to be sent, got %d messages", len(msgs))
+	}
+}
+
+func TestProbeNoNTLM(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var negotiator Negotiator
+	if _, err := negotiator.Probe(req); err == nil {
+		t.Fatal("expected an error for a server that doesn't offer NTLM")
+	}
+}
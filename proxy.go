@@ -0,0 +1,57 @@
+package ntlmssp
+
+import "net/http"
+
+// authHeaders names the status code and headers of authentication to either
+// a server or a proxy.
+type authHeaders struct {
+	status        int    // status code asking for authentication
+	authorization string // request header with the client's token
+	authenticate  string // response header with the offered schemes and challenge
+}
+
+var (
+	serverHeaders = authHeaders{http.StatusUnauthorized, "Authorization", "Www-Authenticate"}
+	proxyHeaders  = authHeaders{http.StatusProxyAuthRequired, "Proxy-Authorization", "Proxy-Authenticate"}
+)
+
+// headers returns the headers the Negotiator authenticates with.
+func (l Negotiator) headers() authHeaders {
+	if l.proxy {
+		return proxyHeaders
+	}
+	return serverHeaders
+}
+
+// proxyNegotiator returns the Negotiator that authenticates the legs of a
+// handshake to the proxy, with ProxyCredentials.
+func (l Negotiator) proxyNegotiator() Negotiator {
+	return Negotiator{
+		Credentials:           l.ProxyCredentials,
+		IgnoreBasicAuthHeader: true,
+		ProbeLength:           l.ProbeLength,
+		MaxDrain:              l.MaxDrain,
+		Now:                   l.Now,
+		proxy:                 true,
+	}
+}
+
+// proxyTransport sends the legs of a handshake with the server through rt,
+// authenticating them to the proxy with l whenever it answers with a 407.
+type proxyTransport struct {
+	l  Negotiator
+	h  *handshake // of the server, which gets the round trips counted
+	rt http.RoundTripper
+}
+
+func (t proxyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// the proxy authorization belongs to the handshake with the proxy,
+	// which leaves the leg itself alone
+	req = req.Clone(req.Context())
+	req.Header.Del(proxyHeaders.authorization)
+	h := handshake{rt: t.rt}
+	res, err := t.l.roundTrip(req, &h)
+	// the leg itself is already counted by the handshake with the server
+	t.h.roundTrips += h.roundTrips - 1
+	return res, err
+}
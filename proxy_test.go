@@ -0,0 +1,104 @@
+package ntlmssp
+
+import (
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// proxyServer is an NTLM proxy in front of handler, which authenticates
+// every connection with the given password before passing its requests on.
+func proxyServer(password string) *httptest.Server {
+	var mu sync.Mutex
+	proxies := map[string]*Server{}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		s := proxies[req.RemoteAddr]
+		if s == nil {
+			s = testServer(password)
+			proxies[req.RemoteAddr] = s
+		}
+		mu.Unlock()
+		if s.Session() == nil {
+			in, err := authheader(req.Header.Values("Proxy-Authorization")).GetData()
+			var out []byte
+			if err == nil && len(in) > 0 {
+				out, err = s.Step(in)
+			}
+			if err != nil {
+				mu.Lock()
+				delete(proxies, req.RemoteAddr)
+				mu.Unlock()
+				w.Header().Set("Proxy-Authenticate", "NTLM")
+				w.WriteHeader(http.StatusProxyAuthRequired)
+				return
+			}
+			if s.Session() == nil {
+				w.Header().Set("Proxy-Authenticate", strings.TrimSpace("NTLM "+base64.StdEncoding.EncodeToString(out)))
+				w.WriteHeader(http.StatusProxyAuthRequired)
+				return
+			}
+		}
+		handler(w, req)
+	}))
+}
+
+func TestNegotiatorProxy(t *testing.T) {
+	proxy := proxyServer("proxypass")
+	defer proxy.Close()
+	proxyURL, err := url.Parse(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	negotiator := Negotiator{
+		RoundTripper: &http.Transport{Proxy: http.ProxyURL(proxyURL)},
+		ProxyCredentials: func(*http.Request) (Credential, error) {
+			return Credential{Domain: "isis", User: "malory", Password: []byte("proxypass")}, nil
+		},
+		PinAuthenticatedConnection: true,
+	}
+	// the second request reuses the connection already authenticated to
+	// the proxy, so only the server asks for a handshake
+	for i, roundTrips := range []int{5, 3} {
+		req, err := http.NewRequest(http.MethodPost, "http://origin.example/", strings.NewReader("body"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth("isis\\malory", "guest")
+		r, err := negotiator.Authenticate(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(r.Response.Body)
+		r.Response.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := "access granted to isis\\malory\n"; string(body) != expected {
+			t.Fatalf("request %d: expected body %q, got %q", i, expected, body)
+		}
+		if r.RoundTrips != roundTrips {
+			t.Errorf("request %d: expected %d round trips, got %d", i, roundTrips, r.RoundTrips)
+		}
+	}
+
+	// the proxy's credentials are separate from the server's
+	req, err := http.NewRequest(http.MethodGet, "http://origin.example/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("isis\\malory", "proxypass")
+	resp, err := Negotiator{RoundTripper: negotiator.RoundTripper}.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusProxyAuthRequired {
+		t.Fatalf("expected status %d without proxy credentials, got %d", http.StatusProxyAuthRequired, resp.StatusCode)
+	}
+}
@@ -0,0 +1,82 @@
+package ntlmssp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// retryAfter returns the delay asked for by the Retry-After header of res,
+// either in seconds or as an HTTP date relative to now, or 0 if there is
+// none.
+func retryAfter(res *http.Response, now time.Time) time.Duration {
+	v := res.Header.Get("Retry-After")
+	if v == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(v); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
+
+// authenticateThrottled runs the handshake, starting it over up to
+// RetryThrottled times as long as the server throttles it.
+func (l Negotiator) authenticateThrottled(req *http.Request) (*Result, error) {
+	// the body is sent once per attempt
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	ctx := req.Context()
+	for retries := 0; ; retries++ {
+		r := req.Clone(ctx)
+		if body != nil {
+			r.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		h := handshake{traceConn: l.VerifyConnection}
+		result, err := l.authenticateOnce(r, &h)
+		if h.retryAfter <= 0 || retries == l.RetryThrottled {
+			return result, err
+		}
+		var rejected *RejectedError
+		switch {
+		case errors.As(err, &rejected):
+			l.drain(rejected.Response)
+		case err == nil && result.Response.StatusCode == http.StatusUnauthorized:
+			l.drain(result.Response)
+		case !errors.Is(err, ErrNoChallenge):
+			return result, err
+		}
+		if err := sleep(ctx, h.retryAfter); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// sleep waits for d, or returns the error of ctx if it is done sooner.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,104 @@
+package ntlmssp
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2024, 2, 29, 12, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		header   string
+		expected time.Duration
+	}{
+		{"", 0},
+		{"3", 3 * time.Second},
+		{"-1", 0},
+		{now.Add(time.Minute).Format(http.TimeFormat), time.Minute},
+		{now.Add(-time.Minute).Format(http.TimeFormat), 0},
+		{"soon", 0},
+	} {
+		res := &http.Response{Header: http.Header{}}
+		if tc.header != "" {
+			res.Header.Set("Retry-After", tc.header)
+		}
+		if d := retryAfter(res, now); d != tc.expected {
+			t.Errorf("%q: expected %v, got %v", tc.header, tc.expected, d)
+		}
+	}
+}
+
+// throttlingServer answers the first NEGOTIATE messages it gets with a 401
+// asking to retry after the given number of seconds, and then falls back to
+// handler.
+func throttlingServer(throttled int32, seconds string) *httptest.Server {
+	var negotiates atomic.Int32
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		data, _ := authheader(req.Header.Values("Authorization")).GetData()
+		if len(data) > 8 && data[8] == 1 && negotiates.Add(1) <= throttled {
+			w.Header().Set("WWW-Authenticate", "NTLM")
+			w.Header().Set("Retry-After", seconds)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		handler(w, req)
+	}))
+}
+
+func TestNegotiatorRetryThrottled(t *testing.T) {
+	server := throttlingServer(1, "1")
+	defer server.Close()
+	req, err := http.NewRequest(http.MethodPost, server.URL, strings.NewReader("body"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("isis\\malory", "guest")
+	if _, err := (Negotiator{}).RoundTrip(req); !errors.Is(err, ErrNoChallenge) {
+		t.Fatalf("expected %v without RetryThrottled, got %v", ErrNoChallenge, err)
+	}
+
+	server = throttlingServer(1, "1")
+	defer server.Close()
+	req, err = http.NewRequest(http.MethodPost, server.URL, strings.NewReader("body"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("isis\\malory", "guest")
+	start := time.Now()
+	resp, err := Negotiator{RetryThrottled: 1}.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the retried handshake to succeed, got %s", resp.Status)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Fatalf("expected RoundTrip to wait for a second, it took %v", elapsed)
+	}
+}
+
+func TestNegotiatorRetryThrottledCanceled(t *testing.T) {
+	server := throttlingServer(1, "60")
+	defer server.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("isis\\malory", "guest")
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	if _, err := (Negotiator{RetryThrottled: 1}).RoundTrip(req); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Fatalf("expected the cancellation to interrupt the wait, it took %v", elapsed)
+	}
+}
@@ -0,0 +1,263 @@
+package ntlmssp
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// serverFlags are the flags a Server agrees to if the client requests them.
+var serverFlags = negotiateFlagNTLMSSPNEGOTIATEUNICODE |
+	negotiateFlagNTLMSSPREQUESTTARGET |
+	negotiateFlagNTLMSSPNEGOTIATESIGN |
+	negotiateFlagNTLMSSPNEGOTIATESEAL |
+	negotiateFlagNTLMSSPNEGOTIATEALWAYSSIGN |
+	negotiateFlagNTLMSSPNEGOTIATEEXTENDEDSESSIONSECURITY |
+	negotiateFlagNTLMSSPNEGOTIATE128 |
+	negotiateFlagNTLMSSPNEGOTIATEKEYEXCH |
+	negotiateFlagNTLMSSPNEGOTIATE56
+
+// ErrAuthenticationFailed is returned by Server and VerifyAuthenticate when the client's response
+// doesn't match the expected one, i.e. the password is wrong.
+var ErrAuthenticationFailed = errors.New("ntlmssp: authentication failed")
+
+// Server performs the server side of an NTLM handshake, e.g. to test clients
+// against. Only NTLMv2 responses are accepted. A Server is used for a single
+// handshake.
+type Server struct {
+	// TargetName is the NetBIOS domain name of the server, sent as the
+	// target name of the challenge.
+	TargetName string
+	// ComputerName is the NetBIOS name of the server.
+	ComputerName string
+
+	// Hash returns the NT hash of the password of user in domain, e.g.
+	// GetNtlmHash(password), or an error if the user is unknown.
+	Hash func(domain, user string) ([]byte, error)
+
+	// TargetInfo, if not nil, replaces the AV pairs of the challenge,
+	// which by default are the NetBIOS domain and computer names and a
+	// timestamp.
+	TargetInfo []AVPair
+
+	// ChannelBindings, if not nil, are the bindings of the channel the
+	// handshake runs on, e.g. TLSServerEndPoint of the server certificate.
+	// Clients must then send the matching MsvAvChannelBindings.
+	ChannelBindings *ChannelBindings
+
+	// RequireMIC rejects AUTHENTICATE messages without a MIC. A MIC that
+	// is sent is always verified.
+	RequireMIC bool
+
+	// Rand, if not nil, is the source of the 8 byte server challenge
+	// instead of crypto/rand, e.g. a bytes.Reader with a fixed challenge
+	// for reproducible handshakes.
+	Rand io.Reader
+
+	flags        negotiateFlags
+	challenge    []byte
+	transcript   [][]byte // the NEGOTIATE and CHALLENGE messages, for the MIC
+	domain, user string
+	session      *Session
+}
+
+// Step returns the next message to send to the client. The first call takes
+// the NEGOTIATE message received from the client and returns the CHALLENGE
+// message, the second takes the AUTHENTICATE message and returns nil once the
+// client is authenticated.
+func (s *Server) Step(in []byte) ([]byte, error) {
+	switch {
+	case s.challenge == nil:
+		nm, err := parseNegotiateMessage(in)
+		if err != nil {
+			return nil, err
+		}
+		out, err := s.processNegotiate(nm)
+		if err != nil {
+			return nil, err
+		}
+		s.transcript = [][]byte{append([]byte{}, in...), out}
+		return out, nil
+	case s.session == nil:
+		am, err := parseAuthenticateMessage(in)
+		if err != nil {
+			return nil, err
+		}
+		return nil, s.processAuthenticate(am, in)
+	}
+	return nil, errors.New("ntlmssp: handshake already complete")
+}
+
+func (s *Server) processNegotiate(nm *NegotiateMessage) ([]byte, error) {
+	// only unicode is supported, so it is even selected for clients that
+	// only offer OEM
+	s.flags = negotiateFlags(nm.NegotiateFlags)&serverFlags |
+		negotiateFlagNTLMSSPNEGOTIATEUNICODE |
+		negotiateFlagNTLMSSPNEGOTIATENTLM |
+		negotiateFlagNTLMSSPNEGOTIATETARGETINFO |
+		negotiateFlagNTLMSSPTARGETTYPEDOMAIN
+	s.challenge = make([]byte, 8)
+	r := s.Rand
+	if r == nil {
+		r = rand.Reader
+	}
+	if _, err := io.ReadFull(r, s.challenge); err != nil {
+		return nil, err
+	}
+
+	name := toUnicode(s.TargetName)
+	pairs := s.TargetInfo
+	if pairs == nil {
+		pairs = []AVPair{
+			{ID: MsvAvNbDomainName, Value: toUnicode(s.TargetName)},
+			{ID: MsvAvNbComputerName, Value: toUnicode(s.ComputerName)},
+			{ID: MsvAvTimestamp, Value: fileTime(time.Now())},
+		}
+	}
+	info := marshalAVPairs(pairs)
+	if err := checkVarFieldLen("TargetInfo", len(info)); err != nil {
+		return nil, err
+	}
+	ptr := binary.Size(&challengeMessageFields{})
+	f := challengeMessageFields{
+		messageHeader:  newMessageHeader(2),
+		TargetName:     newVarField(&ptr, len(name)),
+		NegotiateFlags: s.flags,
+		TargetInfo:     newVarField(&ptr, len(info)),
+	}
+	copy(f.ServerChallenge[:], s.challenge)
+	b := bytes.Buffer{}
+	if err := binary.Write(&b, binary.LittleEndian, &f); err != nil {
+		return nil, err
+	}
+	b.Write(name)
+	b.Write(info)
+	return b.Bytes(), nil
+}
+
+func (s *Server) processAuthenticate(am *AuthenticateMessage, msg []byte) error {
+	if am.User == "" && len(am.NtChallengeResponse) == 0 {
+		return errors.New("ntlmssp: anonymous authentication is not supported")
+	}
+	hash, err := s.Hash(am.Domain, am.User)
+	if err != nil {
+		return err
+	}
+	flags := s.flags & negotiateFlags(am.NegotiateFlags)
+	exportedSessionKey, err := verifyNTLMv2(am, s.challenge, flags, hash)
+	if err != nil {
+		return err
+	}
+	v2, err := am.NTLMv2()
+	if err != nil {
+		return err
+	}
+	if err := s.checkAVPairs(v2.TargetInfo, msg, exportedSessionKey); err != nil {
+		return err
+	}
+	s.domain, s.user = am.Domain, am.User
+	s.session = newSession(flags, exportedSessionKey, false)
+	return nil
+}
+
+// User returns the domain and name of the authenticated user, which are
+// empty until the handshake has completed.
+func (s *Server) User() (domain, user string) {
+	return s.domain, s.user
+}
+
+// Session returns the session established by the handshake, or nil if the
+// handshake hasn't completed yet.
+func (s *Server) Session() *Session {
+	return s.session
+}
+
+// VerifyAuthenticate checks the NTLMv2 response of the AUTHENTICATE message
+// authenticate, sent in reply to the CHALLENGE message challenge, against
+// the NT hash of the user's password, e.g. GetNtlmHash(password). It returns
+// the domain and name of the user along with the exported session key, or
+// ErrAuthenticationFailed if the response doesn't match. Unlike Server, it
+// leaves issuing challenges and looking up users to the caller.
+func VerifyAuthenticate(challenge, authenticate []byte, ntHash []byte) (domain, user string, sessionKey []byte, err error) {
+	cm, err := parseChallengeMessage(challenge)
+	if err != nil {
+		return "", "", nil, err
+	}
+	am, err := parseAuthenticateMessage(authenticate)
+	if err != nil {
+		return "", "", nil, err
+	}
+	flags := negotiateFlags(cm.NegotiateFlags) & negotiateFlags(am.NegotiateFlags)
+	sessionKey, err = verifyNTLMv2(am, cm.ServerChallenge[:], flags, ntHash)
+	if err != nil {
+		return "", "", nil, err
+	}
+	return am.Domain, am.User, sessionKey, nil
+}
+
+// verifyNTLMv2 checks the NTLMv2 response of am to serverChallenge and
+// returns the exported session key.
+func verifyNTLMv2(am *AuthenticateMessage, serverChallenge []byte, flags negotiateFlags, hash []byte) ([]byte, error) {
+	// an NTLMv2 response is the 16 byte NTProofStr followed by a blob of
+	// at least 28 bytes, NTLMv1 responses are always 24 bytes long
+	nt := am.NtChallengeResponse
+	if len(nt) < 44 {
+		return nil, errors.New("ntlmssp: only NTLMv2 responses are accepted")
+	}
+	ntlmV2Hash := hmacMd5(hash, toUnicode(strings.ToUpper(am.User)+am.Domain))
+	mac := newNtlmV2MAC(ntlmV2Hash)
+	if !hmac.Equal(mac.sum(nil, serverChallenge, nt[16:]), nt[:16]) {
+		return nil, ErrAuthenticationFailed
+	}
+	exportedSessionKey := mac.sessionBaseKey(nt[:16])
+	if flags.Has(negotiateFlagNTLMSSPNEGOTIATEKEYEXCH) {
+		if len(am.EncryptedRandomSessionKey) != 16 {
+			return nil, errors.New("ntlmssp: missing encrypted random session key")
+		}
+		exportedSessionKey = rc4K(exportedSessionKey, am.EncryptedRandomSessionKey)
+	}
+	return exportedSessionKey, nil
+}
+
+// checkAVPairs checks the channel bindings and the MIC of an AUTHENTICATE
+// message msg against the AV pairs of its NTLMv2 response.
+func (s *Server) checkAVPairs(pairs []AVPair, msg, exportedSessionKey []byte) error {
+	var avFlags uint32
+	var bindings []byte
+	for _, p := range pairs {
+		switch p.ID {
+		case MsvAvFlags:
+			if len(p.Value) == 4 {
+				avFlags = binary.LittleEndian.Uint32(p.Value)
+			}
+		case MsvAvChannelBindings:
+			bindings = p.Value
+		}
+	}
+	if s.ChannelBindings != nil && !hmac.Equal(bindings, s.ChannelBindings.Hash()) {
+		return fmt.Errorf("%w: channel bindings don't match", ErrAuthenticationFailed)
+	}
+	if avFlags&msvAvFlagMIC == 0 {
+		if s.RequireMIC {
+			return fmt.Errorf("%w: MIC required", ErrAuthenticationFailed)
+		}
+		return nil
+	}
+	// the MIC follows the fixed fields and the version
+	if len(msg) < micOffset+16 {
+		return &ParseError{AuthenticateMessageType, "MIC", errors.New("message too short")}
+	}
+	mic := msg[micOffset : micOffset+16]
+	zeroed := append([]byte{}, msg...)
+	clear(zeroed[micOffset : micOffset+16])
+	if !hmac.Equal(hmacMd5(exportedSessionKey, s.transcript[0], s.transcript[1], zeroed), mic) {
+		return fmt.Errorf("%w: MIC doesn't match", ErrAuthenticationFailed)
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package ntlmssp
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// runHandshake runs a complete handshake between c and s.
+func runHandshake(c *Client, s *Server) error {
+	negotiate, err := c.Step(nil)
+	if err != nil {
+		return err
+	}
+	challenge, err := s.Step(negotiate)
+	if err != nil {
+		return err
+	}
+	authenticate, err := c.Step(challenge)
+	if err != nil {
+		return err
+	}
+	_, err = s.Step(authenticate)
+	return err
+}
+
+func testServer(password string) *Server {
+	return &Server{
+		TargetName:   "DOMAIN",
+		ComputerName: "SERVER",
+		Hash: func(domain, user string) ([]byte, error) {
+			if domain != "isis" || user != "malory" {
+				return nil, errors.New("unknown user")
+			}
+			return GetNtlmHash(password), nil
+		},
+	}
+}
+
+func TestServer(t *testing.T) {
+	c := &Client{Domain: "isis", User: "malory", Password: "guest", Sign: true, Seal: true}
+	s := testServer("guest")
+	if err := runHandshake(c, s); err != nil {
+		t.Fatal(err)
+	}
+	if domain, user := s.User(); domain != "isis" || user != "malory" {
+		t.Fatalf("expected isis\\malory, got %s\\%s", domain, user)
+	}
+	if !bytes.Equal(c.Session().SessionKey(), s.Session().SessionKey()) {
+		t.Fatal("client and server disagree on the session key")
+	}
+	sealed, signature, err := c.Session().Seal([]byte("Plaintext"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := s.Session().Unseal(sealed, signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg) != "Plaintext" {
+		t.Fatalf("expected Plaintext, got %q", msg)
+	}
+}
+
+func TestServerWrongPassword(t *testing.T) {
+	c := &Client{Domain: "isis", User: "malory", Password: "guest"}
+	if err := runHandshake(c, testServer("secret")); !errors.Is(err, ErrAuthenticationFailed) {
+		t.Fatalf("expected ErrAuthenticationFailed, got %v", err)
+	}
+}
+
+func TestServerAnonymous(t *testing.T) {
+	if err := runHandshake(&Client{}, testServer("guest")); err == nil {
+		t.Fatal("expected anonymous authentication to be refused")
+	}
+}
+
+func TestSessionRekey(t *testing.T) {
+	c := &Client{Domain: "isis", User: "malory", Password: "guest", Sign: true}
+	s := testServer("guest")
+	if err := runHandshake(c, s); err != nil {
+		t.Fatal(err)
+	}
+	session := c.Session()
+	oldKey := session.SessionKey()
+	for i := 0; i < 3; i++ {
+		signature, err := session.Sign([]byte("before"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Session().Verify([]byte("before"), signature); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s = testServer("guest")
+	if err := session.Rekey(&Client{Domain: "isis", User: "malory", Password: "guest", Sign: true}, s.Step); err != nil {
+		t.Fatal(err)
+	}
+	newKey := session.SessionKey()
+	if bytes.Equal(newKey, oldKey) {
+		t.Fatal("expected the session key to change")
+	}
+	for i := 0; i < 3; i++ {
+		signature, err := session.Sign([]byte("after"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Session().Verify([]byte("after"), signature); err != nil {
+			t.Fatalf("message %d after rekeying: %v", i, err)
+		}
+	}
+
+	// a failed handshake leaves the keys alone
+	if err := session.Rekey(&Client{Domain: "isis", User: "malory", Password: "wrong"}, testServer("guest").Step); err == nil {
+		t.Fatal("expected rekeying with the wrong password to fail")
+	}
+	if !bytes.Equal(session.SessionKey(), newKey) {
+		t.Fatal("expected the session key to be kept")
+	}
+}
+
+func TestVerifyAuthenticate(t *testing.T) {
+	c := &Client{Domain: "isis", User: "malory", Password: "guest", Sign: true}
+	s := testServer("guest")
+	negotiate, err := c.Step(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	challenge, err := s.Step(negotiate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authenticate, err := c.Step(challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	domain, user, sessionKey, err := VerifyAuthenticate(challenge, authenticate, GetNtlmHash("guest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if domain != "isis" || user != "malory" {
+		t.Fatalf("expected isis\\malory, got %s\\%s", domain, user)
+	}
+	if !bytes.Equal(sessionKey, c.Session().SessionKey()) {
+		t.Fatal("client and server disagree on the session key")
+	}
+
+	if _, _, _, err := VerifyAuthenticate(challenge, authenticate, GetNtlmHash("secret")); !errors.Is(err, ErrAuthenticationFailed) {
+		t.Fatalf("expected ErrAuthenticationFailed, got %v", err)
+	}
+}
@@ -0,0 +1,297 @@
+package ntlmssp
+
+import (
+	"crypto/cipher"
+	"crypto/hmac"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"sync"
+)
+
+// magic constants used to derive the signing and sealing keys, see
+// https://msdn.microsoft.com/en-us/library/cc236711.aspx
+const (
+	clientSigningMagic = "session key to client-to-server signing key magic constant\x00"
+	serverSigningMagic = "session key to server-to-client signing key magic constant\x00"
+	clientSealingMagic = "session key to client-to-server sealing key magic constant\x00"
+	serverSealingMagic = "session key to server-to-client sealing key magic constant\x00"
+)
+
+const signatureSize = 16
+
+// Session provides message integrity and confidentiality using the keys
+// established by an NTLM handshake, as described in
+// https://msdn.microsoft.com/en-us/library/cc236702.aspx . A Session is safe
+// for concurrent use, but since every message consumes a sequence number the
+// peer must process messages in the order they were signed or sealed.
+type Session struct {
+	flags      negotiateFlags
+	sessionKey []byte
+
+	mu       sync.Mutex
+	out, in  sessionKeys
+	outSeqNo uint32
+	inSeqNo  uint32
+}
+
+// sessionKeys holds the keys for a single direction of the session.
+type sessionKeys struct {
+	signingKey []byte
+	handle     cipher.Stream
+}
+
+// newSession derives the signing and sealing keys from the exported session
+// key. client determines which keys are used for outgoing messages.
+func newSession(flags negotiateFlags, exportedSessionKey []byte, client bool) *Session {
+	if len(exportedSessionKey) == 0 {
+		// anonymous sessions have no keys to sign or seal with
+		flags.Unset(negotiateFlagNTLMSSPNEGOTIATESIGN | negotiateFlagNTLMSSPNEGOTIATESEAL)
+		return &Session{flags: flags}
+	}
+	s := &Session{flags: flags, sessionKey: exportedSessionKey}
+	clientKeys := sessionKeys{
+		signingKey: signKey(flags, exportedSessionKey, clientSigningMagic),
+		handle:     newRC4(sealKey(flags, exportedSessionKey, clientSealingMagic)),
+	}
+	serverKeys := sessionKeys{
+		signingKey: signKey(flags, exportedSessionKey, serverSigningMagic),
+		handle:     newRC4(sealKey(flags, exportedSessionKey, serverSealingMagic)),
+	}
+	if client {
+		s.out, s.in = clientKeys, serverKeys
+	} else {
+		s.out, s.in = serverKeys, clientKeys
+	}
+	return s
+}
+
+func signKey(flags negotiateFlags, key []byte, magic string) []byte {
+	if !flags.Has(negotiateFlagNTLMSSPNEGOTIATEEXTENDEDSESSIONSECURITY) {
+		return nil
+	}
+	h := backend.newMD5()
+	h.Write(key)
+	h.Write([]byte(magic))
+	return h.Sum(nil)
+}
+
+func sealKey(flags negotiateFlags, key []byte, magic string) []byte {
+	if !flags.Has(negotiateFlagNTLMSSPNEGOTIATEEXTENDEDSESSIONSECURITY) {
+		// NTLMSSP_NEGOTIATE_LM_KEY isn't supported, so the key is used as is
+		return key
+	}
+	switch {
+	case flags.Has(negotiateFlagNTLMSSPNEGOTIATE128):
+	case flags.Has(negotiateFlagNTLMSSPNEGOTIATE56):
+		key = key[:7]
+	default:
+		key = key[:5]
+	}
+	h := backend.newMD5()
+	h.Write(key)
+	h.Write([]byte(magic))
+	return h.Sum(nil)
+}
+
+// SessionKey returns the exported session key of the handshake, which is
+// nil for anonymous sessions.
+func (s *Session) SessionKey() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sessionKey
+}
+
+// Rekey runs a new handshake with c and replaces the keys of the session with
+// the fresh ones, e.g. to rotate the keys of a long-lived session without
+// tearing down the connection. exchange sends a message to the server and
+// returns its response; the response to the AUTHENTICATE message is ignored.
+//
+// The keys are only replaced once the handshake has completed, and the swap
+// is atomic: every message is signed or sealed either with the old keys or
+// with the new ones, whose sequence numbers start again at zero. Callers must
+// make sure that the peer switches to the new keys at the same point in the
+// message stream, e.g. by not sending messages while rekeying. If the
+// handshake fails, the session keeps its keys.
+func (s *Session) Rekey(c *Client, exchange func(msg []byte) ([]byte, error)) error {
+	negotiate, err := c.Step(nil)
+	if err != nil {
+		return err
+	}
+	challenge, err := exchange(negotiate)
+	if err != nil {
+		return err
+	}
+	authenticate, err := c.Step(challenge)
+	if err != nil {
+		return err
+	}
+	if _, err := exchange(authenticate); err != nil {
+		return err
+	}
+	fresh := c.Session()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.flags, s.sessionKey = fresh.flags, fresh.sessionKey
+	s.out, s.in = fresh.out, fresh.in
+	s.outSeqNo, s.inSeqNo = 0, 0
+	return nil
+}
+
+// NegotiatedFlags returns the negotiate flags both sides agreed to, i.e. the
+// flags of the CHALLENGE message that were also set in the AUTHENTICATE
+// message, as defined by MS-NLMP.
+func (s *Session) NegotiatedFlags() uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return uint32(s.flags)
+}
+
+// dummySignature is the signature used when NTLMSSP_NEGOTIATE_ALWAYS_SIGN
+// was negotiated without NTLMSSP_NEGOTIATE_SIGN or NTLMSSP_NEGOTIATE_SEAL.
+var dummySignature = []byte{1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+
+// canSign reports whether the session has real signatures, which is also the
+// case for sessions that only negotiated sealing.
+func (s *Session) canSign() bool {
+	return s.flags.Has(negotiateFlagNTLMSSPNEGOTIATESIGN) || s.flags.Has(negotiateFlagNTLMSSPNEGOTIATESEAL)
+}
+
+// alwaysSignOnly reports whether the session only carries dummy signatures.
+func (s *Session) alwaysSignOnly() bool {
+	return !s.canSign() && s.flags.Has(negotiateFlagNTLMSSPNEGOTIATEALWAYSSIGN)
+}
+
+// Sign returns the signature of an outgoing message. If only
+// NTLMSSP_NEGOTIATE_ALWAYS_SIGN was negotiated, this is a dummy signature.
+func (s *Session) Sign(msg []byte) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.alwaysSignOnly() {
+		return append([]byte{}, dummySignature...), nil
+	}
+	if !s.canSign() {
+		return nil, errors.New("signing was not negotiated")
+	}
+	return s.mac(&s.out, &s.outSeqNo, msg), nil
+}
+
+// Verify checks the signature of an incoming message. If only
+// NTLMSSP_NEGOTIATE_ALWAYS_SIGN was negotiated, only the dummy signature is
+// accepted.
+func (s *Session) Verify(msg, signature []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.alwaysSignOnly() {
+		if !hmac.Equal(signature, dummySignature) {
+			return errors.New("invalid message signature")
+		}
+		return nil
+	}
+	if !s.canSign() {
+		return errors.New("signing was not negotiated")
+	}
+	if !hmac.Equal(s.mac(&s.in, &s.inSeqNo, msg), signature) {
+		return errors.New("invalid message signature")
+	}
+	return nil
+}
+
+// Seal encrypts an outgoing message, returning the encrypted message and its
+// signature.
+func (s *Session) Seal(msg []byte) (sealed, signature []byte, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.flags.Has(negotiateFlagNTLMSSPNEGOTIATESEAL) {
+		return nil, nil, errors.New("sealing was not negotiated")
+	}
+	sealed = make([]byte, len(msg))
+	s.out.handle.XORKeyStream(sealed, msg)
+	return sealed, s.mac(&s.out, &s.outSeqNo, msg), nil
+}
+
+// Unseal decrypts an incoming message and checks its signature.
+func (s *Session) Unseal(sealed, signature []byte) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.flags.Has(negotiateFlagNTLMSSPNEGOTIATESEAL) {
+		return nil, errors.New("sealing was not negotiated")
+	}
+	msg := make([]byte, len(sealed))
+	s.in.handle.XORKeyStream(msg, sealed)
+	if !hmac.Equal(s.mac(&s.in, &s.inSeqNo, msg), signature) {
+		return nil, errors.New("invalid message signature")
+	}
+	return msg, nil
+}
+
+// Wrap returns the GSS_Wrap token of an outgoing message, i.e. the message
+// followed by its 16 byte NTLMSSP_MESSAGE_SIGNATURE. As with GSS-API NTLM
+// mechanisms, the message is sealed whenever the session negotiated sealing,
+// so that Unwrap can tell from the session alone; conf only demands it, and
+// fails if sealing wasn't negotiated.
+func (s *Session) Wrap(msg []byte, conf bool) ([]byte, error) {
+	if s.sealing() {
+		sealed, signature, err := s.Seal(msg)
+		if err != nil {
+			return nil, err
+		}
+		return append(sealed, signature...), nil
+	}
+	if conf {
+		return nil, errors.New("sealing was not negotiated")
+	}
+	signature, err := s.Sign(msg)
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]byte{}, msg...), signature...), nil
+}
+
+// Unwrap checks and, if the session negotiated sealing, decrypts a token
+// produced by the peer's Wrap. conf reports whether the message was sealed.
+func (s *Session) Unwrap(token []byte) (msg []byte, conf bool, err error) {
+	if len(token) < signatureSize {
+		return nil, false, errors.New("wrap token is too short")
+	}
+	payload, signature := token[:len(token)-signatureSize], token[len(token)-signatureSize:]
+	if s.sealing() {
+		msg, err := s.Unseal(payload, signature)
+		return msg, err == nil, err
+	}
+	if err := s.Verify(payload, signature); err != nil {
+		return nil, false, err
+	}
+	return append([]byte{}, payload...), false, nil
+}
+
+// sealing reports whether the session negotiated sealing.
+func (s *Session) sealing() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.flags.Has(negotiateFlagNTLMSSPNEGOTIATESEAL)
+}
+
+// mac computes an NTLMSSP_MESSAGE_SIGNATURE and advances the sequence number,
+// see https://msdn.microsoft.com/en-us/library/cc236702.aspx
+func (s *Session) mac(keys *sessionKeys, seqNo *uint32, msg []byte) []byte {
+	sig := make([]byte, signatureSize)
+	binary.LittleEndian.PutUint32(sig[0:], 1)
+	if s.flags.Has(negotiateFlagNTLMSSPNEGOTIATEEXTENDEDSESSIONSECURITY) {
+		binary.LittleEndian.PutUint32(sig[12:], *seqNo)
+		mac := hmacMd5(keys.signingKey, sig[12:], msg)
+		copy(sig[4:12], mac)
+		if s.flags.Has(negotiateFlagNTLMSSPNEGOTIATEKEYEXCH) {
+			keys.handle.XORKeyStream(sig[4:12], sig[4:12])
+		}
+	} else {
+		// RandomPad, Checksum and SeqNum are all encrypted in turn, after
+		// which RandomPad is reset to zero
+		binary.LittleEndian.PutUint32(sig[8:], crc32.ChecksumIEEE(msg))
+		keys.handle.XORKeyStream(sig[4:16], sig[4:16])
+		binary.LittleEndian.PutUint32(sig[4:], 0)
+		binary.LittleEndian.PutUint32(sig[12:], binary.LittleEndian.Uint32(sig[12:])^*seqNo)
+	}
+	*seqNo++
+	return sig
+}
@@ -0,0 +1,212 @@
+package ntlmssp
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"testing"
+)
+
+// test vectors from https://msdn.microsoft.com/en-us/library/cc236621.aspx
+// section 4.2.4 (NTLMv2 Authentication)
+
+var specFlags negotiateFlags = 0xe28a8233
+var specServerChallenge = []byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef}
+var specClientChallenge = bytes.Repeat([]byte{0xaa}, 8)
+var specRandomSessionKey = bytes.Repeat([]byte{0x55}, 16)
+var specTargetInfo = []byte{
+	0x02, 0x00, 0x0c, 0x00, 0x44, 0x00, 0x6f, 0x00, 0x6d, 0x00, 0x61, 0x00, 0x69, 0x00, 0x6e, 0x00,
+	0x01, 0x00, 0x0c, 0x00, 0x53, 0x00, 0x65, 0x00, 0x72, 0x00, 0x76, 0x00, 0x65, 0x00, 0x72, 0x00,
+	0x00, 0x00, 0x00, 0x00,
+}
+
+func unhex(t testing.TB, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestSessionKeyExchange(t *testing.T) {
+	ntlmV2Hash := getNtlmV2Hash("Password", "User", "Domain")
+	if expected := unhex(t, "0c868a403bfd7a93a3001ef22ef02e3f"); !bytes.Equal(ntlmV2Hash, expected) {
+		t.Fatalf("expected NTOWFv2 %x, got %x", expected, ntlmV2Hash)
+	}
+	response := computeNtlmV2Response(ntlmV2Hash, specServerChallenge, specClientChallenge, make([]byte, 8), specTargetInfo)
+	if expected := unhex(t, "68cd0ab851e51c96aabc927bebef6a1c"); !bytes.Equal(response[:16], expected) {
+		t.Fatalf("expected NTProofStr %x, got %x", expected, response[:16])
+	}
+	sessionBaseKey := computeSessionBaseKey(ntlmV2Hash, response[:16])
+	if expected := unhex(t, "8de40ccadbc14a82f15cb0ad0de95ca3"); !bytes.Equal(sessionBaseKey, expected) {
+		t.Fatalf("expected session base key %x, got %x", expected, sessionBaseKey)
+	}
+	encryptedSessionKey := rc4K(sessionBaseKey, specRandomSessionKey)
+	if expected := unhex(t, "c5dad2544fc9799094ce1ce90bc9d03e"); !bytes.Equal(encryptedSessionKey, expected) {
+		t.Fatalf("expected encrypted session key %x, got %x", expected, encryptedSessionKey)
+	}
+}
+
+func TestSessionSeal(t *testing.T) {
+	client := newSession(specFlags, specRandomSessionKey, true)
+	sealed, signature, err := client.Seal(toUnicode("Plaintext"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := unhex(t, "54e50165bf1936dc996020c1811b0f06fb5f"); !bytes.Equal(sealed, expected) {
+		t.Fatalf("expected sealed message %x, got %x", expected, sealed)
+	}
+	if expected := unhex(t, "010000007fb38ec5c55d497600000000"); !bytes.Equal(signature, expected) {
+		t.Fatalf("expected signature %x, got %x", expected, signature)
+	}
+}
+
+func TestSessionRoundTrip(t *testing.T) {
+	for _, flags := range []negotiateFlags{
+		specFlags,
+		specFlags &^ negotiateFlagNTLMSSPNEGOTIATEKEYEXCH,
+		specFlags &^ negotiateFlagNTLMSSPNEGOTIATEEXTENDEDSESSIONSECURITY,
+	} {
+		client := newSession(flags, specRandomSessionKey, true)
+		server := newSession(flags, specRandomSessionKey, false)
+		for i, msg := range []string{"first message", "second message"} {
+			signature, err := client.Sign([]byte(msg))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := server.Verify([]byte(msg), signature); err != nil {
+				t.Fatalf("flags %08x, message %d: %v", uint32(flags), i, err)
+			}
+			sealed, signature, err := server.Seal([]byte(msg))
+			if err != nil {
+				t.Fatal(err)
+			}
+			unsealed, err := client.Unseal(sealed, signature)
+			if err != nil {
+				t.Fatalf("flags %08x, message %d: %v", uint32(flags), i, err)
+			}
+			if string(unsealed) != msg {
+				t.Fatalf("expected %q, got %q", msg, unsealed)
+			}
+		}
+		signature, _ := client.Sign([]byte("tampered"))
+		if err := server.Verify([]byte("Tampered"), signature); err == nil {
+			t.Fatalf("flags %08x: expected tampered message to fail verification", uint32(flags))
+		}
+	}
+}
+
+func TestSessionAlwaysSignOnly(t *testing.T) {
+	flags := negotiateFlagNTLMSSPNEGOTIATEALWAYSSIGN |
+		negotiateFlagNTLMSSPNEGOTIATEEXTENDEDSESSIONSECURITY |
+		negotiateFlagNTLMSSPNEGOTIATE128 |
+		negotiateFlagNTLMSSPNEGOTIATEUNICODE
+	client := newSession(flags, specRandomSessionKey, true)
+	server := newSession(flags, specRandomSessionKey, false)
+
+	// keys are derived regardless of whether signing was negotiated
+	expected := md5.Sum(append(append([]byte{}, specRandomSessionKey...), clientSigningMagic...))
+	if !bytes.Equal(client.out.signingKey, expected[:]) || !bytes.Equal(server.in.signingKey, expected[:]) {
+		t.Fatalf("expected client signing key %x, got %x and %x", expected, client.out.signingKey, server.in.signingKey)
+	}
+	expected = md5.Sum(append(append([]byte{}, specRandomSessionKey...), serverSigningMagic...))
+	if !bytes.Equal(client.in.signingKey, expected[:]) || !bytes.Equal(server.out.signingKey, expected[:]) {
+		t.Fatalf("expected server signing key %x, got %x and %x", expected, client.in.signingKey, server.out.signingKey)
+	}
+
+	signature, err := client.Sign([]byte("message"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(signature, dummySignature) {
+		t.Fatalf("expected dummy signature, got %x", signature)
+	}
+	if err := server.Verify([]byte("message"), signature); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Verify([]byte("message"), unhex(t, "010000007fb38ec5c55d497600000000")); err == nil {
+		t.Fatal("expected a non-dummy signature to be rejected")
+	}
+}
+
+func TestSessionSealOnly(t *testing.T) {
+	for _, flags := range []negotiateFlags{
+		specFlags &^ negotiateFlagNTLMSSPNEGOTIATESIGN,
+		specFlags &^ (negotiateFlagNTLMSSPNEGOTIATESIGN | negotiateFlagNTLMSSPNEGOTIATEALWAYSSIGN),
+	} {
+		client := newSession(flags, specRandomSessionKey, true)
+		server := newSession(flags, specRandomSessionKey, false)
+		// sealing without signing yields the same signature as with it
+		sealed, signature, err := client.Seal(toUnicode("Plaintext"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := unhex(t, "010000007fb38ec5c55d497600000000"); !bytes.Equal(signature, expected) {
+			t.Fatalf("flags %08x: expected signature %x, got %x", uint32(flags), expected, signature)
+		}
+		unsealed, err := server.Unseal(sealed, signature)
+		if err != nil {
+			t.Fatalf("flags %08x: %v", uint32(flags), err)
+		}
+		if !bytes.Equal(unsealed, toUnicode("Plaintext")) {
+			t.Fatalf("flags %08x: expected Plaintext, got %q", uint32(flags), unsealed)
+		}
+		// and messages that are only signed carry real signatures too
+		signature, err = server.Sign([]byte("message"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Equal(signature, dummySignature) {
+			t.Fatalf("flags %08x: expected a real signature", uint32(flags))
+		}
+		if err := client.Verify([]byte("message"), signature); err != nil {
+			t.Fatalf("flags %08x: %v", uint32(flags), err)
+		}
+	}
+}
+
+func TestSessionWrap(t *testing.T) {
+	for _, tc := range []struct {
+		flags negotiateFlags
+		conf  bool
+	}{
+		{specFlags, true},
+		{specFlags &^ negotiateFlagNTLMSSPNEGOTIATESEAL, false},
+	} {
+		client := newSession(tc.flags, specRandomSessionKey, true)
+		server := newSession(tc.flags, specRandomSessionKey, false)
+		for i, msg := range []string{"first message", "second message"} {
+			token, err := client.Wrap([]byte(msg), tc.conf)
+			if err != nil {
+				t.Fatalf("flags %08x: %v", uint32(tc.flags), err)
+			}
+			if len(token) != len(msg)+signatureSize {
+				t.Fatalf("flags %08x: expected a %d byte token, got %d", uint32(tc.flags), len(msg)+signatureSize, len(token))
+			}
+			if sealed := string(token[:len(msg)]) != msg; sealed != tc.conf {
+				t.Fatalf("flags %08x: expected sealed %v, got %v", uint32(tc.flags), tc.conf, sealed)
+			}
+			unwrapped, conf, err := server.Unwrap(token)
+			if err != nil {
+				t.Fatalf("flags %08x, message %d: %v", uint32(tc.flags), i, err)
+			}
+			if string(unwrapped) != msg || conf != tc.conf {
+				t.Fatalf("flags %08x: expected %q with conf %v, got %q with conf %v", uint32(tc.flags), msg, tc.conf, unwrapped, conf)
+			}
+		}
+		token, _ := client.Wrap([]byte("tampered"), tc.conf)
+		token[0] ^= 1
+		if _, _, err := server.Unwrap(token); err == nil {
+			t.Fatalf("flags %08x: expected a tampered token to fail", uint32(tc.flags))
+		}
+	}
+
+	// confidentiality can't be had without sealing
+	client := newSession(specFlags&^negotiateFlagNTLMSSPNEGOTIATESEAL, specRandomSessionKey, true)
+	if _, err := client.Wrap([]byte("message"), true); err == nil {
+		t.Fatal("expected Wrap with conf to fail without sealing")
+	}
+	if _, _, err := client.Unwrap(make([]byte, signatureSize-1)); err == nil {
+		t.Fatal("expected a token shorter than a signature to be refused")
+	}
+}
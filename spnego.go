@@ -0,0 +1,129 @@
+package ntlmssp
+
+import (
+	"encoding/asn1"
+	"errors"
+)
+
+// states of a SPNEGO negotiation, see RFC 4178
+const (
+	negStateAcceptCompleted  = 0
+	negStateAcceptIncomplete = 1
+	negStateReject           = 2
+	negStateRequestMIC       = 3
+)
+
+// mechanism OIDs of SPNEGO and the mechanisms it negotiates
+var (
+	oidSPNEGO     = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 2}
+	oidKerberos   = asn1.ObjectIdentifier{1, 2, 840, 113554, 1, 2, 2}
+	oidMSKerberos = asn1.ObjectIdentifier{1, 2, 840, 48018, 1, 2, 2} // as sent by Windows
+	oidNTLM       = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 2, 2, 10}
+)
+
+// negTokenInit is the NegTokenInit of RFC 4178. Servers that hint at the
+// mechanisms they support send a NegTokenInit2 instead, which starts alike.
+type negTokenInit struct {
+	MechTypes   []asn1.ObjectIdentifier `asn1:"explicit,tag:0"`
+	MechToken   []byte                  `asn1:"explicit,optional,tag:2"`
+	MechListMIC []byte                  `asn1:"explicit,optional,tag:3"`
+}
+
+// wrapNegTokenInit wraps the initial token of the first of mechs in a
+// SPNEGO NegTokenInit, framed as a GSS-API InitialContextToken.
+func wrapNegTokenInit(mechs []asn1.ObjectIdentifier, token []byte) ([]byte, error) {
+	inner, err := asn1.Marshal(negTokenInit{MechTypes: mechs, MechToken: token})
+	if err != nil {
+		return nil, err
+	}
+	negToken, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: inner})
+	if err != nil {
+		return nil, err
+	}
+	mech, err := asn1.Marshal(oidSPNEGO)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(asn1.RawValue{Class: asn1.ClassApplication, Tag: 0, IsCompound: true, Bytes: append(mech, negToken...)})
+}
+
+// parseNegTokenInit parses a NegotiationToken holding a NegTokenInit or
+// NegTokenInit2, with or without the GSS-API framing.
+func parseNegTokenInit(data []byte) (*negTokenInit, error) {
+	var token asn1.RawValue
+	if _, err := asn1.Unmarshal(data, &token); err != nil {
+		return nil, err
+	}
+	if token.Class == asn1.ClassApplication && token.Tag == 0 {
+		var mech asn1.ObjectIdentifier
+		rest, err := asn1.Unmarshal(token.Bytes, &mech)
+		if err != nil {
+			return nil, err
+		}
+		if !mech.Equal(oidSPNEGO) {
+			return nil, errors.New("not a SPNEGO token")
+		}
+		if _, err := asn1.Unmarshal(rest, &token); err != nil {
+			return nil, err
+		}
+	}
+	if token.Class != asn1.ClassContextSpecific || token.Tag != 0 {
+		return nil, errors.New("not a SPNEGO NegTokenInit")
+	}
+	var init negTokenInit
+	if _, err := asn1.Unmarshal(token.Bytes, &init); err != nil {
+		return nil, err
+	}
+	return &init, nil
+}
+
+// negTokenResp is the NegTokenResp of RFC 4178. NegState is -1 if absent.
+type negTokenResp struct {
+	NegState      asn1.Enumerated       `asn1:"explicit,optional,tag:0,default:-1"`
+	SupportedMech asn1.ObjectIdentifier `asn1:"explicit,optional,tag:1"`
+	ResponseToken []byte                `asn1:"explicit,optional,tag:2"`
+	MechListMIC   []byte                `asn1:"explicit,optional,tag:3"`
+}
+
+// parseNegTokenResp parses a NegotiationToken holding a NegTokenResp.
+func parseNegTokenResp(data []byte) (*negTokenResp, error) {
+	var token asn1.RawValue
+	if rest, err := asn1.Unmarshal(data, &token); err != nil {
+		return nil, err
+	} else if len(rest) > 0 {
+		return nil, errors.New("trailing data after SPNEGO token")
+	}
+	if token.Class != asn1.ClassContextSpecific || token.Tag != 1 {
+		return nil, errors.New("not a SPNEGO NegTokenResp")
+	}
+	var resp negTokenResp
+	if _, err := asn1.Unmarshal(token.Bytes, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// unwrapNegotiate returns the NTLM message carried by a token sent under the
+// Negotiate scheme. That is the mechToken of a SPNEGO NegTokenInit or the
+// response token of a NegTokenResp, but some clients and misconfigured
+// servers send the raw NTLM message instead. wrapped reports whether the
+// token was SPNEGO, tokens that are neither are returned as they are.
+func unwrapNegotiate(data []byte) (msg []byte, wrapped bool) {
+	if token, err := parseNegTokenResp(data); err == nil && len(token.ResponseToken) > 0 {
+		return token.ResponseToken, true
+	}
+	if token, err := parseNegTokenInit(data); err == nil && len(token.MechToken) > 0 {
+		return token.MechToken, true
+	}
+	return data, false
+}
+
+// wrapNegTokenResp wraps an NTLM message in a SPNEGO NegTokenResp, to answer
+// a server that wrapped its challenge.
+func wrapNegTokenResp(msg []byte) ([]byte, error) {
+	inner, err := asn1.Marshal(negTokenResp{NegState: -1, ResponseToken: msg})
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 1, IsCompound: true, Bytes: inner})
+}
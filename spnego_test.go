@@ -0,0 +1,204 @@
+package ntlmssp
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// NegTokenResp tokens with just a negState
+var (
+	acceptCompletedToken = []byte{0xa1, 0x07, 0x30, 0x05, 0xa0, 0x03, 0x0a, 0x01, 0x00}
+	rejectToken          = []byte{0xa1, 0x07, 0x30, 0x05, 0xa0, 0x03, 0x0a, 0x01, 0x02}
+)
+
+func TestParseNegTokenResp(t *testing.T) {
+	for _, tc := range []struct {
+		token    []byte
+		negState int
+	}{
+		{acceptCompletedToken, negStateAcceptCompleted},
+		{rejectToken, negStateReject},
+		{[]byte{0xa1, 0x02, 0x30, 0x00}, -1},
+	} {
+		resp, err := parseNegTokenResp(tc.token)
+		if err != nil {
+			t.Fatalf("%x: %v", tc.token, err)
+		}
+		if int(resp.NegState) != tc.negState {
+			t.Errorf("%x: expected negState %d, got %d", tc.token, tc.negState, resp.NegState)
+		}
+	}
+	if _, err := parseNegTokenResp(unhex(t, exampleChallenge)); err == nil {
+		t.Error("expected an NTLM message not to parse as NegTokenResp")
+	}
+}
+
+func TestNegotiatorMutualAuth(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		token      []byte
+		status     int
+		mutualAuth bool
+		err        error
+		rejected   bool
+	}{
+		// NTLM doesn't authenticate the server
+		{"accept-completed", acceptCompletedToken, http.StatusOK, false, nil, false},
+		{"reject", rejectToken, http.StatusOK, false, ErrMutualAuthRejected, false},
+		// the AUTHENTICATE message itself was rejected
+		{"reject with 401", rejectToken, http.StatusUnauthorized, false, nil, true},
+		{"no token", nil, http.StatusOK, false, nil, false},
+	} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			var msgs [][]byte
+			recorder(func(http.ResponseWriter, *http.Request) {}, &msgs)(w, req)
+			switch {
+			case len(msgs) == 0:
+				w.Header().Set("WWW-Authenticate", "Negotiate")
+				w.WriteHeader(http.StatusUnauthorized)
+			case msgs[0][8] == 3 && tc.token != nil:
+				w.Header().Set("WWW-Authenticate", "Negotiate "+base64.StdEncoding.EncodeToString(tc.token))
+				w.WriteHeader(tc.status)
+			default:
+				handler(w, req)
+			}
+		}))
+		req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth("isis\\malory", "guest")
+		r, err := Negotiator{}.Authenticate(req)
+		server.Close()
+		var rejected *RejectedError
+		if errors.As(err, &rejected) {
+			rejected.Response.Body.Close()
+			if !tc.rejected || rejected.Reason != RejectCredentials {
+				t.Errorf("%s: unexpected rejection %v", tc.name, err)
+			}
+			continue
+		}
+		if tc.rejected {
+			t.Errorf("%s: expected a *RejectedError, got %v", tc.name, err)
+			continue
+		}
+		if !errors.Is(err, tc.err) {
+			t.Errorf("%s: expected error %v, got %v", tc.name, tc.err, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		r.Response.Body.Close()
+		if r.MutualAuth != tc.mutualAuth {
+			t.Errorf("%s: expected MutualAuth %v, got %v", tc.name, tc.mutualAuth, r.MutualAuth)
+		}
+	}
+}
+
+func TestNegotiatorWrappedChallenge(t *testing.T) {
+	for _, wrap := range []bool{false, true} {
+		var authenticateWrapped bool
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			_, authz, _ := strings.Cut(req.Header.Get("Authorization"), " ")
+			data, _ := base64.StdEncoding.DecodeString(authz)
+			msg, wrapped := unwrapNegotiate(data)
+			switch {
+			case len(msg) > 8 && msg[8] == 1:
+				challenge := unhex(t, exampleChallenge)
+				if wrap {
+					var err error
+					if challenge, err = wrapNegTokenResp(challenge); err != nil {
+						panic(err)
+					}
+				}
+				w.Header().Set("WWW-Authenticate", "Negotiate "+base64.StdEncoding.EncodeToString(challenge))
+				w.WriteHeader(http.StatusUnauthorized)
+			case len(msg) > 8 && msg[8] == 3:
+				authenticateWrapped = wrapped
+				if _, _, err := unmarshal(msg); err != nil {
+					w.WriteHeader(http.StatusUnauthorized)
+				}
+			default:
+				w.Header().Set("WWW-Authenticate", "Negotiate")
+				w.WriteHeader(http.StatusUnauthorized)
+			}
+		}))
+		req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth("isis\\malory", "guest")
+		resp, err := Negotiator{}.RoundTrip(req)
+		server.Close()
+		if err != nil {
+			t.Fatalf("wrapped %v: %v", wrap, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("wrapped %v: unexpected status %v", wrap, resp.Status)
+		}
+		if authenticateWrapped != wrap {
+			t.Errorf("wrapped %v: expected the AUTHENTICATE message to be wrapped alike", wrap)
+		}
+	}
+}
+
+func TestNegotiatorNegotiateOnly(t *testing.T) {
+	for _, raw := range []bool{false, true} {
+		var negotiateWrapped, authenticateWrapped bool
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			scheme, authz, _ := strings.Cut(req.Header.Get("Authorization"), " ")
+			data, _ := base64.StdEncoding.DecodeString(authz)
+			if scheme != "Negotiate" || len(data) == 0 {
+				w.Header().Set("WWW-Authenticate", "Negotiate")
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			msg, wrapped := unwrapNegotiate(data)
+			switch {
+			case len(msg) > 8 && msg[8] == 1:
+				if init, err := parseNegTokenInit(data); err == nil {
+					negotiateWrapped = len(init.MechTypes) == 1 && init.MechTypes[0].Equal(oidNTLM)
+				}
+				challenge, err := wrapNegTokenResp(unhex(t, exampleChallenge))
+				if err != nil {
+					panic(err)
+				}
+				w.Header().Set("WWW-Authenticate", "Negotiate "+base64.StdEncoding.EncodeToString(challenge))
+				w.WriteHeader(http.StatusUnauthorized)
+			case len(msg) > 8 && msg[8] == 3:
+				authenticateWrapped = wrapped
+				if _, _, err := unmarshal(msg); err != nil {
+					w.WriteHeader(http.StatusUnauthorized)
+				}
+			default:
+				w.WriteHeader(http.StatusBadRequest)
+			}
+		}))
+		req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth("isis\\malory", "guest")
+		resp, err := Negotiator{RawNegotiate: raw}.RoundTrip(req)
+		server.Close()
+		if err != nil {
+			t.Fatalf("raw %v: %v", raw, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("raw %v: unexpected status %v", raw, resp.Status)
+		}
+		if negotiateWrapped == raw {
+			t.Errorf("raw %v: unexpected NegTokenInit wrapping %v of the NEGOTIATE message", raw, negotiateWrapped)
+		}
+		if !authenticateWrapped {
+			t.Errorf("raw %v: expected the AUTHENTICATE message in a NegTokenResp", raw)
+		}
+	}
+}
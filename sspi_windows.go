@@ -0,0 +1,123 @@
+//go:build windows
+
+package ntlmssp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	secur32                        = syscall.NewLazyDLL("secur32.dll")
+	procAcquireCredentialsHandleW  = secur32.NewProc("AcquireCredentialsHandleW")
+	procInitializeSecurityContextW = secur32.NewProc("InitializeSecurityContextW")
+	procDeleteSecurityContext      = secur32.NewProc("DeleteSecurityContext")
+	procFreeCredentialsHandle      = secur32.NewProc("FreeCredentialsHandle")
+	procFreeContextBuffer          = secur32.NewProc("FreeContextBuffer")
+)
+
+const (
+	secEOK               = 0
+	secIContinueNeeded   = 0x00090312
+	secpkgCredOutbound   = 2
+	iscReqConnection     = 0x00000800
+	iscReqAllocateMemory = 0x00000100
+	securityNativeDrep   = 0x00000010
+	secbufferVersion     = 0
+	secbufferToken       = 2
+)
+
+// secHandle is the SecHandle structure, used for both credential and context
+// handles.
+type secHandle struct {
+	lower, upper uintptr
+}
+
+// secBuffer is the SecBuffer structure.
+type secBuffer struct {
+	size       uint32
+	bufferType uint32
+	buffer     *byte
+}
+
+// secBufferDesc is the SecBufferDesc structure.
+type secBufferDesc struct {
+	version uint32
+	count   uint32
+	buffers *secBuffer
+}
+
+// sspiClient runs an NTLM handshake with the Windows SSPI.
+type sspiClient struct {
+	target  *uint16
+	cred    secHandle
+	ctx     secHandle
+	haveCtx bool
+}
+
+// SSPIClient returns an NTLMClient for Negotiator.NewClient that runs the
+// handshake with the Windows SSPI, as the logged-on user. The target name is
+// the SPN of the request's host, i.e. that of its Host if set.
+func SSPIClient(req *http.Request) (NTLMClient, error) {
+	target, err := syscall.UTF16PtrFromString("HTTP/" + requestHost(req))
+	if err != nil {
+		return nil, err
+	}
+	pkg, err := syscall.UTF16PtrFromString("NTLM")
+	if err != nil {
+		return nil, err
+	}
+	c := &sspiClient{target: target}
+	var expiry syscall.Filetime
+	r, _, _ := procAcquireCredentialsHandleW.Call(0, uintptr(unsafe.Pointer(pkg)), secpkgCredOutbound,
+		0, 0, 0, 0, uintptr(unsafe.Pointer(&c.cred)), uintptr(unsafe.Pointer(&expiry)))
+	if r != secEOK {
+		return nil, fmt.Errorf("ntlmssp: AcquireCredentialsHandle: %w", syscall.Errno(r))
+	}
+	return c, nil
+}
+
+// Step returns the message SSPI built, which is sent as it is.
+func (c *sspiClient) Step(in []byte) ([]byte, error) {
+	var input *secBufferDesc
+	var ctx *secHandle
+	if in != nil {
+		if !c.haveCtx || len(in) == 0 {
+			return nil, errors.New("ntlmssp: unexpected CHALLENGE message")
+		}
+		input = &secBufferDesc{secbufferVersion, 1, &secBuffer{uint32(len(in)), secbufferToken, &in[0]}}
+		ctx = &c.ctx
+	}
+	out := secBuffer{bufferType: secbufferToken}
+	output := secBufferDesc{secbufferVersion, 1, &out}
+	var attrs uint32
+	var expiry syscall.Filetime
+	r, _, _ := procInitializeSecurityContextW.Call(
+		uintptr(unsafe.Pointer(&c.cred)), uintptr(unsafe.Pointer(ctx)), uintptr(unsafe.Pointer(c.target)),
+		iscReqConnection|iscReqAllocateMemory, 0, securityNativeDrep, uintptr(unsafe.Pointer(input)), 0,
+		uintptr(unsafe.Pointer(&c.ctx)), uintptr(unsafe.Pointer(&output)),
+		uintptr(unsafe.Pointer(&attrs)), uintptr(unsafe.Pointer(&expiry)))
+	if r != secEOK && r != secIContinueNeeded {
+		return nil, fmt.Errorf("ntlmssp: InitializeSecurityContext: %w", syscall.Errno(r))
+	}
+	c.haveCtx = true
+	if out.buffer == nil {
+		return nil, nil
+	}
+	defer procFreeContextBuffer.Call(uintptr(unsafe.Pointer(out.buffer)))
+	return bytes.Clone(unsafe.Slice(out.buffer, out.size)), nil
+}
+
+// Close releases the context and the credentials of the handshake.
+func (c *sspiClient) Close() error {
+	if c.haveCtx {
+		procDeleteSecurityContext.Call(uintptr(unsafe.Pointer(&c.ctx)))
+		c.haveCtx = false
+	}
+	procFreeCredentialsHandle.Call(uintptr(unsafe.Pointer(&c.cred)))
+	return nil
+}
@@ -0,0 +1,41 @@
+//go:build windows
+
+package ntlmssp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestSSPIClientPassThrough(t *testing.T) {
+	var msgs [][]byte
+	server := httptest.NewServer(recorder(handler, &msgs))
+	defer server.Close()
+	var client *recordingClient
+	negotiator := Negotiator{NewClient: func(req *http.Request) (NTLMClient, error) {
+		c, err := SSPIClient(req)
+		if err != nil {
+			return nil, err
+		}
+		client = &recordingClient{client: c}
+		return client, nil
+	}}
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := negotiator.RoundTrip(req)
+	if err != nil {
+		t.Skipf("SSPI can't run the handshake: %v", err)
+	}
+	resp.Body.Close()
+	if len(client.msgs) != 2 {
+		t.Fatalf("expected SSPI to build 2 messages, got %d", len(client.msgs))
+	}
+	// the messages are sent with the flags and version SSPI chose
+	if !reflect.DeepEqual(msgs, client.msgs) {
+		t.Fatalf("expected the SSPI messages to be sent unchanged, sent %x, got %x", client.msgs, msgs)
+	}
+}
@@ -0,0 +1,23 @@
+package ntlmssp
+
+// TokenProvider adapts a Client to database drivers that take a token
+// provider for integrated authentication, e.g. over SQL Server's TDS
+// protocol. Its methods match the IntegratedAuthenticator interface of
+// go-mssqldb, so that it can be returned from an integratedauth provider.
+type TokenProvider struct {
+	Client *Client
+}
+
+// InitialBytes returns the NEGOTIATE message sent with the login.
+func (p TokenProvider) InitialBytes() ([]byte, error) {
+	return p.Client.Step(nil)
+}
+
+// NextBytes returns the AUTHENTICATE message in response to the CHALLENGE
+// message received from the server.
+func (p TokenProvider) NextBytes(challenge []byte) ([]byte, error) {
+	return p.Client.Step(challenge)
+}
+
+// Free is a no-op, the Client holds no resources besides memory.
+func (p TokenProvider) Free() {}
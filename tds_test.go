@@ -0,0 +1,29 @@
+package ntlmssp
+
+import "testing"
+
+func TestTokenProvider(t *testing.T) {
+	p := TokenProvider{&Client{Domain: "isis", User: "malory", Password: "guest"}}
+	defer p.Free()
+	initial, err := p.InitialBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if typ, _, err := ParseMessage(initial); err != nil || typ != NegotiateMessageType {
+		t.Fatalf("expected a NEGOTIATE message, got %v (%v)", typ, err)
+	}
+	next, err := p.NextBytes(unhex(t, exampleChallenge))
+	if err != nil {
+		t.Fatal(err)
+	}
+	typ, m, err := ParseMessage(next)
+	if err != nil || typ != AuthenticateMessageType {
+		t.Fatalf("expected an AUTHENTICATE message, got %v (%v)", typ, err)
+	}
+	if am := m.(*AuthenticateMessage); am.Domain != "isis" || am.User != "malory" {
+		t.Fatalf("expected isis\\malory, got %s\\%s", am.Domain, am.User)
+	}
+	if _, err := p.NextBytes(unhex(t, exampleChallenge)); err == nil {
+		t.Fatal("expected an error once the handshake is complete")
+	}
+}
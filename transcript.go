@@ -0,0 +1,67 @@
+package ntlmssp
+
+import "time"
+
+// Transcript records the messages of a handshake, e.g. to reproduce a
+// customer issue later. It can be serialized with encoding/json, the messages
+// are then base64 encoded.
+type Transcript struct {
+	Negotiate    []byte `json:"negotiate"`
+	Challenge    []byte `json:"challenge"`
+	Authenticate []byte `json:"authenticate"`
+	// NegotiatedFlags are those of the established session, see
+	// Session.NegotiatedFlags, or 0 if the messages came from an
+	// NTLMClient other than Client.
+	NegotiatedFlags uint32 `json:"negotiatedFlags"`
+	// ClientChallenge is the client challenge of the NTLMv2 response, nil
+	// for other responses.
+	ClientChallenge []byte `json:"clientChallenge,omitempty"`
+}
+
+func newTranscript(negotiate, challenge, authenticate []byte, session *Session) *Transcript {
+	t := &Transcript{
+		Negotiate:    append([]byte{}, negotiate...),
+		Challenge:    append([]byte{}, challenge...),
+		Authenticate: append([]byte{}, authenticate...),
+	}
+	if session != nil {
+		t.NegotiatedFlags = session.NegotiatedFlags()
+	}
+	if v2, err := t.ntlmV2(); err == nil {
+		t.ClientChallenge = v2.ClientChallenge
+	}
+	return t
+}
+
+// ntlmV2 returns the NTLMv2 response of the AUTHENTICATE message.
+func (t *Transcript) ntlmV2() (*NTLMv2Response, error) {
+	am, err := parseAuthenticateMessage(t.Authenticate)
+	if err != nil {
+		return nil, err
+	}
+	return am.NTLMv2()
+}
+
+// Verify checks the recorded AUTHENTICATE message against the NT hash of the
+// user's password, like a server would, see VerifyAuthenticate.
+func (t *Transcript) Verify(ntHash []byte) (domain, user string, err error) {
+	domain, user, _, err = VerifyAuthenticate(t.Challenge, t.Authenticate, ntHash)
+	return domain, user, err
+}
+
+// Replay runs the handshake of c against the recorded CHALLENGE message,
+// with the recorded client challenge and timestamp, and returns the
+// AUTHENTICATE message. Unless a random session key was exchanged, it is the
+// recorded one if c has the same credentials and options.
+func (t *Transcript) Replay(c *Client) ([]byte, error) {
+	v2, err := t.ntlmV2()
+	if err != nil {
+		return nil, err
+	}
+	c.ClientChallenge = v2.ClientChallenge
+	c.Now = func() time.Time { return v2.Timestamp }
+	if _, err := c.Step(nil); err != nil {
+		return nil, err
+	}
+	return c.Step(t.Challenge)
+}
@@ -0,0 +1,68 @@
+package ntlmssp
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTranscript(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+	var transcripts []*Transcript
+	negotiator := Negotiator{Transcript: func(t *Transcript) { transcripts = append(transcripts, t) }}
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("isis\\malory", "guest")
+	resp, err := negotiator.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if len(transcripts) != 1 {
+		t.Fatalf("expected a transcript, got %d", len(transcripts))
+	}
+
+	data, err := json.Marshal(transcripts[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var transcript Transcript
+	if err := json.Unmarshal(data, &transcript); err != nil {
+		t.Fatal(err)
+	}
+	if len(transcript.ClientChallenge) != 8 || transcript.NegotiatedFlags == 0 {
+		t.Fatalf("incomplete transcript: %s", data)
+	}
+
+	domain, user, err := transcript.Verify(GetNtlmHash("guest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if domain != "isis" || user != "malory" {
+		t.Fatalf("expected isis\\malory, got %s\\%s", domain, user)
+	}
+	if _, _, err := transcript.Verify(GetNtlmHash("secret")); err == nil {
+		t.Fatal("expected the wrong password to be refused")
+	}
+
+	msg, err := transcript.Replay(&Client{Domain: "isis", User: "malory", Password: "guest"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayed, err := parseAuthenticateMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorded, err := parseAuthenticateMessage(transcript.Authenticate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(replayed.NtChallengeResponse, recorded.NtChallengeResponse) {
+		t.Fatalf("expected NTLMv2 response %x, got %x", recorded.NtChallengeResponse, replayed.NtChallengeResponse)
+	}
+}
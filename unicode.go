@@ -1,29 +1,53 @@
 package ntlmssp
 
 import (
-	"bytes"
 	"encoding/binary"
 	"errors"
 	"unicode/utf16"
+	"unicode/utf8"
 )
 
 // helper func's for dealing with Windows Unicode (UTF16LE)
 
+// EncodeUTF16LE encodes s as UTF-16LE, the Unicode encoding of NTLM
+// messages. Characters outside the Basic Multilingual Plane are encoded as
+// surrogate pairs, invalid UTF-8 as U+FFFD.
+func EncodeUTF16LE(s string) []byte {
+	u := utf16.Encode([]rune(s))
+	b := make([]byte, 2*len(u))
+	for i, c := range u {
+		binary.LittleEndian.PutUint16(b[2*i:], c)
+	}
+	return b
+}
+
+// DecodeUTF16LE decodes UTF-16LE data. Unpaired surrogates and a trailing
+// odd byte are decoded as U+FFFD.
+func DecodeUTF16LE(d []byte) string {
+	u := make([]uint16, len(d)/2)
+	for i := range u {
+		u[i] = binary.LittleEndian.Uint16(d[2*i:])
+	}
+	s := string(utf16.Decode(u))
+	if len(d)%2 > 0 {
+		s += string(utf8.RuneError)
+	}
+	return s
+}
+
 func fromUnicode(d []byte) (string, error) {
 	if len(d)%2 > 0 {
 		return "", errors.New("Unicode (UTF 16 LE) specified, but uneven data length")
 	}
-	s := make([]uint16, len(d)/2)
-	err := binary.Read(bytes.NewReader(d), binary.LittleEndian, &s)
-	if err != nil {
-		return "", err
-	}
-	return string(utf16.Decode(s)), nil
+	return DecodeUTF16LE(d), nil
 }
 
 func toUnicode(s string) []byte {
-	uints := utf16.Encode([]rune(s))
-	b := bytes.Buffer{}
-	binary.Write(&b, binary.LittleEndian, &uints)
-	return b.Bytes()
+	return EncodeUTF16LE(s)
+}
+
+// toOEM encodes s for the OEM code page, which isn't known, so ASCII is
+// assumed.
+func toOEM(s string) []byte {
+	return []byte(s)
 }
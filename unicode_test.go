@@ -0,0 +1,42 @@
+package ntlmssp
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestUTF16LE(t *testing.T) {
+	for _, tc := range []struct {
+		s string
+		b []byte
+	}{
+		{"", []byte{}},
+		{"User", []byte{'U', 0, 's', 0, 'e', 0, 'r', 0}},
+		{"Ünïcødé", []byte{0xdc, 0, 'n', 0, 0xef, 0, 'c', 0, 0xf8, 0, 'd', 0, 0xe9, 0}},
+		{"日本", []byte{0xe5, 0x65, 0x2c, 0x67}},
+		// U+1F600 is encoded as the surrogate pair D83D DE00
+		{"a\U0001F600", []byte{'a', 0, 0x3d, 0xd8, 0x00, 0xde}},
+	} {
+		if b := EncodeUTF16LE(tc.s); !bytes.Equal(b, tc.b) {
+			t.Errorf("EncodeUTF16LE(%q): expected %x, got %x", tc.s, tc.b, b)
+		}
+		if s := DecodeUTF16LE(tc.b); s != tc.s {
+			t.Errorf("DecodeUTF16LE(%x): expected %q, got %q", tc.b, tc.s, s)
+		}
+	}
+}
+
+func TestDecodeUTF16LEMalformed(t *testing.T) {
+	for _, tc := range []struct {
+		b []byte
+		s string
+	}{
+		{[]byte{'a', 0, 'b'}, "a�"},
+		{[]byte{0x3d, 0xd8}, "�"},
+		{[]byte{0x00, 0xde, 'a', 0}, "�a"},
+	} {
+		if s := DecodeUTF16LE(tc.b); s != tc.s {
+			t.Errorf("DecodeUTF16LE(%x): expected %q, got %q", tc.b, tc.s, s)
+		}
+	}
+}
@@ -2,8 +2,12 @@ package ntlmssp
 
 import (
 	"errors"
+	"fmt"
 )
 
+// maxVarFieldLen is the length of the longest payload a varField can hold.
+const maxVarFieldLen = 0xFFFF
+
 type varField struct {
 	Len          uint16
 	MaxLen       uint16
@@ -11,10 +15,11 @@ type varField struct {
 }
 
 func (f varField) ReadFrom(buffer []byte) ([]byte, error) {
-	if len(buffer) < int(f.BufferOffset+uint32(f.Len)) {
+	end := uint64(f.BufferOffset) + uint64(f.Len)
+	if uint64(len(buffer)) < end {
 		return nil, errors.New("Error reading data, varField extends beyond buffer")
 	}
-	return buffer[f.BufferOffset : f.BufferOffset+uint32(f.Len)], nil
+	return buffer[f.BufferOffset:end], nil
 }
 
 func (f varField) ReadStringFrom(buffer []byte, unicode bool) (string, error) {
@@ -38,3 +43,12 @@ func newVarField(ptr *int, fieldsize int) varField {
 	*ptr += fieldsize
 	return f
 }
+
+// checkVarFieldLen returns an error if a payload of fieldsize bytes is too long
+// for a varField, rather than letting newVarField truncate its length.
+func checkVarFieldLen(name string, fieldsize int) error {
+	if fieldsize > maxVarFieldLen {
+		return fmt.Errorf("ntlmssp: %s is %d bytes long, at most %d fit in a message", name, fieldsize, maxVarFieldLen)
+	}
+	return nil
+}
@@ -1,5 +1,9 @@
 package ntlmssp
 
+// NTLMSSPRevisionW2K3 is the NTLMRevisionCurrent of the current version of
+// the protocol, NTLMSSP_REVISION_W2K3.
+const NTLMSSPRevisionW2K3 = 0x0F
+
 // Version is a struct representing https://msdn.microsoft.com/en-us/library/cc236654.aspx
 type Version struct {
 	ProductMajorVersion uint8
@@ -15,6 +19,15 @@ func DefaultVersion() Version {
 		ProductMajorVersion: 6,
 		ProductMinorVersion: 1,
 		ProductBuild:        7601,
-		NTLMRevisionCurrent: 15,
+		NTLMRevisionCurrent: NTLMSSPRevisionW2K3,
+	}
+}
+
+// withRevision returns v with a zero NTLMRevisionCurrent replaced by
+// NTLMSSPRevisionW2K3.
+func (v Version) withRevision() Version {
+	if v.NTLMRevisionCurrent == 0 {
+		v.NTLMRevisionCurrent = NTLMSSPRevisionW2K3
 	}
+	return v
 }